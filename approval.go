@@ -0,0 +1,284 @@
+package servercontrol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultApprovalTTL = time.Hour
+
+// DeployRequest is an update_service call waiting for a caller other than
+// the one that made it to approve it.
+type DeployRequest struct {
+	ID             string `json:"id"`
+	Hash           string `json:"hash"`
+	Ref            string `json:"ref,omitempty"`
+	OverrideFreeze bool   `json:"override_freeze,omitempty"`
+	Caller         string `json:"caller"`
+	Created        string `json:"created"`
+	Expires        string `json:"expires"`
+}
+
+// pendingDeploy is a DeployRequest with the scopes of who made it, which
+// the deployment runs with once approved
+type pendingDeploy struct {
+	DeployRequest
+	Scopes  []Scope `json:"scopes"`
+	expires time.Time
+}
+
+func (p *pendingDeploy) caller() Caller {
+	return Caller{Name: p.Caller, Scopes: p.Scopes}
+}
+
+// approvals holds the deploy requests made to this server, in a JSON file
+// when there is one so they survive the restarts deployments make
+type approvals struct {
+	mu      sync.Mutex
+	path    string
+	pending map[string]*pendingDeploy
+}
+
+func openApprovals(path string) (*approvals, error) {
+
+	a := &approvals{path: path, pending: map[string]*pendingDeploy{}}
+	if path == "" {
+		return a, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	list := []*pendingDeploy{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, p := range list {
+		if p.expires, err = time.Parse(time.RFC3339, p.Expires); err != nil {
+			return nil, fmt.Errorf("%s: deploy request %s: %v", path, p.ID, err)
+		}
+		a.pending[p.ID] = p
+	}
+	return a, nil
+}
+
+// save rewrites the file, the caller holds mu
+func (a *approvals) save() error {
+
+	if a.path == "" {
+		return nil
+	}
+
+	list := make([]*pendingDeploy, 0, len(a.pending))
+	for _, p := range a.pending {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created < list[j].Created })
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+// prune drops expired requests, the caller holds mu
+func (a *approvals) prune(log *fieldLogger) {
+
+	now := time.Now()
+	pruned := false
+	for id, p := range a.pending {
+		if now.After(p.expires) {
+			log.info("deploy request expired", field("request", id), field(FieldHash, p.Hash), field("caller", p.Caller))
+			delete(a.pending, id)
+			pruned = true
+		}
+	}
+	if pruned {
+		if err := a.save(); err != nil {
+			log.error("unable to save deploy requests", errField(err))
+		}
+	}
+}
+
+// add records p, unless its caller already has a request pending for the
+// same hash, which is returned instead
+func (a *approvals) add(p *pendingDeploy, log *fieldLogger) (*pendingDeploy, error) {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.prune(log)
+	for _, existing := range a.pending {
+		if existing.Caller == p.Caller && existing.Hash == p.Hash {
+			return existing, nil
+		}
+	}
+	a.pending[p.ID] = p
+	if err := a.save(); err != nil {
+		delete(a.pending, p.ID)
+		return nil, err
+	}
+	return p, nil
+}
+
+func (a *approvals) get(id string) (*pendingDeploy, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p, ok := a.pending[id]
+	return p, ok
+}
+
+// take removes the request with id, reporting whether it was still there
+func (a *approvals) take(id string, log *fieldLogger) bool {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.pending[id]; !ok {
+		return false
+	}
+	delete(a.pending, id)
+	if err := a.save(); err != nil {
+		log.error("unable to save deploy requests", errField(err))
+	}
+	return true
+}
+
+func (a *approvals) list(log *fieldLogger) []DeployRequest {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.prune(log)
+	list := make([]DeployRequest, 0, len(a.pending))
+	for _, p := range a.pending {
+		list = append(list, p.DeployRequest)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created < list[j].Created })
+	return list
+}
+
+// needsApproval is whether update_service from the caller of req only
+// makes a deploy request
+func (sc *ServerControl) needsApproval(req *http.Request) bool {
+
+	if !sc.config.RequireApproval {
+		return false
+	}
+	name := callerName(req)
+	for _, exempt := range sc.config.ApprovalExempt {
+		if exempt == name {
+			return false
+		}
+	}
+	return true
+}
+
+// requestApproval answers update_service with a pending deploy request
+func (sc *ServerControl) requestApproval(res http.ResponseWriter, req *http.Request, props defaultProps) {
+
+	caller, _ := CallerFromContext(req.Context())
+	now := time.Now()
+	expires := now.Add(sc.config.ApprovalTTL)
+
+	log := sc.requestLog(props)
+	p, err := sc.approvals.add(&pendingDeploy{
+		DeployRequest: DeployRequest{
+			ID:             newDeploymentID(),
+			Hash:           props.Hash,
+			Ref:            props.Ref,
+			OverrideFreeze: props.OverrideFreeze,
+			Caller:         caller.Name,
+			Created:        now.UTC().Format(time.RFC3339Nano),
+			Expires:        expires.UTC().Format(time.RFC3339),
+		},
+		Scopes:  caller.Scopes,
+		expires: expires,
+	}, sc.log)
+	if err != nil {
+		log.error("unable to save deploy requests", errField(err))
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+		return
+	}
+
+	log.info("deploy awaiting approval", field("request", p.ID), field("caller", p.Caller))
+
+	res.Header().Add("Content-Type", "application/json")
+	res.WriteHeader(http.StatusAccepted)
+	if j, err := ToJsonString(p.DeployRequest); err == nil {
+		fmt.Fprint(res, j)
+	} else {
+		fmt.Fprintf(res, "%s", err.Error())
+	}
+}
+
+// approve deploys a pending request made by another caller, answering as
+// update_service would have. The deployment is recorded as made by the
+// requester and approved by the caller. The request is only used up once
+// the deployment holds the deploy lock.
+func (sc *ServerControl) approve(res http.ResponseWriter, req *http.Request) {
+
+	props := struct {
+		ID string `json:"id"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&props); err != nil || props.ID == "" {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(res, "id of the deploy request needed")
+		return
+	}
+
+	p, ok := sc.approvals.get(props.ID)
+	switch {
+	case !ok:
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "no deploy request %s", props.ID)
+		return
+	case time.Now().After(p.expires):
+		sc.approvals.take(p.ID, sc.log)
+		res.WriteHeader(http.StatusGone)
+		fmt.Fprintf(res, "deploy request %s expired at %s", p.ID, p.Expires)
+		return
+	case p.Caller == callerName(req):
+		sc.log.warn("refused approval of own deploy request", field("request", p.ID), field("caller", p.Caller))
+		res.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(res, "a deploy request needs approving by someone other than who made it")
+		return
+	}
+
+	deployProps := defaultProps{Hash: p.Hash, Ref: p.Ref, OverrideFreeze: p.OverrideFreeze,
+		Approves: p.ID, ApprovedBy: callerName(req)}
+	requester := req.WithContext(context.WithValue(req.Context(), callerKey{}, p.caller()))
+	sc.deploy(res, requester, deployProps, "deploy")
+}
+
+// deployRequests serves the deploy requests waiting for approval
+func (sc *ServerControl) deployRequests(res http.ResponseWriter, req *http.Request) {
+
+	res.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate")
+	res.Header().Add("Content-Type", "application/json")
+
+	if j, err := ToJsonString(sc.approvals.list(sc.log)); err == nil {
+		fmt.Fprint(res, j)
+	} else {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+	}
+}
@@ -0,0 +1,373 @@
+package servercontrol
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const auditDetailLimit = 512
+
+// AuditEntry is one line of the audit log. Every entry carries the hash of
+// the one before it and its own hash covers that, so editing, dropping or
+// reordering lines breaks the chain from that point on.
+type AuditEntry struct {
+	Seq       int64  `json:"seq"`
+	Time      string `json:"time"`
+	Action    string `json:"action"`
+	Caller    string `json:"caller"`
+	Remote    string `json:"remote"`
+	Instance  string `json:"instance_id,omitempty"`
+	Hash      string `json:"hash,omitempty"`
+	Ref       string `json:"ref,omitempty"`
+	Status    int    `json:"status"`
+	Outcome   string `json:"outcome"`
+	Detail    string `json:"detail,omitempty"`
+	PrevHash  string `json:"prev_hash"`
+	EntryHash string `json:"entry_hash,omitempty"`
+}
+
+func (e AuditEntry) computeHash() (string, error) {
+
+	e.EntryHash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(append([]byte(e.PrevHash+"\n"), data...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+type auditLog struct {
+	mu       sync.Mutex
+	path     string
+	seq      int64
+	lastHash string
+}
+
+// openAuditLog picks the chain up where an existing log left off, after
+// truncating an entry a crash left half written. Unreadable entries are
+// logged and left for the query to report, new entries follow the last
+// readable one. Only failing to read the file stops it.
+func openAuditLog(path string, log *fieldLogger) (*auditLog, error) {
+
+	l := &auditLog{path: path}
+
+	f, err := readAuditLog(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f.partial >= 0 {
+		log.warn("truncating partly written audit entry", field("path", path), field("offset", f.partial))
+		if err := os.Truncate(path, f.partial); err != nil {
+			return nil, err
+		}
+	}
+	for _, g := range f.gaps {
+		log.error("unreadable audit entry", field("path", path), field("line", g.line), errField(g.err))
+	}
+
+	if n := len(f.entries); n > 0 {
+		l.seq = f.entries[n-1].Seq
+		l.lastHash = f.entries[n-1].EntryHash
+	}
+
+	return l, nil
+}
+
+func (l *auditLog) append(e AuditEntry) error {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Seq = l.seq + 1
+	e.PrevHash = l.lastHash
+
+	hash, err := e.computeHash()
+	if err != nil {
+		return err
+	}
+	e.EntryHash = hash
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	l.seq = e.Seq
+	l.lastHash = e.EntryHash
+	return nil
+}
+
+// auditGap is a line of the audit log that isn't an entry, found before
+// entries[at]
+type auditGap struct {
+	line int
+	at   int
+	err  error
+}
+
+// auditFile is what could be read of an audit log. partial is the offset
+// of a last entry that was only partly written, -1 if none.
+type auditFile struct {
+	entries []AuditEntry
+	gaps    []auditGap
+	partial int64
+}
+
+// readAuditLog returns the entries of the log at path, noting the lines
+// that aren't entries rather than giving up on the rest
+func readAuditLog(path string) (*auditFile, error) {
+
+	r, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	f := &auditFile{entries: []AuditEntry{}}
+	f.partial, err = readJSONLines(r, func(n int, line []byte) error {
+		e := AuditEntry{}
+		if err := json.Unmarshal(line, &e); err != nil {
+			f.gaps = append(f.gaps, auditGap{line: n, at: len(f.entries), err: err})
+			return nil
+		}
+		f.entries = append(f.entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// verify returns an error naming the first entry that doesn't follow from
+// the one before it. The chain starts again after an unreadable line, so
+// the entries past one are still checked, but the log isn't valid.
+func (f *auditFile) verify() error {
+
+	prev := ""
+	g := 0
+	for i, e := range f.entries {
+		for ; g < len(f.gaps) && f.gaps[g].at == i; g++ {
+			prev = e.PrevHash
+		}
+		if e.PrevHash != prev {
+			return fmt.Errorf("audit entry %d does not follow entry %d", e.Seq, i)
+		}
+		hash, err := e.computeHash()
+		if err != nil {
+			return err
+		}
+		if hash != e.EntryHash {
+			return fmt.Errorf("audit entry %d has been modified", e.Seq)
+		}
+		prev = e.EntryHash
+	}
+
+	if len(f.gaps) > 0 {
+		return fmt.Errorf("audit log line %d is unreadable: %v", f.gaps[0].line, f.gaps[0].err)
+	}
+	return nil
+}
+
+// VerifyAuditLog checks the hash chain of the audit log at path
+func VerifyAuditLog(path string) error {
+
+	f, err := readAuditLog(path)
+	if err != nil {
+		return err
+	}
+	return f.verify()
+}
+
+// auditRecorder captures what a handler responded with
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *auditRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *auditRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if room := auditDetailLimit - r.body.Len(); room > 0 {
+		if len(b) < room {
+			room = len(b)
+		}
+		r.body.Write(b[:room])
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// audited records every call to a mutating endpoint and its outcome. It is
+// a no-op unless AuditLog is configured.
+func (sc *ServerControl) audited(action string, next http.HandlerFunc) http.HandlerFunc {
+
+	return func(res http.ResponseWriter, req *http.Request) {
+
+		if sc.audit == nil {
+			next(res, req)
+			return
+		}
+
+		props := defaultProps{}
+		if body, err := readBody(req); err == nil {
+			json.Unmarshal(body, &props)
+		}
+
+		rec := &auditRecorder{ResponseWriter: res}
+		next(rec, req)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		e := AuditEntry{
+			Time:     time.Now().UTC().Format(time.RFC3339Nano),
+			Action:   action,
+			Caller:   callerName(req),
+			Remote:   req.RemoteAddr,
+			Instance: sc.instanceID(),
+			Hash:     props.Hash,
+			Ref:      props.Ref,
+			Status:   rec.status,
+			Outcome:  "ok",
+		}
+		if wantsPlan(req, props) {
+			e.Action += "_plan"
+		}
+		if rec.status >= 400 {
+			e.Outcome = "failed"
+			e.Detail = rec.body.String()
+		}
+
+		if err := sc.audit.append(e); err != nil {
+			sc.log.error("unable to write audit log", errField(err))
+		}
+	}
+}
+
+// auditQuery serves the audit log filtered by since and until (RFC 3339),
+// action and caller, most recent limit entries, along with whether the
+// hash chain of the whole log is intact
+func (sc *ServerControl) auditQuery(res http.ResponseWriter, req *http.Request) {
+
+	res.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate")
+	res.Header().Add("Content-Type", "application/json")
+
+	if sc.audit == nil {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(res, "audit log not enabled")
+		return
+	}
+
+	q := req.URL.Query()
+
+	var since, until time.Time
+	var err error
+	if v := q.Get("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			res.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(res, "bad since: %s", err.Error())
+			return
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if until, err = time.Parse(time.RFC3339, v); err != nil {
+			res.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(res, "bad until: %s", err.Error())
+			return
+		}
+	}
+
+	limit := 1000
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			res.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(res, "bad limit")
+			return
+		}
+	}
+
+	sc.audit.mu.Lock()
+	f, err := readAuditLog(sc.audit.path)
+	sc.audit.mu.Unlock()
+	if os.IsNotExist(err) {
+		f, err = &auditFile{partial: -1}, nil
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+		return
+	}
+
+	chainErr := f.verify()
+
+	matched := []AuditEntry{}
+	for _, e := range f.entries {
+		t, _ := time.Parse(time.RFC3339Nano, e.Time)
+		switch {
+		case !since.IsZero() && t.Before(since):
+		case !until.IsZero() && t.After(until):
+		case q.Get("action") != "" && e.Action != q.Get("action"):
+		case q.Get("caller") != "" && e.Caller != q.Get("caller"):
+		default:
+			matched = append(matched, e)
+		}
+	}
+	if len(matched) > limit {
+		matched = matched[len(matched)-limit:]
+	}
+
+	result := struct {
+		ChainValid bool         `json:"chain_valid"`
+		ChainError string       `json:"chain_error,omitempty"`
+		Entries    []AuditEntry `json:"entries"`
+	}{
+		ChainValid: chainErr == nil,
+		Entries:    matched,
+	}
+	if chainErr != nil {
+		result.ChainError = chainErr.Error()
+	}
+
+	if j, err := ToJsonString(result); err == nil {
+		fmt.Fprint(res, j)
+	} else {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+	}
+}
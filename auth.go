@@ -0,0 +1,449 @@
+package servercontrol
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Requests are authenticated with an HMAC-SHA256 over the method, path,
+// query, timestamp, nonce and a hash of the body, keyed with the shared
+// secret. The timestamp must be within SignatureSkew of the server's clock
+// and a nonce is only accepted once inside that window.
+const (
+	headerTimestamp = "X-Sc-Timestamp"
+	headerNonce     = "X-Sc-Nonce"
+	headerSignature = "X-Sc-Signature"
+	headerSecret    = "X-Sc-Secret"
+	headerKey       = "X-Sc-Key"
+
+	defaultSignatureSkew = 5 * time.Minute
+)
+
+var (
+	errMissingSignature = errors.New("request not signed")
+	errBadTimestamp     = errors.New("request timestamp outside allowed skew")
+	errReplayed         = errors.New("request nonce already used")
+	errBadSignature     = errors.New("request signature mismatch")
+	errNoSecret         = errors.New("no secret configured")
+	errUnknownKey       = errors.New("unknown key")
+)
+
+// A Scope is a set of endpoints a Token may call.
+type Scope string
+
+const (
+	ScopeRead           Scope = "read"            // service_data, server_version, health, signals, auto_deploy, freeze, deploy_requests
+	ScopeBuild          Scope = "build"           // prime_build
+	ScopeRestartSelf    Scope = "restart-self"    // update_server, restart_server
+	ScopeDeployFleet    Scope = "deploy-fleet"    // update_service, approve, git_webhook, *_auto_deploy, *_scheduled_deploy
+	ScopeRollback       Scope = "rollback"        // rollback
+	ScopeOverrideFreeze Scope = "override-freeze" // deploying during a freeze with override_freeze
+	ScopeAll            Scope = "*"               // everything, what Secret grants
+)
+
+// fleetKey is the name requests signed with the shared Secret are known by
+const fleetKey = "fleet"
+
+// routeScopes maps routes, relative to Prefix, to the scope needed to call
+// them. Anything not listed needs ScopeAll.
+var routeScopes = map[string]Scope{
+	"/service_data":   ScopeRead,
+	"/server_version": ScopeRead,
+	"/metrics":        ScopeRead,
+	"/prime_build":    ScopeBuild,
+	"/update_server":  ScopeRestartSelf,
+	"/restart_server": ScopeRestartSelf,
+	"/update_service": ScopeDeployFleet,
+	"/audit":          ScopeRead,
+	"/history":        ScopeRead,
+	"/rollback":       ScopeRollback,
+	"/lock":           ScopeRead,
+	"/unlock":         ScopeAll,
+	"/health":         ScopeRead,
+	"/signals":        ScopeRead,
+	"/changelog":      ScopeRead,
+	"/git_webhook":    ScopeDeployFleet,
+
+	"/auto_deploy":        ScopeRead,
+	"/pause_auto_deploy":  ScopeDeployFleet,
+	"/resume_auto_deploy": ScopeDeployFleet,
+
+	"/freeze":                  ScopeRead,
+	"/schedule_deploy":         ScopeDeployFleet,
+	"/scheduled_deploys":       ScopeRead,
+	"/cancel_scheduled_deploy": ScopeDeployFleet,
+
+	"/approve":         ScopeDeployFleet,
+	"/deploy_requests": ScopeRead,
+}
+
+// Token is a named credential limited to some scopes. Requests made with
+// it are signed with SignRequestAs, or carry Secret in the legacy header.
+type Token struct {
+	Name   string
+	Secret string
+	Scopes []Scope
+}
+
+// Caller identifies who made a request, it's attached to the request
+// context once authenticated.
+type Caller struct {
+	Name   string
+	Scopes []Scope
+}
+
+type callerKey struct{}
+
+func (c Caller) Allowed(scope Scope) bool {
+	for _, s := range c.Scopes {
+		if s == ScopeAll || s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CallerFromContext returns the authenticated caller of a request handled
+// by servercontrol
+func CallerFromContext(ctx context.Context) (Caller, bool) {
+	c, ok := ctx.Value(callerKey{}).(Caller)
+	return c, ok
+}
+
+func callerName(req *http.Request) string {
+	if c, ok := CallerFromContext(req.Context()); ok {
+		return c.Name
+	}
+	return "unknown"
+}
+
+func validateTokens(tokens []Token) error {
+
+	names := map[string]bool{fleetKey: true}
+	for _, t := range tokens {
+		if t.Name == "" || t.Secret == "" {
+			return errors.New("tokens need a name and a secret")
+		}
+		if names[t.Name] {
+			return errors.New("duplicate token name " + t.Name)
+		}
+		names[t.Name] = true
+	}
+	return nil
+}
+
+// tokens is every credential the handler accepts, one for each active
+// shared secret first
+func (sc *ServerControl) tokens() []Token {
+
+	tokens := []Token{}
+	for _, secret := range sc.secrets.active() {
+		tokens = append(tokens, Token{Name: fleetKey, Secret: secret, Scopes: []Scope{ScopeAll}})
+	}
+	return append(tokens, sc.config.Tokens...)
+}
+
+// SignRequest signs req with the shared secret so a servercontrol handler
+// will accept it. The body is read and replaced, so it can be called on any
+// request built with http.NewRequest.
+func SignRequest(req *http.Request, secret string) error {
+	req.Header.Del(headerKey)
+	return sign(req, secret)
+}
+
+// SignRequestAs signs req with one of the handler's named Tokens
+func SignRequestAs(req *http.Request, name, secret string) error {
+	req.Header.Set(headerKey, name)
+	return sign(req, secret)
+}
+
+func sign(req *http.Request, secret string) error {
+
+	body, err := readBody(req)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(headerTimestamp, timestamp)
+	req.Header.Set(headerNonce, hex.EncodeToString(nonce))
+	req.Header.Set(headerSignature, signature(secret, req, body))
+	return nil
+}
+
+func signature(secret string, req *http.Request, body []byte) string {
+
+	bodyHash := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(req.Method + "\n" +
+		req.URL.EscapedPath() + "\n" +
+		req.URL.RawQuery + "\n" +
+		req.Header.Get(headerTimestamp) + "\n" +
+		req.Header.Get(headerNonce) + "\n" +
+		hex.EncodeToString(bodyHash[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// readBody drains req.Body and puts back a reader over the same bytes
+func readBody(req *http.Request) ([]byte, error) {
+
+	if req.Body == nil {
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// nonceCache remembers nonces until their timestamp falls out of the skew
+// window, after which the timestamp check alone rejects a replay
+type nonceCache struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{seen: map[string]time.Time{}}
+}
+
+// add records nonce and reports whether it was new
+func (c *nonceCache) add(nonce string, expires time.Time) bool {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastPrune) > time.Minute {
+		for n, e := range c.seen {
+			if e.Before(now) {
+				delete(c.seen, n)
+			}
+		}
+		c.lastPrune = now
+	}
+
+	if e, ok := c.seen[nonce]; ok && e.After(now) {
+		return false
+	}
+	c.seen[nonce] = expires
+	return true
+}
+
+func (sc *ServerControl) verifySignature(r *http.Request) (Caller, error) {
+
+	name := r.Header.Get(headerKey)
+	if name == "" {
+		name = fleetKey
+	}
+
+	candidates := []Token{}
+	for _, t := range sc.tokens() {
+		if t.Name == name {
+			candidates = append(candidates, t)
+		}
+	}
+	if len(candidates) == 0 {
+		if name == fleetKey {
+			return Caller{}, errNoSecret
+		}
+		return Caller{}, errUnknownKey
+	}
+
+	sig := r.Header.Get(headerSignature)
+	nonce := r.Header.Get(headerNonce)
+	if sig == "" || nonce == "" {
+		return Caller{}, errMissingSignature
+	}
+
+	ts, err := strconv.ParseInt(r.Header.Get(headerTimestamp), 10, 64)
+	if err != nil {
+		return Caller{}, errBadTimestamp
+	}
+
+	signedAt := time.Unix(ts, 0)
+	skew := time.Since(signedAt)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > sc.config.SignatureSkew {
+		return Caller{}, errBadTimestamp
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return Caller{}, err
+	}
+
+	var token *Token
+	for i, t := range candidates {
+		expected := signature(t.Secret, r, body)
+		if hmac.Equal([]byte(sig), []byte(expected)) && token == nil {
+			token = &candidates[i]
+		}
+	}
+	if token == nil {
+		return Caller{}, errBadSignature
+	}
+
+	// only remember nonces of requests that were signed by a peer, so
+	// garbage can't fill the cache
+	if !sc.nonces.add(nonce, signedAt.Add(sc.config.SignatureSkew)) {
+		return Caller{}, errReplayed
+	}
+
+	return Caller{Name: token.Name, Scopes: token.Scopes}, nil
+}
+
+// legacySecret accepts a plain secret from the x-sc-secret header or the
+// secret cookie, kept while a fleet migrates to signed requests
+func (sc *ServerControl) legacySecret(r *http.Request) (Caller, bool) {
+
+	if sc.config.DisableLegacyAuth {
+		return Caller{}, false
+	}
+
+	secret := r.Header.Get(headerSecret)
+	if secret == "" {
+		if cookie, err := r.Cookie("secret"); err == nil {
+			secret = cookie.Value
+		}
+	}
+	if secret == "" {
+		return Caller{}, false
+	}
+
+	// compare against every token so timing doesn't give away which matched
+	var caller Caller
+	found := false
+	for _, t := range sc.tokens() {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(t.Secret)) == 1 && !found {
+			caller = Caller{Name: t.Name, Scopes: t.Scopes}
+			found = true
+		}
+	}
+	return caller, found
+}
+
+func (sc *ServerControl) authenticate(r *http.Request) (Caller, error) {
+
+	switch sc.routeName(r.URL.Path) {
+	case gitWebhookRoute:
+		return sc.gitWebhookCaller(r)
+	case metricsRoute:
+		if caller, ok := sc.metricsCaller(r); ok {
+			return caller, nil
+		}
+	case healthRoute:
+		if caller, ok := sc.healthCaller(r); ok {
+			return caller, nil
+		}
+	}
+
+	if r.Header.Get(headerSignature) == "" {
+		if caller, ok := sc.legacySecret(r); ok {
+			return caller, nil
+		}
+	}
+
+	return sc.verifySignature(r)
+}
+
+// bearerCaller is a read only caller for a route that is public, or that
+// is called with a static bearer token rather than a token of its own
+func bearerCaller(r *http.Request, name string, public bool, token string) (Caller, bool) {
+
+	caller := Caller{Name: name, Scopes: []Scope{ScopeRead}}
+	if public {
+		return caller, true
+	}
+
+	if token == "" {
+		return Caller{}, false
+	}
+	bearer := r.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(bearer), []byte("Bearer "+token)) != 1 {
+		return Caller{}, false
+	}
+	return caller, true
+}
+
+// routeName is path relative to Prefix, the way routeScopes lists it
+func (sc *ServerControl) routeName(path string) string {
+
+	route := strings.TrimPrefix(path, sc.config.Prefix)
+	if route != "/" {
+		route = strings.TrimSuffix(route, "/")
+	}
+	return route
+}
+
+// routeScope returns the scope needed to call path
+func (sc *ServerControl) routeScope(path string) Scope {
+
+	if scope, ok := routeScopes[sc.routeName(path)]; ok {
+		return scope
+	}
+	return ScopeAll
+}
+
+func (sc *ServerControl) auth(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+
+	caller, err := sc.authenticate(r)
+	if err != nil {
+		sc.log.warn("rejected request", field("method", r.Method), field("path", r.URL.Path),
+			field("remote", r.RemoteAddr), errField(err))
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	scope := sc.routeScope(r.URL.Path)
+	if !caller.Allowed(scope) {
+		sc.log.warn("rejected request, caller lacks scope", field("method", r.Method), field("path", r.URL.Path),
+			field("remote", r.RemoteAddr), field("caller", caller.Name), field("scope", scope))
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if scope != ScopeRead {
+		sc.log.info("request", field("method", r.Method), field("path", r.URL.Path),
+			field("remote", r.RemoteAddr), field("caller", caller.Name))
+	}
+
+	next(rw, r.WithContext(context.WithValue(r.Context(), callerKey{}, caller)))
+}
+
+// signRequest authenticates an outgoing peer request, adding the legacy
+// header as well until DisableLegacyAuth is set so peers still running an
+// older version accept it
+func (sc *ServerControl) signRequest(req *http.Request, secret string) error {
+
+	if !sc.config.DisableLegacyAuth {
+		req.Header.Set(headerSecret, secret)
+	}
+	return SignRequest(req, secret)
+}
@@ -0,0 +1,319 @@
+package servercontrol
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAutoDeployMaxBackoff = 30 * time.Minute
+
+	// autoDeployCaller is who deployments of a polled branch head are
+	// audited as
+	autoDeployCaller = "auto-deploy"
+
+	// pausedSuffix tells the auto-deploy pause apart from the deploy lock
+	// in LockTable or LockFile
+	pausedSuffix = ".auto-deploy-paused"
+)
+
+// AutoDeployStatus is what this instance's branch poller last saw, and who
+// paused automatic deployments if anyone did.
+type AutoDeployStatus struct {
+	Enabled   bool          `json:"enabled"`
+	Branch    string        `json:"branch"`
+	Interval  time.Duration `json:"interval"`
+	Paused    *LockHolder   `json:"paused"`
+	LastPoll  string        `json:"last_poll,omitempty"`
+	NextPoll  string        `json:"next_poll,omitempty"`
+	Head      string        `json:"head,omitempty"`
+	Deployed  string        `json:"deployed,omitempty"`
+	Failures  int           `json:"failures"`
+	LastError string        `json:"last_error,omitempty"`
+}
+
+// autoDeployer holds the poller's status and wakes it early on resume
+type autoDeployer struct {
+	mu     sync.Mutex
+	status AutoDeployStatus
+	wake   chan struct{}
+}
+
+func newAutoDeployer(config ServerControlConfig) *autoDeployer {
+	return &autoDeployer{
+		status: AutoDeployStatus{
+			Enabled:  config.AutoDeployInterval > 0,
+			Branch:   config.Branch,
+			Interval: config.AutoDeployInterval,
+		},
+		wake: make(chan struct{}, 1),
+	}
+}
+
+func (a *autoDeployer) update(fn func(s *AutoDeployStatus)) {
+	a.mu.Lock()
+	fn(&a.status)
+	a.mu.Unlock()
+}
+
+func (a *autoDeployer) get() AutoDeployStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.status
+}
+
+// backoff doubles interval for each consecutive failure, up to max
+func backoff(interval time.Duration, failures int, max time.Duration) time.Duration {
+
+	wait := interval
+	for i := 0; i < failures && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+// pollBranch deploys the head of Branch whenever it moves, for fleets a git
+// host can't reach with a webhook. Every instance polls, the deploy lock,
+// which New insists the fleet shares, keeps them from deploying twice.
+func (sc *ServerControl) pollBranch() {
+
+	if sc.config.AutoDeployInterval <= 0 {
+		return
+	}
+
+	log := sc.log.with(field("branch", sc.config.Branch))
+	log.info("auto-deploy polling", field("interval", sc.config.AutoDeployInterval.String()))
+
+	failures := 0
+	for {
+		wait := backoff(sc.config.AutoDeployInterval, failures, sc.config.AutoDeployMaxBackoff)
+		sc.autoDeploy.update(func(s *AutoDeployStatus) {
+			s.NextPoll = time.Now().Add(wait).UTC().Format(time.RFC3339)
+		})
+
+		select {
+		case <-time.After(wait):
+		case <-sc.autoDeploy.wake:
+		}
+
+		head, err := sc.autoDeployHead(log)
+		if err != nil {
+			failures++
+			log.warn("auto-deploy failed", field(FieldHash, head), field("failures", failures), errField(err))
+		} else {
+			failures = 0
+		}
+
+		sc.autoDeploy.update(func(s *AutoDeployStatus) {
+			s.LastPoll = timestamp()
+			s.Failures = failures
+			if head != "" {
+				s.Head = head
+			}
+			if err != nil {
+				s.LastError = err.Error()
+			} else {
+				s.LastError = ""
+			}
+		})
+	}
+}
+
+// autoDeployHead resolves the head of Branch and deploys it unless it's
+// already running, auto-deploy is paused or frozen, or another deployment
+// is going on
+func (sc *ServerControl) autoDeployHead(log *fieldLogger) (string, error) {
+
+	paused, err := sc.paused.Holder()
+	if err != nil {
+		return "", err
+	}
+	if paused != nil {
+		log.debug("auto-deploy paused", field("caller", paused.Caller))
+		return "", nil
+	}
+
+	if status := sc.frozen(time.Now()); status.Frozen {
+		log.debug("auto-deploy frozen", field("freeze", status.Name))
+		return "", nil
+	}
+
+	head, err := branchHead(sc.config.RepoUrl, sc.config.Branch)
+	if err != nil {
+		return "", err
+	}
+	if head == "" {
+		return "", fmt.Errorf("no branch %s on %s", sc.config.Branch, sc.config.RepoUrl)
+	}
+
+	// the restart that ends a deployment may not have happened yet
+	if head == sc.config.Version || head == sc.autoDeploy.get().Deployed {
+		return head, nil
+	}
+
+	if holder, err := sc.lock.Holder(); err == nil && holder != nil {
+		log.info("not deploying, deploy lock held", field(FieldHash, head), field("holder", holder.describe()))
+		return head, nil
+	}
+
+	log.info("branch moved, deploying", field(FieldHash, head))
+	caller := Caller{Name: autoDeployCaller, Scopes: []Scope{ScopeDeployFleet}}
+	r, err := sc.internalRequest("/update_service", sc.audited("update_service", sc.updateService),
+		caller, defaultProps{Hash: head, Ref: sc.config.Branch})
+	if err != nil {
+		return head, err
+	}
+	if r.status >= 400 {
+		return head, fmt.Errorf("update_service returned %d: %s", r.status, strings.TrimSpace(r.body.String()))
+	}
+	if r.status == http.StatusAccepted {
+		log.info("deploy awaiting approval", field(FieldHash, head))
+		return head, nil
+	}
+
+	sc.autoDeploy.update(func(s *AutoDeployStatus) { s.Deployed = head })
+	return head, nil
+}
+
+// autoDeployStatus serves what the branch poller last saw
+func (sc *ServerControl) autoDeployStatus(res http.ResponseWriter, req *http.Request) {
+
+	res.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate")
+	res.Header().Add("Content-Type", "application/json")
+
+	status := sc.autoDeploy.get()
+
+	var err error
+	if status.Paused, err = sc.paused.Holder(); err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+		return
+	}
+
+	if j, err := ToJsonString(status); err == nil {
+		fmt.Fprint(res, j)
+	} else {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+	}
+}
+
+// pauseAutoDeploy stops automatic deployments across the fleet, for the
+// duration given as "for" or until resumed. Deploys by hand still work.
+func (sc *ServerControl) pauseAutoDeploy(res http.ResponseWriter, req *http.Request) {
+
+	props := struct {
+		For string `json:"for"`
+	}{}
+	body, err := readBody(req)
+	if err == nil && len(body) > 0 {
+		err = json.Unmarshal(body, &props)
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "%s", err.Error())
+		return
+	}
+
+	now := time.Now()
+	// a pause without an end is one that ends long after anyone cares
+	until := now.AddDate(100, 0, 0)
+	if props.For != "" {
+		d, err := time.ParseDuration(props.For)
+		if err != nil || d <= 0 {
+			res.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(res, "bad duration %q", props.For)
+			return
+		}
+		until = now.Add(d)
+	}
+
+	h, current, err := sc.pause(callerName(req), until)
+	if err == ErrLocked {
+		res.WriteHeader(http.StatusConflict)
+		if current != nil {
+			fmt.Fprintf(res, "auto-deploy already paused by %s until %s", current.Caller, current.Expires.Format(time.RFC3339))
+		} else {
+			fmt.Fprint(res, "auto-deploy already paused")
+		}
+		return
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+		return
+	}
+
+	if j, err := ToJsonString(h); err == nil {
+		fmt.Fprint(res, j)
+	} else {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+	}
+}
+
+// pause stops automatic deployments until then, returning the current
+// holder along with ErrLocked when they already are
+func (sc *ServerControl) pause(caller string, until time.Time) (*LockHolder, *LockHolder, error) {
+
+	now := time.Now()
+	h := LockHolder{
+		DeploymentID: newDeploymentID(),
+		Instance:     sc.instanceID(),
+		Caller:       caller,
+		Hash:         sc.config.Version,
+		Acquired:     now,
+		Expires:      until,
+	}
+
+	current, err := sc.paused.Acquire(h)
+	if err != nil {
+		return nil, current, err
+	}
+	sc.log.info("auto-deploy paused", field("caller", caller), field("until", until.UTC().Format(time.RFC3339)))
+	return &h, nil, nil
+}
+
+// pauseForRollback keeps the head of Branch, likely what is being rolled
+// back from, from being deployed again right after
+func (sc *ServerControl) pauseForRollback(caller string) {
+
+	if sc.config.AutoDeployInterval <= 0 && sc.config.GitWebhookToken == "" {
+		return
+	}
+	if _, _, err := sc.pause(caller, time.Now().AddDate(100, 0, 0)); err != nil && err != ErrLocked {
+		sc.log.error("unable to pause auto-deploy for rollback", errField(err))
+	}
+}
+
+// resumeAutoDeploy lifts a pause, whoever made it, and has this instance
+// poll right away
+func (sc *ServerControl) resumeAutoDeploy(res http.ResponseWriter, req *http.Request) {
+
+	holder, _ := sc.paused.Holder()
+
+	if err := sc.paused.ForceUnlock(); err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+		return
+	}
+
+	select {
+	case sc.autoDeploy.wake <- struct{}{}:
+	default:
+	}
+
+	if holder != nil {
+		sc.log.info("auto-deploy resumed", field("caller", callerName(req)), field("paused_by", holder.Caller))
+		fmt.Fprintf(res, "resumed auto-deploy paused by %s", holder.Caller)
+	} else {
+		fmt.Fprint(res, "auto-deploy was not paused")
+	}
+}
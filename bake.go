@@ -0,0 +1,312 @@
+package servercontrol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bake states of a Deployment.
+const (
+	BakeBaking = "baking"
+	BakePassed = "passed"
+	BakeFailed = "failed"
+)
+
+const (
+	defaultBakeInterval = 10 * time.Second
+
+	// bakeCaller is who automatic rollbacks are audited as
+	bakeCaller = "bake-watcher"
+)
+
+// Signals is how an instance is doing, as reported by BakeSignals and
+// served at /signals.
+type Signals struct {
+	ErrorRate float64       `json:"error_rate"`
+	Latency   time.Duration `json:"latency"`
+}
+
+// bakeBreach is a signal over its threshold, as opposed to a failure to
+// read one
+type bakeBreach struct {
+	instance string
+	reason   string
+}
+
+func (b *bakeBreach) Error() string {
+	return b.instance + ": " + b.reason
+}
+
+func validateBake(config ServerControlConfig) error {
+
+	if config.BakeTime <= 0 {
+		return nil
+	}
+	if config.HistoryFile == "" {
+		return errors.New("BakeTime needs HistoryFile")
+	}
+	if config.BakeSignals == nil && config.BakeMetricsPath == "" {
+		return errors.New("BakeTime needs BakeSignals or BakeMetricsPath")
+	}
+	if config.BakeSignals == nil && config.BakeErrorRateMetric == "" && config.BakeLatencyMetric == "" {
+		return errors.New("BakeMetricsPath needs BakeErrorRateMetric or BakeLatencyMetric")
+	}
+	if config.BakeMaxErrorRate <= 0 && config.BakeMaxLatency <= 0 {
+		return errors.New("BakeTime needs BakeMaxErrorRate or BakeMaxLatency")
+	}
+	return nil
+}
+
+// resumeBake picks up the bake of the deployment that installed this
+// version. The coordinator restarts at the end of a deployment, so it is
+// always the new process that watches.
+func (sc *ServerControl) resumeBake() {
+
+	if sc.config.BakeTime <= 0 {
+		return
+	}
+
+	d := sc.history.latest()
+	if d == nil || d.Bake != BakeBaking || d.Hash != sc.config.Version {
+		return
+	}
+	sc.bake(*d)
+}
+
+// bake samples every instance until BakeTime has passed since d finished,
+// rolling the fleet back at the first breach
+func (sc *ServerControl) bake(d Deployment) {
+
+	log := sc.log.with(field(FieldDeployment, d.ID), field(FieldHash, d.Hash), field(FieldPhase, "bake"))
+
+	finished, err := time.Parse(time.RFC3339Nano, d.Finished)
+	if err != nil {
+		log.error("unable to read when the deployment finished", errField(err))
+		return
+	}
+	until := finished.Add(sc.config.BakeTime)
+	log.info("baking", field("until", until.UTC().Format(time.RFC3339)))
+
+	for time.Now().Before(until) {
+
+		time.Sleep(sc.config.BakeInterval)
+
+		if latest := sc.history.latest(); latest == nil || latest.ID != d.ID {
+			log.info("a newer deployment started, stopped baking")
+			return
+		}
+
+		err := sc.sampleFleet(log)
+		if breach, ok := err.(*bakeBreach); ok {
+			log.error("bake failed, rolling back", field(FieldInstance, breach.instance), errField(err))
+			d.Bake = BakeFailed
+			d.BakeError = breach.Error()
+			sc.record(&d)
+
+			failed := sc.event(EventBakeFailed, defaultProps{Hash: d.Hash, DeploymentID: d.ID})
+			failed.Instance = breach.instance
+			failed.Error = breach.Error()
+			sc.events.send(failed)
+
+			sc.autoRollback(log)
+			return
+		}
+		if err != nil {
+			log.warn("unable to sample the fleet", errField(err))
+		}
+	}
+
+	log.info("bake passed")
+	d.Bake = BakePassed
+	sc.record(&d)
+}
+
+func (sc *ServerControl) sampleFleet(log *fieldLogger) error {
+
+	data, err := sc.getServiceData()
+	if err != nil {
+		return err
+	}
+
+	var sampleErr error
+	for _, instance := range data.InstanceList {
+
+		s, err := sc.sampleInstance(instance)
+		if err != nil {
+			sampleErr = fmt.Errorf("%s: %v", instance.InstanceID, err)
+			continue
+		}
+		log.debug("sampled instance", field(FieldInstance, instance.InstanceID),
+			field("error_rate", s.ErrorRate), field("latency", s.Latency))
+
+		if b := sc.breach(instance.InstanceID, s); b != nil {
+			return b
+		}
+	}
+	return sampleErr
+}
+
+// breach is the signal of s over its threshold, nil when there is none. A
+// signal at its threshold is still within it.
+func (sc *ServerControl) breach(instance string, s Signals) *bakeBreach {
+
+	if sc.config.BakeMaxErrorRate > 0 && s.ErrorRate > sc.config.BakeMaxErrorRate {
+		return &bakeBreach{instance,
+			fmt.Sprintf("error rate %g over %g", s.ErrorRate, sc.config.BakeMaxErrorRate)}
+	}
+	if sc.config.BakeMaxLatency > 0 && s.Latency > sc.config.BakeMaxLatency {
+		return &bakeBreach{instance,
+			fmt.Sprintf("latency %v over %v", s.Latency, sc.config.BakeMaxLatency)}
+	}
+	return nil
+}
+
+// sampleInstance asks the instance's servercontrol for its signals when the
+// app reports them, otherwise reads them from its metrics
+func (sc *ServerControl) sampleInstance(instance Instance) (Signals, error) {
+
+	s := Signals{}
+
+	if sc.config.BakeSignals != nil {
+		resp, err := sc.apiRequest(sc.getServiceForInstance(instance, "signals"), "GET", nil)
+		if err != nil {
+			return s, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return s, fmt.Errorf("signals returned %d", resp.StatusCode)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&s)
+		return s, err
+	}
+
+	url := fmt.Sprintf("%s://%s:%d%s", sc.config.Proto, instance.PrivateIP, sc.config.ServicePort, sc.config.BakeMetricsPath)
+	resp, err := sc.client.Get(url)
+	if err != nil {
+		return s, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s, fmt.Errorf("%s returned %d", sc.config.BakeMetricsPath, resp.StatusCode)
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := buf.ReadFrom(resp.Body); err != nil {
+		return s, err
+	}
+	if sc.config.BakeErrorRateMetric != "" {
+		if s.ErrorRate, err = promGauge(buf.Bytes(), sc.config.BakeErrorRateMetric); err != nil {
+			return s, err
+		}
+	}
+	if sc.config.BakeLatencyMetric != "" {
+		seconds, err := promGauge(buf.Bytes(), sc.config.BakeLatencyMetric)
+		if err != nil {
+			return s, err
+		}
+		s.Latency = time.Duration(seconds * float64(time.Second))
+	}
+	return s, nil
+}
+
+// promGauge finds the highest value of any series of name in the
+// Prometheus text format
+func promGauge(text []byte, name string) (float64, error) {
+
+	found := false
+	max := math.Inf(-1)
+	scanner := bufio.NewScanner(bytes.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rest := strings.TrimPrefix(line, name)
+		if rest == line {
+			continue
+		}
+		if strings.HasPrefix(rest, "{") {
+			end := strings.LastIndex(rest, "}")
+			if end < 0 {
+				continue
+			}
+			rest = rest[end+1:]
+		} else if !strings.HasPrefix(rest, " ") {
+			// a longer metric name starting with name
+			continue
+		}
+
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", name, err)
+		}
+		found = true
+		if v > max {
+			max = v
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, fmt.Errorf("no %s metric", name)
+	}
+	return max, nil
+}
+
+// autoRollback runs a rollback as if bakeCaller had asked for it, so it is
+// audited and recorded like any other
+func (sc *ServerControl) autoRollback(log *fieldLogger) {
+
+	// a bad deployment is rolled back even if a freeze started meanwhile
+	caller := Caller{Name: bakeCaller, Scopes: []Scope{ScopeRollback, ScopeOverrideFreeze}}
+	res, err := sc.internalRequest("/rollback", sc.audited("rollback", sc.rollback), caller,
+		defaultProps{OverrideFreeze: true})
+	if err != nil {
+		log.error("unable to roll back", errField(err))
+		return
+	}
+	if res.status >= 400 {
+		log.error("automatic rollback failed", field("status", res.status), field("response", res.body.String()))
+	}
+}
+
+// signals serves what BakeSignals reports for this instance
+func (sc *ServerControl) signals(res http.ResponseWriter, req *http.Request) {
+
+	res.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate")
+	res.Header().Add("Content-Type", "application/json")
+
+	if sc.config.BakeSignals == nil {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(res, "no signals registered")
+		return
+	}
+
+	s, err := sc.config.BakeSignals()
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+		return
+	}
+
+	if j, err := ToJsonString(s); err == nil {
+		fmt.Fprint(res, j)
+	} else {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+	}
+}
@@ -0,0 +1,93 @@
+package servercontrol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBakeBreach(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		maxErrors  float64
+		maxLatency time.Duration
+		signals    Signals
+		breached   bool
+	}{
+		{"healthy", 0.05, time.Second, Signals{ErrorRate: 0.01, Latency: 200 * time.Millisecond}, false},
+		{"error rate at the limit", 0.05, time.Second, Signals{ErrorRate: 0.05}, false},
+		{"error rate over the limit", 0.05, time.Second, Signals{ErrorRate: 0.0501}, true},
+		{"latency at the limit", 0.05, time.Second, Signals{Latency: time.Second}, false},
+		{"latency over the limit", 0.05, time.Second, Signals{Latency: time.Second + time.Nanosecond}, true},
+		{"both over", 0.05, time.Second, Signals{ErrorRate: 1, Latency: time.Minute}, true},
+		{"error rate unchecked", 0, time.Second, Signals{ErrorRate: 1}, false},
+		{"latency unchecked", 0.05, 0, Signals{Latency: time.Hour}, false},
+		{"no errors allowed", 0.0001, 0, Signals{ErrorRate: 0.0001}, false},
+	}
+
+	for _, tt := range tests {
+		sc := &ServerControl{config: ServerControlConfig{BakeMaxErrorRate: tt.maxErrors, BakeMaxLatency: tt.maxLatency}}
+		b := sc.breach("i-1", tt.signals)
+		if (b != nil) != tt.breached {
+			t.Errorf("%s: breach = %v, want breached %v", tt.name, b, tt.breached)
+		}
+	}
+}
+
+func TestPromGauge(t *testing.T) {
+
+	text := []byte(`# HELP app_error_rate Errors per request.
+# TYPE app_error_rate gauge
+app_error_rate{route="/a"} 0.01
+app_error_rate{route="/b",code="5xx"} 0.2 1697700000000
+app_error_rate_total 9
+app_latency_seconds 0.35
+
+app_broken {route="/"} x
+`)
+
+	tests := []struct {
+		name string
+		want float64
+		ok   bool
+	}{
+		{"app_error_rate", 0.2, true},
+		{"app_error_rate_total", 9, true},
+		{"app_latency_seconds", 0.35, true},
+		{"app_missing", 0, false},
+		{"app_latency", 0, false},
+		{"app_broken", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, err := promGauge(text, tt.name)
+		if (err == nil) != tt.ok || (tt.ok && got != tt.want) {
+			t.Errorf("promGauge(%s) = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestValidateBake(t *testing.T) {
+
+	signals := func() (Signals, error) { return Signals{}, nil }
+	tests := []struct {
+		name   string
+		config ServerControlConfig
+		ok     bool
+	}{
+		{"off", ServerControlConfig{}, true},
+		{"signals", ServerControlConfig{BakeTime: time.Minute, HistoryFile: "h", BakeSignals: signals, BakeMaxErrorRate: 0.1}, true},
+		{"metrics", ServerControlConfig{BakeTime: time.Minute, HistoryFile: "h", BakeMetricsPath: "/metrics",
+			BakeLatencyMetric: "latency", BakeMaxLatency: time.Second}, true},
+		{"no history", ServerControlConfig{BakeTime: time.Minute, BakeSignals: signals, BakeMaxErrorRate: 0.1}, false},
+		{"no signals", ServerControlConfig{BakeTime: time.Minute, HistoryFile: "h", BakeMaxErrorRate: 0.1}, false},
+		{"no metric names", ServerControlConfig{BakeTime: time.Minute, HistoryFile: "h", BakeMetricsPath: "/metrics", BakeMaxErrorRate: 0.1}, false},
+		{"no thresholds", ServerControlConfig{BakeTime: time.Minute, HistoryFile: "h", BakeSignals: signals}, false},
+	}
+
+	for _, tt := range tests {
+		if err := validateBake(tt.config); (err == nil) != tt.ok {
+			t.Errorf("%s: validateBake = %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package servercontrol
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+const changelogLimit = 500
+
+// Changelog is what moving from the From commits to To changes: Commits
+// are in To but in none of From, newest first, and Removed are in some of
+// From but not in To, as when rolling back.
+type Changelog struct {
+	From      []string `json:"from"`
+	To        string   `json:"to"`
+	Ref       string   `json:"ref,omitempty"`
+	Commits   []Commit `json:"commits"`
+	Removed   []Commit `json:"removed"`
+	Files     []string `json:"files"`
+	Truncated bool     `json:"truncated,omitempty"`
+}
+
+// Commit is one entry of a Changelog.
+type Commit struct {
+	Hash    string   `json:"hash"`
+	Author  string   `json:"author"`
+	Email   string   `json:"email"`
+	Date    string   `json:"date"`
+	Subject string   `json:"subject"`
+	Files   []string `json:"files"`
+}
+
+// git runs git in RepoDir
+func (sc *ServerControl) git(args ...string) ([]byte, error) {
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = sc.config.RepoDir
+	out, err := cmd.Output()
+	if exiterr, ok := err.(*exec.ExitError); ok {
+		return nil, fmt.Errorf("git %s: %v\n%s", args[0], err, exiterr.Stderr)
+	}
+	return out, err
+}
+
+// fetchCommits makes sure RepoDir has every hash, fetching when it doesn't
+func (sc *ServerControl) fetchCommits(hashes ...string) error {
+
+	missing := false
+	for _, h := range hashes {
+		if _, err := sc.git("cat-file", "-e", h+"^{commit}"); err != nil {
+			missing = true
+			break
+		}
+	}
+	if !missing {
+		return nil
+	}
+
+	if err := sc.fetchRefs(); err != nil {
+		return err
+	}
+
+	for _, h := range hashes {
+		if _, err := sc.git("cat-file", "-e", h+"^{commit}"); err != nil {
+			return fmt.Errorf("%s is not a commit of %s", h, sc.config.RepoUrl)
+		}
+	}
+	return nil
+}
+
+// fetchRefs fetches the remote's branches and tags. Branches go under
+// refs/remotes/servercontrol so the checkout the update script manages is
+// left alone.
+func (sc *ServerControl) fetchRefs() error {
+	_, err := sc.git("fetch", "-q", "-f", "--no-write-fetch-head", "--tags", sc.config.RepoUrl,
+		"+refs/heads/*:refs/remotes/servercontrol/*")
+	return err
+}
+
+// changelog lists what changes going from the from hashes to the to hash,
+// all of them full hashes
+func (sc *ServerControl) changelog(from []string, to string) (*Changelog, error) {
+
+	seen := map[string]bool{}
+	distinct := []string{}
+	for _, f := range from {
+		if fullHash.MatchString(f) && !seen[f] {
+			seen[f] = true
+			distinct = append(distinct, f)
+		}
+	}
+	sort.Strings(distinct)
+
+	if err := sc.fetchCommits(append([]string{to}, distinct...)...); err != nil {
+		return nil, err
+	}
+
+	cl := &Changelog{From: distinct, To: to, Commits: []Commit{}, Removed: []Commit{}}
+
+	args := []string{to}
+	if len(distinct) > 0 {
+		args = append(args, "--not")
+		args = append(args, distinct...)
+	}
+	var err error
+	if cl.Commits, cl.Truncated, err = sc.gitLog(args...); err != nil {
+		return nil, err
+	}
+
+	listed := map[string]bool{}
+	for _, f := range distinct {
+		removed, truncated, err := sc.gitLog(f, "--not", to)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range removed {
+			if !listed[c.Hash] {
+				listed[c.Hash] = true
+				cl.Removed = append(cl.Removed, c)
+			}
+		}
+		cl.Truncated = cl.Truncated || truncated
+	}
+
+	files := map[string]bool{}
+	for _, list := range [][]Commit{cl.Commits, cl.Removed} {
+		for _, c := range list {
+			for _, f := range c.Files {
+				files[f] = true
+			}
+		}
+	}
+	cl.Files = make([]string, 0, len(files))
+	for f := range files {
+		cl.Files = append(cl.Files, f)
+	}
+	sort.Strings(cl.Files)
+
+	return cl, nil
+}
+
+// gitLog reads up to changelogLimit commits of a git log revision range
+func (sc *ServerControl) gitLog(revisions ...string) ([]Commit, bool, error) {
+
+	args := []string{"log", fmt.Sprintf("--max-count=%d", changelogLimit+1), "--name-only",
+		"--format=%x1e%H%x1f%an%x1f%ae%x1f%aI%x1f%s"}
+	out, err := sc.git(append(args, revisions...)...)
+	if err != nil {
+		return nil, false, err
+	}
+
+	commits := []Commit{}
+	for _, record := range bytes.Split(out, []byte{0x1e}) {
+		lines := strings.Split(strings.TrimSpace(string(record)), "\n")
+		fields := strings.Split(lines[0], "\x1f")
+		if len(fields) != 5 {
+			continue
+		}
+		c := Commit{Hash: fields[0], Author: fields[1], Email: fields[2], Date: fields[3], Subject: fields[4], Files: []string{}}
+		for _, f := range lines[1:] {
+			if f = strings.TrimSpace(f); f != "" {
+				c.Files = append(c.Files, f)
+			}
+		}
+		commits = append(commits, c)
+	}
+
+	if len(commits) > changelogLimit {
+		return commits[:changelogLimit], true, nil
+	}
+	return commits, false, nil
+}
+
+// fleetHashes is every version the fleet is running
+func fleetHashes(data *ServiceData) []string {
+
+	hashes := []string{}
+	for _, i := range data.InstanceList {
+		hashes = append(hashes, i.GitCommitHash)
+	}
+	return hashes
+}
+
+// changelogQuery serves the changelog from the from hash, or what the fleet
+// runs without one, to the to ref, the head of Branch by default
+func (sc *ServerControl) changelogQuery(res http.ResponseWriter, req *http.Request) {
+
+	res.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate")
+	res.Header().Add("Content-Type", "application/json")
+
+	q := req.URL.Query()
+
+	to := defaultProps{Ref: q.Get("to")}
+	if to.Ref == "" {
+		to.Ref = sc.config.Branch
+	}
+	if !sc.resolveProps(res, &to) {
+		return
+	}
+
+	var from []string
+	for _, f := range q["from"] {
+		hash, err := sc.resolveRef(f)
+		if err != nil {
+			res.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(res, "unable to resolve %s\n%s", f, err.Error())
+			return
+		}
+		from = append(from, hash)
+	}
+	if len(from) == 0 {
+		data, err := sc.getServiceData()
+		if err != nil {
+			res.WriteHeader(errorStatus(err))
+			fmt.Fprintf(res, "%s", err.Error())
+			return
+		}
+		from = fleetHashes(data)
+	}
+
+	cl, err := sc.changelog(from, to.Hash)
+	if err != nil {
+		sc.log.error("unable to build changelog", errField(err))
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+		return
+	}
+	cl.Ref = to.Ref
+
+	if j, err := ToJsonString(cl); err == nil {
+		fmt.Fprint(res, j)
+	} else {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+	}
+}
@@ -0,0 +1,780 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rem7/servercontrol"
+)
+
+// builderScript replaces the go tool git_update_to_hash.sh builds with, so
+// the real script checks out the commit. Instead of compiling it writes a
+// wrapper that re-executes this binary as a node reporting the commit
+// checked out. A node fails a build if the commit is listed in its
+// fail-build file and crashes on boot if it is listed in its crash-on-boot
+// file, both next to its checkout.
+const builderScript = `#!/bin/sh
+while [ $# -gt 0 ]; do
+    case "$1" in
+    -ldflags) hash=${2#*main.gitHash=}; shift ;;
+    -o) out=$2; shift ;;
+    esac
+    shift
+done
+if grep -qx "$hash" ../fail-build 2>/dev/null; then
+    echo " - Compiling $hash failed."
+    exit 1
+fi
+sleep %d
+cat > $out.$$ <<EOF
+#!/bin/sh
+if grep -qx "$hash" crash-on-boot 2>/dev/null; then
+    echo "$hash crashed on boot" >&2
+    exit 1
+fi
+exec "%s" node -version $hash "\$@"
+EOF
+chmod 0755 $out.$$
+mv $out.$$ $out
+`
+
+type cluster struct {
+	name    string
+	dir     string
+	self    string
+	secret  string
+	port    int
+	timeout int
+	repoURL string
+	script  string
+	builder string
+	aws     *fakeAWS
+	awsURL  string
+	awsSrv  *http.Server
+	hooks   *hookReceiver
+	nodes   []*node
+
+	// "dynamo" when the deploy lock is kept in the fake DynamoDB
+	lock string
+
+	// allowed signers file every build is checked against
+	signers string
+
+	// how long the deploy lock is held between renewals, the default when 0
+	lockTTL time.Duration
+
+	// how often nodes poll the branch, auto-deploy is off when 0
+	autoDeploy time.Duration
+
+	// freeze windows as JSON, none when empty
+	freezes string
+
+	// deploys wait for approval, expiring after approvalTTL
+	approvalTTL time.Duration
+
+	// set when the fleet runs with mutual TLS
+	tls    string
+	ca     *certAuthority
+	caFile string
+	client *http.Client
+}
+
+type node struct {
+	id   string
+	ip   string
+	app  string
+	dir  string
+	repo string
+	logf *os.File
+
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stopped bool
+	exited  chan struct{}
+}
+
+type clusterOptions struct {
+	name       string
+	size       int
+	port       int
+	timeout    int
+	buildDelay int
+	repoURL    string
+	script     string
+	version    string
+	tls        string
+	lock       string
+	signers    string
+}
+
+func newCluster(root string, opts clusterOptions) (*cluster, error) {
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(root, opts.name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	c := &cluster{
+		name:    opts.name,
+		dir:     dir,
+		self:    self,
+		secret:  "scsim-secret",
+		port:    opts.port,
+		timeout: opts.timeout,
+		repoURL: opts.repoURL,
+		script:  opts.script,
+		builder: filepath.Join(dir, "go"),
+		tls:     opts.tls,
+		lock:    opts.lock,
+		signers: opts.signers,
+		client:  &http.Client{},
+	}
+
+	if c.tls != "" {
+		if c.ca, err = newCertAuthority(opts.name + " fleet ca"); err != nil {
+			return nil, err
+		}
+		c.caFile = filepath.Join(dir, "ca.pem")
+		if err := ioutil.WriteFile(c.caFile, c.ca.pem, 0644); err != nil {
+			return nil, err
+		}
+
+		roots := x509.NewCertPool()
+		roots.AddCert(c.ca.cert)
+		c.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	}
+
+	script := fmt.Sprintf(builderScript, opts.buildDelay, self)
+	if err := ioutil.WriteFile(c.builder, []byte(script), 0755); err != nil {
+		return nil, err
+	}
+
+	userData := fmt.Sprintf("#!/bin/bash\nAPP_NAME=scsim\nGO_GIT_HASH=%s\n", opts.version)
+	c.aws = newFakeAWS(opts.name+"-asg", fakeLaunchConfig{
+		Name:         opts.name + "-lc-1",
+		ImageID:      "ami-5c5c5c5c",
+		InstanceType: "t2.micro",
+		UserData:     base64.StdEncoding.EncodeToString([]byte(userData)),
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	c.awsURL = "http://" + l.Addr().String()
+	c.awsSrv = &http.Server{Handler: c.aws}
+	go c.awsSrv.Serve(l)
+
+	if c.hooks, err = newHookReceiver(); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < opts.size; i++ {
+		n := &node{
+			id:  fmt.Sprintf("i-%08x", i+1),
+			ip:  fmt.Sprintf("127.0.0.%d", i+10),
+			app: fmt.Sprintf("scsim%d-%s-%d", os.Getpid(), opts.name, i),
+			dir: filepath.Join(dir, fmt.Sprintf("node%d", i)),
+		}
+		n.repo = filepath.Join(n.dir, "repo")
+		if err := os.MkdirAll(filepath.Join(n.dir, "bin"), 0755); err != nil {
+			return nil, err
+		}
+		// the checkout the update script fetches into, kept apart from the
+		// node's files as it cleans what git doesn't track. Its origin goes
+		// nowhere, the script has to fetch from RepoUrl.
+		if out, err := exec.Command("git", "init", "-q", n.repo).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("git init: %v\n%s", err, out)
+		}
+		if out, err := exec.Command("git", "-C", n.repo, "remote", "add", "origin", filepath.Join(n.dir, "no-origin")).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("git remote add: %v\n%s", err, out)
+		}
+		if n.logf, err = os.Create(filepath.Join(dir, fmt.Sprintf("node%d.log", i))); err != nil {
+			return nil, err
+		}
+		if err := c.install(n, opts.version); err != nil {
+			return nil, err
+		}
+		if err := c.setSecrets(n, c.secret); err != nil {
+			return nil, err
+		}
+		if c.ca != nil {
+			// connections between loopback addresses come from 127.0.0.1,
+			// so it has to be in every node's certificate too
+			ips := []net.IP{net.ParseIP(n.ip), net.ParseIP("127.0.0.1")}
+			if n.certFile, n.keyFile, err = c.ca.issue(n.dir, n.id, ips); err != nil {
+				return nil, err
+			}
+		}
+		c.aws.addInstance(fakeInstance{ID: n.id, PrivateIP: n.ip, Launched: time.Now()})
+		c.nodes = append(c.nodes, n)
+	}
+
+	return c, nil
+}
+
+// install builds hash for n with the update script and installs it as the
+// binary the supervisor starts, the way a node is provisioned from user data
+func (c *cluster) install(n *node, hash string) error {
+
+	build := exec.Command(c.script, n.app, hash)
+	build.Dir = n.repo
+	build.Env = append(os.Environ(), "SERVERCONTROL_GO="+c.builder,
+		"SERVERCONTROL_METADATA_ENDPOINT="+c.awsURL+"/"+n.id,
+		"SERVERCONTROL_REPO_URL="+c.repoURL)
+	if out, err := build.CombinedOutput(); err != nil {
+		return fmt.Errorf("building %s: %v\n%s", hash, err, out)
+	}
+
+	bin := filepath.Join("/tmp", n.app+"-"+hash)
+	install := exec.Command("install", "-m", "0777", bin, filepath.Join(n.dir, "bin", n.app))
+	if out, err := install.CombinedOutput(); err != nil {
+		return fmt.Errorf("installing %s: %v\n%s", hash, err, out)
+	}
+	return nil
+}
+
+func (c *cluster) start() {
+	for _, n := range c.nodes {
+		n.exited = make(chan struct{})
+		go c.supervise(n)
+	}
+}
+
+// supervise keeps a node's installed binary running, restarting it whenever
+// it exits, the way systemd or upstart would on a real instance
+func (c *cluster) supervise(n *node) {
+
+	defer close(n.exited)
+
+	args := []string{
+		"-addr", fmt.Sprintf("%s:%d", n.ip, c.port),
+		"-app", n.app,
+		"-repo-url", c.repoURL,
+		"-repo-dir", n.repo,
+		"-update-script", c.script,
+		"-secret", c.secret,
+		"-secrets-file", filepath.Join(n.dir, "secrets"),
+		"-audit-log", filepath.Join(n.dir, "audit.log"),
+		"-history", filepath.Join(n.dir, "history"),
+		"-schedule-file", filepath.Join(n.dir, "schedule"),
+		"-approval-file", filepath.Join(n.dir, "approvals"),
+		"-unhealthy-file", filepath.Join(n.dir, "unhealthy"),
+		"-broken-file", filepath.Join(n.dir, "broken"),
+		"-erroring-file", filepath.Join(n.dir, "erroring"),
+		"-allowed-signers", c.signers,
+		"-bake", "15s",
+		"-timeout", fmt.Sprint(c.timeout),
+		"-disable-legacy-auth",
+		"-webhook", c.hooks.url,
+		"-webhook-secret", simWebhookSecret,
+		"-git-webhook-token", "git",
+		"-metrics-token", simMetricsToken,
+		"-public-health",
+	}
+	if c.lock == "dynamo" {
+		args = append(args, "-lock-table", "scsim-locks", "-lock-key", "scsim")
+	} else {
+		args = append(args, "-lock-file", c.lockFile())
+	}
+	for _, t := range simTokens {
+		args = append(args, "-token", t)
+	}
+	if c.lockTTL > 0 {
+		args = append(args, "-lock-ttl", c.lockTTL.String())
+	}
+	if c.approvalTTL > 0 {
+		args = append(args, "-require-approval", "-approval-ttl", c.approvalTTL.String())
+	}
+	if c.freezes != "" {
+		args = append(args, "-freezes", c.freezes)
+	}
+	if c.autoDeploy > 0 {
+		args = append(args, "-auto-deploy", c.autoDeploy.String(), "-auto-deploy-max-backoff", "4s")
+	}
+	if c.ca != nil {
+		args = append(args, "-tls-ca", c.caFile, "-tls-cert", n.certFile, "-tls-key", n.keyFile)
+	}
+	if c.tls == "spiffe" {
+		args = append(args, "-trust-domain", simTrustDomain)
+	}
+
+	for {
+		cmd := exec.Command(filepath.Join(n.dir, "bin", n.app), args...)
+		cmd.Dir = n.dir
+		cmd.Stdout = n.logf
+		cmd.Stderr = n.logf
+		cmd.Env = append(os.Environ(),
+			"DEBUG=1",
+			"GOPATH="+n.dir,
+			"SERVERCONTROL_GO="+c.builder,
+			"AWS_ACCESS_KEY_ID=scsim",
+			"AWS_SECRET_ACCESS_KEY=scsim",
+			"SERVERCONTROL_METADATA_ENDPOINT="+c.awsURL+"/"+n.id,
+			"SERVERCONTROL_AWS_ENDPOINT="+c.awsURL,
+		)
+
+		n.mu.Lock()
+		if n.stopped {
+			n.mu.Unlock()
+			return
+		}
+		err := cmd.Start()
+		n.cmd = cmd
+		n.mu.Unlock()
+
+		if err == nil {
+			err = cmd.Wait()
+		}
+		fmt.Fprintf(n.logf, "scsim: %s exited: %v\n", n.id, err)
+
+		n.mu.Lock()
+		stopped := n.stopped
+		n.mu.Unlock()
+		if stopped {
+			return
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+func (c *cluster) stop() {
+
+	for _, n := range c.nodes {
+		n.mu.Lock()
+		n.stopped = true
+		if n.cmd != nil && n.cmd.Process != nil {
+			n.cmd.Process.Kill()
+		}
+		n.mu.Unlock()
+	}
+
+	for _, n := range c.nodes {
+		if n.exited != nil {
+			<-n.exited
+		}
+		n.logf.Close()
+		artifacts, _ := filepath.Glob(filepath.Join("/tmp", n.app+"-*"))
+		for _, a := range artifacts {
+			os.Remove(a)
+		}
+	}
+
+	c.awsSrv.Close()
+	c.hooks.close()
+}
+
+func (c *cluster) url(n *node, service string) string {
+	scheme := "http"
+	if c.ca != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s:%d/server-control/%s", scheme, n.ip, c.port, service)
+}
+
+// simTokens are the scoped tokens every node accepts besides the secret
+var simTokens = []string{
+	"viewer:viewer-secret:read",
+	"deployer:deployer-secret:deploy-fleet",
+	"git:git-secret:deploy-fleet",
+}
+
+// simMetricsToken is the bearer token every node's /metrics is scraped with
+const simMetricsToken = "scsim-metrics-token"
+
+func (c *cluster) request(method, url string, body interface{}, timeout time.Duration) (int, []byte, error) {
+	return c.do(c.client, "", method, url, body, timeout)
+}
+
+// do makes a signed request, with the shared secret or as one of simTokens
+func (c *cluster) do(client *http.Client, token, method, url string, body interface{}, timeout time.Duration) (int, []byte, error) {
+
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, err
+	}
+	if token == "" {
+		err = servercontrol.SignRequest(req, c.secret)
+	} else {
+		err = servercontrol.SignRequestAs(req, token, token+"-secret")
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	cl := *client
+	cl.Timeout = timeout
+	resp, err := cl.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	out, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, out, err
+}
+
+// gitPush delivers a push event to n the way GitHub does, signing it with
+// secret, or the way GitLab does when delivery is empty
+func (c *cluster) gitPush(n *node, event, delivery, secret string, body interface{}) (int, []byte, error) {
+
+	data, _ := json.Marshal(body)
+	req, err := http.NewRequest("POST", c.url(n, "git_webhook"), bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, err
+	}
+	if delivery == "" {
+		req.Header.Set("X-Gitlab-Event", event)
+		req.Header.Set("X-Gitlab-Token", secret)
+	} else {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(data)
+		req.Header.Set("X-GitHub-Event", event)
+		req.Header.Set("X-GitHub-Delivery", delivery)
+		req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	cl := *c.client
+	cl.Timeout = 10 * time.Second
+	resp, err := cl.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	out, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, out, err
+}
+
+func (c *cluster) version(n *node) (string, error) {
+
+	code, body, err := c.request("GET", c.url(n, "server_version"), nil, 2*time.Second)
+	if err != nil {
+		return "", err
+	}
+	if code != http.StatusOK {
+		return "", fmt.Errorf("server_version returned %d", code)
+	}
+
+	sv := servercontrol.ServerVersion{}
+	if err := json.Unmarshal(body, &sv); err != nil {
+		return "", err
+	}
+	return sv.GitCommitHash, nil
+}
+
+// waitForVersion polls every node until each reports the hash it is
+// expected to run, or the timeout expires
+func (c *cluster) waitForVersion(want map[*node]string, timeout time.Duration) error {
+
+	deadline := time.Now().Add(timeout)
+	for {
+		pending := []string{}
+		for n, hash := range want {
+			if v, err := c.version(n); err != nil || v != hash {
+				pending = append(pending, fmt.Sprintf("%s (have %q, want %s)", n.id, short(v), short(hash)))
+			}
+		}
+
+		if len(pending) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("nodes not on expected version: " + strings.Join(pending, ", "))
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+func (c *cluster) allOn(hash string) map[*node]string {
+	want := map[*node]string{}
+	for _, n := range c.nodes {
+		want[n] = hash
+	}
+	return want
+}
+
+func (c *cluster) updateService(n *node, hash string) (int, string, error) {
+	code, body, err := c.request("GET", c.url(n, "update_service"),
+		map[string]string{"hash": hash}, 5*time.Minute)
+	return code, string(body), err
+}
+
+// launchConfigHash returns the GO_GIT_HASH new instances would boot with
+func (c *cluster) launchConfigHash() string {
+
+	lc := c.aws.currentLaunchConfig()
+	data, _ := base64.StdEncoding.DecodeString(lc.UserData)
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "GO_GIT_HASH=") {
+			return strings.TrimPrefix(line, "GO_GIT_HASH=")
+		}
+	}
+	return ""
+}
+
+func (c *cluster) failBuild(n *node, hash string) error {
+	return ioutil.WriteFile(filepath.Join(n.dir, "fail-build"), []byte(hash+"\n"), 0644)
+}
+
+func (c *cluster) crashOnBoot(n *node, hash string) error {
+	return ioutil.WriteFile(filepath.Join(n.dir, "crash-on-boot"), []byte(hash+"\n"), 0644)
+}
+
+// unhealthyOn makes n report unhealthy while it runs hash
+func (c *cluster) unhealthyOn(n *node, hash string) error {
+	return ioutil.WriteFile(filepath.Join(n.dir, "unhealthy"), []byte(hash+"\n"), 0644)
+}
+
+// brokenOn makes n fail its smoke test while it runs hash
+func (c *cluster) brokenOn(n *node, hash string) error {
+	return ioutil.WriteFile(filepath.Join(n.dir, "broken"), []byte(hash+"\n"), 0644)
+}
+
+// erroringOn makes n report every request failing while it runs hash
+func (c *cluster) erroringOn(n *node, hash string) error {
+	return ioutil.WriteFile(filepath.Join(n.dir, "erroring"), []byte(hash+"\n"), 0644)
+}
+
+// setSecrets replaces the secrets n accepts, newest first
+func (c *cluster) setSecrets(n *node, secrets ...string) error {
+	data := strings.Join(secrets, "\n") + "\n"
+	return ioutil.WriteFile(filepath.Join(n.dir, "secrets"), []byte(data), 0600)
+}
+
+// lastAudit checks n's audit log is intact and returns its latest entry
+// for action
+func (c *cluster) lastAudit(n *node, action string) (*servercontrol.AuditEntry, error) {
+
+	code, body, err := c.request("GET", c.url(n, "audit")+"?action="+action, nil, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("audit returned %d: %s", code, body)
+	}
+
+	result := struct {
+		ChainValid bool                       `json:"chain_valid"`
+		ChainError string                     `json:"chain_error"`
+		Entries    []servercontrol.AuditEntry `json:"entries"`
+	}{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	if !result.ChainValid {
+		return nil, fmt.Errorf("%s audit log broken: %s", n.id, result.ChainError)
+	}
+	if len(result.Entries) == 0 {
+		return nil, fmt.Errorf("%s has no %s in its audit log", n.id, action)
+	}
+	return &result.Entries[len(result.Entries)-1], nil
+}
+
+// hasMetric checks a node's /metrics output, scraped the way Prometheus
+// would with the bearer token, has a sample line starting with the given
+// series
+func (c *cluster) hasMetric(n *node, series string) error {
+
+	code, body, err := c.scrape(n, "metrics", "")
+	if err != nil {
+		return err
+	}
+	if code != http.StatusForbidden {
+		return fmt.Errorf("metrics without a token returned %d", code)
+	}
+
+	code, body, err = c.scrape(n, "metrics", simMetricsToken)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return fmt.Errorf("metrics returned %d: %s", code, body)
+	}
+
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s metrics have no %s", n.id, series)
+}
+
+// scrape gets one of a node's services with only a bearer token, or none
+// at all, the way a scraper or load balancer would
+func (c *cluster) scrape(n *node, service, token string) (int, []byte, error) {
+
+	req, err := http.NewRequest("GET", c.url(n, service), nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	cl := *c.client
+	cl.Timeout = 5 * time.Second
+	resp, err := cl.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body, err
+}
+
+// deploymentID finds the id of the last deploy n coordinated in its log
+func (c *cluster) deploymentID(n *node) (string, error) {
+
+	data, err := ioutil.ReadFile(n.logf.Name())
+	if err != nil {
+		return "", err
+	}
+
+	id := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.Contains(line, `msg="deploy started"`) {
+			continue
+		}
+		for _, kv := range strings.Fields(line) {
+			if strings.HasPrefix(kv, servercontrol.FieldDeployment+"=") {
+				id = strings.TrimPrefix(kv, servercontrol.FieldDeployment+"=")
+			}
+		}
+	}
+	if id == "" {
+		return "", fmt.Errorf("%s logged no deploy", n.id)
+	}
+	return id, nil
+}
+
+// logged checks n's log mentions s
+func (c *cluster) logged(n *node, s string) error {
+
+	data, err := ioutil.ReadFile(n.logf.Name())
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(data), s) {
+		return fmt.Errorf("%s never logged %s", n.id, s)
+	}
+	return nil
+}
+
+// history returns the deployments n has coordinated, oldest first
+func (c *cluster) history(n *node) ([]servercontrol.Deployment, error) {
+
+	code, body, err := c.request("GET", c.url(n, "history"), nil, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("history returned %d: %s", code, body)
+	}
+
+	result := struct {
+		Deployments []servercontrol.Deployment `json:"deployments"`
+	}{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	return result.Deployments, nil
+}
+
+// lockFile is the deploy lock every node shares, standing in for DynamoDB
+func (c *cluster) lockFile() string {
+	return filepath.Join(c.dir, "deploy.lock")
+}
+
+// plantLock puts h in the deploy lock the way its holder would have
+func (c *cluster) plantLock(h servercontrol.LockHolder) error {
+	return c.plant("", h)
+}
+
+// plantPause pauses auto-deploy the way pause_auto_deploy would have
+func (c *cluster) plantPause(h servercontrol.LockHolder) error {
+	return c.plant(".auto-deploy-paused", h)
+}
+
+// plant puts h in the lock kept next to the deploy lock under suffix
+func (c *cluster) plant(suffix string, h servercontrol.LockHolder) error {
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+
+	if c.lock != "dynamo" {
+		return ioutil.WriteFile(c.lockFile()+suffix, data, 0600)
+	}
+
+	str := func(s string) dynamoValue { return dynamoValue{S: &s} }
+	expires := fmt.Sprint(h.Expires.Unix())
+
+	c.aws.mu.Lock()
+	defer c.aws.mu.Unlock()
+	if c.aws.tables == nil {
+		c.aws.tables = map[string]map[string]dynamoItem{}
+	}
+	if c.aws.tables["scsim-locks"] == nil {
+		c.aws.tables["scsim-locks"] = map[string]dynamoItem{}
+	}
+	c.aws.tables["scsim-locks"]["scsim"+suffix] = dynamoItem{
+		"lock_key":      str("scsim" + suffix),
+		"deployment_id": str(h.DeploymentID),
+		"expires":       dynamoValue{N: &expires},
+		"holder":        str(string(data)),
+	}
+	return nil
+}
+
+// lockHolder asks n who holds the deploy lock
+func (c *cluster) lockHolder(n *node) (*servercontrol.LockHolder, error) {
+
+	code, body, err := c.request("GET", c.url(n, "lock"), nil, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("lock returned %d: %s", code, body)
+	}
+
+	result := struct {
+		Holder *servercontrol.LockHolder `json:"holder"`
+	}{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	return result.Holder, nil
+}
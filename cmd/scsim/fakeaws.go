@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const simRegion = "us-west-2"
+
+type fakeInstance struct {
+	ID        string
+	PrivateIP string
+	Launched  time.Time
+}
+
+type fakeLaunchConfig struct {
+	Name         string
+	ImageID      string
+	InstanceType string
+	UserData     string // base64 encoded, as the api returns it
+}
+
+// fakeAWS stands in for the ec2 metadata service and the subset of the
+// autoscaling and ec2 query apis servercontrol uses. Metadata is served
+// under /<instance-id>/latest/... so every node can be pointed at its own
+// view and, like an instance with IMDSv2 enforced, only to requests with a
+// session token. Requests with a DynamoDB X-Amz-Target go to a minimal
+// DynamoDB, everything else is treated as a query api call.
+type fakeAWS struct {
+	mu            sync.Mutex
+	groupName     string
+	groupLC       string
+	instances     []fakeInstance
+	launchConfigs map[string]fakeLaunchConfig
+	tables        map[string]map[string]dynamoItem
+}
+
+func newFakeAWS(groupName string, lc fakeLaunchConfig) *fakeAWS {
+	return &fakeAWS{
+		groupName:     groupName,
+		groupLC:       lc.Name,
+		launchConfigs: map[string]fakeLaunchConfig{lc.Name: lc},
+	}
+}
+
+func (f *fakeAWS) addInstance(i fakeInstance) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.instances = append(f.instances, i)
+}
+
+// currentLaunchConfig returns the launch configuration the group is using
+func (f *fakeAWS) currentLaunchConfig() fakeLaunchConfig {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.launchConfigs[f.groupLC]
+}
+
+func (f *fakeAWS) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+
+	if strings.HasPrefix(req.URL.Path, "/i-") {
+		f.serveMetadata(res, req)
+		return
+	}
+
+	if strings.HasPrefix(req.Header.Get("X-Amz-Target"), "DynamoDB_") {
+		f.serveDynamo(res, req)
+		return
+	}
+
+	if err := req.ParseForm(); err != nil {
+		f.writeError(res, "InvalidRequest", err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	action := req.Form.Get("Action")
+	switch action {
+	case "DescribeAutoScalingInstances":
+		f.describeAutoScalingInstances(res, req)
+	case "DescribeAutoScalingGroups":
+		f.describeAutoScalingGroups(res, req)
+	case "DescribeLaunchConfigurations":
+		f.describeLaunchConfigurations(res, req)
+	case "CreateLaunchConfiguration":
+		f.createLaunchConfiguration(res, req)
+	case "UpdateAutoScalingGroup":
+		f.updateAutoScalingGroup(res, req)
+	case "DescribeInstances":
+		f.describeInstances(res, req)
+	default:
+		f.writeError(res, "InvalidAction", "unsupported action "+action)
+	}
+}
+
+func (f *fakeAWS) serveMetadata(res http.ResponseWriter, req *http.Request) {
+
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)
+	if len(parts) != 2 {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id, p := parts[0], "/"+parts[1]
+
+	f.mu.Lock()
+	var instance *fakeInstance
+	for i := range f.instances {
+		if f.instances[i].ID == id {
+			instance = &f.instances[i]
+		}
+	}
+	f.mu.Unlock()
+
+	if instance == nil {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	token := "token-" + instance.ID
+	if p == "/latest/api/token" {
+		if req.Method != "PUT" || req.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(res, token)
+		return
+	}
+
+	if req.Header.Get("X-aws-ec2-metadata-token") != token {
+		res.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch p {
+	case "/latest/meta-data/instance-id":
+		fmt.Fprint(res, instance.ID)
+	case "/latest/meta-data/placement/availability-zone":
+		fmt.Fprint(res, simRegion+"a")
+	case "/latest/meta-data/instance-type":
+		fmt.Fprint(res, f.currentLaunchConfig().InstanceType)
+	case "/latest/dynamic/instance-identity/document":
+		json.NewEncoder(res).Encode(map[string]string{
+			"instanceId": instance.ID,
+			"privateIp":  instance.PrivateIP,
+			"region":     simRegion,
+		})
+	case "/latest/user-data":
+		lc := f.currentLaunchConfig()
+		data, _ := base64.StdEncoding.DecodeString(lc.UserData)
+		res.Write(data)
+	default:
+		res.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeAWS) writeXML(res http.ResponseWriter, v interface{}) {
+	res.Header().Set("Content-Type", "text/xml")
+	fmt.Fprint(res, xml.Header)
+	xml.NewEncoder(res).Encode(v)
+}
+
+func (f *fakeAWS) writeError(res http.ResponseWriter, code, message string) {
+	type awsError struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	res.Header().Set("Content-Type", "text/xml")
+	res.WriteHeader(http.StatusBadRequest)
+	fmt.Fprint(res, xml.Header)
+	xml.NewEncoder(res).Encode(struct {
+		XMLName xml.Name   `xml:"ErrorResponse"`
+		Error   awsError   `xml:"Error"`
+		Errors  []awsError `xml:"Errors>Error"`
+	}{
+		Error:  awsError{code, message},
+		Errors: []awsError{{code, message}},
+	})
+}
+
+type xmlMember struct {
+	InstanceID           string `xml:"InstanceId,omitempty"`
+	AutoScalingGroupName string `xml:"AutoScalingGroupName,omitempty"`
+	LifecycleState       string `xml:"LifecycleState,omitempty"`
+}
+
+func (f *fakeAWS) describeAutoScalingInstances(res http.ResponseWriter, req *http.Request) {
+
+	members := []xmlMember{}
+	id := req.Form.Get("InstanceIds.member.1")
+	for _, i := range f.instances {
+		if i.ID == id {
+			members = append(members, xmlMember{
+				InstanceID:           i.ID,
+				AutoScalingGroupName: f.groupName,
+				LifecycleState:       "InService",
+			})
+		}
+	}
+
+	f.writeXML(res, struct {
+		XMLName   xml.Name    `xml:"DescribeAutoScalingInstancesResponse"`
+		Instances []xmlMember `xml:"DescribeAutoScalingInstancesResult>AutoScalingInstances>member"`
+	}{Instances: members})
+}
+
+func (f *fakeAWS) describeAutoScalingGroups(res http.ResponseWriter, req *http.Request) {
+
+	type group struct {
+		Name                    string      `xml:"AutoScalingGroupName"`
+		LaunchConfigurationName string      `xml:"LaunchConfigurationName"`
+		Instances               []xmlMember `xml:"Instances>member"`
+	}
+
+	groups := []group{}
+	if req.Form.Get("AutoScalingGroupNames.member.1") == f.groupName {
+		g := group{Name: f.groupName, LaunchConfigurationName: f.groupLC}
+		for _, i := range f.instances {
+			g.Instances = append(g.Instances, xmlMember{InstanceID: i.ID, LifecycleState: "InService"})
+		}
+		groups = append(groups, g)
+	}
+
+	f.writeXML(res, struct {
+		XMLName xml.Name `xml:"DescribeAutoScalingGroupsResponse"`
+		Groups  []group  `xml:"DescribeAutoScalingGroupsResult>AutoScalingGroups>member"`
+	}{Groups: groups})
+}
+
+func (f *fakeAWS) describeLaunchConfigurations(res http.ResponseWriter, req *http.Request) {
+
+	type launchConfig struct {
+		Name         string `xml:"LaunchConfigurationName"`
+		ImageID      string `xml:"ImageId"`
+		InstanceType string `xml:"InstanceType"`
+		UserData     string `xml:"UserData"`
+	}
+
+	configs := []launchConfig{}
+	if lc, ok := f.launchConfigs[req.Form.Get("LaunchConfigurationNames.member.1")]; ok {
+		configs = append(configs, launchConfig(lc))
+	}
+
+	f.writeXML(res, struct {
+		XMLName xml.Name       `xml:"DescribeLaunchConfigurationsResponse"`
+		Configs []launchConfig `xml:"DescribeLaunchConfigurationsResult>LaunchConfigurations>member"`
+	}{Configs: configs})
+}
+
+func (f *fakeAWS) createLaunchConfiguration(res http.ResponseWriter, req *http.Request) {
+
+	name := req.Form.Get("LaunchConfigurationName")
+	if _, ok := f.launchConfigs[name]; ok {
+		f.writeError(res, "AlreadyExists", "launch configuration "+name+" already exists")
+		return
+	}
+
+	f.launchConfigs[name] = fakeLaunchConfig{
+		Name:         name,
+		ImageID:      req.Form.Get("ImageId"),
+		InstanceType: req.Form.Get("InstanceType"),
+		UserData:     req.Form.Get("UserData"),
+	}
+
+	f.writeXML(res, struct {
+		XMLName xml.Name `xml:"CreateLaunchConfigurationResponse"`
+	}{})
+}
+
+func (f *fakeAWS) updateAutoScalingGroup(res http.ResponseWriter, req *http.Request) {
+
+	if req.Form.Get("AutoScalingGroupName") != f.groupName {
+		f.writeError(res, "ValidationError", "group not found")
+		return
+	}
+
+	name := req.Form.Get("LaunchConfigurationName")
+	if _, ok := f.launchConfigs[name]; !ok {
+		f.writeError(res, "ValidationError", "launch configuration "+name+" not found")
+		return
+	}
+	f.groupLC = name
+
+	f.writeXML(res, struct {
+		XMLName xml.Name `xml:"UpdateAutoScalingGroupResponse"`
+	}{})
+}
+
+func (f *fakeAWS) describeInstances(res http.ResponseWriter, req *http.Request) {
+
+	type state struct {
+		Code int    `xml:"code"`
+		Name string `xml:"name"`
+	}
+
+	type instance struct {
+		InstanceID       string `xml:"instanceId"`
+		ImageID          string `xml:"imageId"`
+		State            state  `xml:"instanceState"`
+		InstanceType     string `xml:"instanceType"`
+		LaunchTime       string `xml:"launchTime"`
+		PrivateIPAddress string `xml:"privateIpAddress"`
+		IPAddress        string `xml:"ipAddress"`
+	}
+
+	wanted := map[string]bool{}
+	for k, v := range req.Form {
+		if strings.HasPrefix(k, "InstanceId.") && len(v) > 0 {
+			wanted[v[0]] = true
+		}
+	}
+
+	lc := f.launchConfigs[f.groupLC]
+	instances := []instance{}
+	for _, i := range f.instances {
+		if len(wanted) > 0 && !wanted[i.ID] {
+			continue
+		}
+		instances = append(instances, instance{
+			InstanceID:       i.ID,
+			ImageID:          lc.ImageID,
+			State:            state{16, "running"},
+			InstanceType:     lc.InstanceType,
+			LaunchTime:       i.Launched.UTC().Format(time.RFC3339),
+			PrivateIPAddress: i.PrivateIP,
+			IPAddress:        i.PrivateIP,
+		})
+	}
+
+	f.writeXML(res, struct {
+		XMLName   xml.Name   `xml:"DescribeInstancesResponse"`
+		Instances []instance `xml:"reservationSet>item>instancesSet>item"`
+	}{Instances: instances})
+}
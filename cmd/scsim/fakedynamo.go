@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type dynamoValue struct {
+	S *string `json:",omitempty"`
+	N *string `json:",omitempty"`
+}
+
+type dynamoItem map[string]dynamoValue
+
+type dynamoRequest struct {
+	TableName                 string
+	Key                       dynamoItem
+	Item                      dynamoItem
+	ConditionExpression       string
+	UpdateExpression          string
+	ExpressionAttributeValues dynamoItem
+}
+
+// serveDynamo handles the item operations the deploy lock makes. Condition
+// and update expressions are matched as the lock writes them rather than
+// parsed.
+func (f *fakeAWS) serveDynamo(res http.ResponseWriter, req *http.Request) {
+
+	r := dynamoRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		f.writeDynamoError(res, "SerializationException", err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.tables == nil {
+		f.tables = map[string]map[string]dynamoItem{}
+	}
+	if f.tables[r.TableName] == nil {
+		f.tables[r.TableName] = map[string]dynamoItem{}
+	}
+	table := f.tables[r.TableName]
+
+	key := r.Key
+	if key == nil {
+		key = r.Item
+	}
+	id := ""
+	if k, ok := key["lock_key"]; ok && k.S != nil {
+		id = *k.S
+	}
+	current, exists := table[id]
+
+	if r.ConditionExpression != "" && !dynamoCondition(r.ConditionExpression, current, exists, r.ExpressionAttributeValues) {
+		f.writeDynamoError(res, "ConditionalCheckFailedException", "The conditional request failed")
+		return
+	}
+
+	out := map[string]interface{}{}
+	switch strings.TrimPrefix(req.Header.Get("X-Amz-Target"), "DynamoDB_20120810.") {
+	case "PutItem":
+		table[id] = r.Item
+	case "GetItem":
+		if exists {
+			out["Item"] = current
+		}
+	case "DeleteItem":
+		delete(table, id)
+	case "UpdateItem":
+		if !exists {
+			current = dynamoItem{"lock_key": key["lock_key"]}
+		}
+		current["expires"] = r.ExpressionAttributeValues[":expires"]
+		current["holder"] = r.ExpressionAttributeValues[":holder"]
+		table[id] = current
+	default:
+		f.writeDynamoError(res, "UnknownOperationException", req.Header.Get("X-Amz-Target"))
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	json.NewEncoder(res).Encode(out)
+}
+
+func dynamoCondition(expr string, item dynamoItem, exists bool, values dynamoItem) bool {
+
+	switch expr {
+	case "attribute_not_exists(lock_key) OR expires < :now":
+		if !exists {
+			return true
+		}
+		expires, _ := strconv.ParseInt(*item["expires"].N, 10, 64)
+		now, _ := strconv.ParseInt(*values[":now"].N, 10, 64)
+		return expires < now
+	case "deployment_id = :id":
+		return exists && item["deployment_id"].S != nil && *item["deployment_id"].S == *values[":id"].S
+	}
+	return false
+}
+
+func (f *fakeAWS) writeDynamoError(res http.ResponseWriter, code, message string) {
+	res.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	res.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(res).Encode(map[string]string{
+		"__type":  "com.amazonaws.dynamodb.v20120810#" + code,
+		"message": message,
+	})
+}
@@ -0,0 +1,1735 @@
+// Command scsim runs a simulated servercontrol fleet on a single Linux box
+// and drives deployments through it end to end, without AWS.
+//
+// Every node is a separate process embedding servercontrol, listening on its
+// own loopback address (Linux routes all of 127.0.0.0/8 to lo) so the fleet
+// can share a ServicePort the way real instances do. A fake metadata and
+// autoscaling/ec2 api, a fake go tool and a supervisor that restarts nodes
+// after servercontrol shuts them down stand in for the rest of the
+// environment.
+//
+//	scsim -n 3 -scenario all
+//
+// Each scenario deploys a new commit of a throwaway git repo through
+// update_service on the first node and checks where every node, and the
+// autoscale group's launch configuration, end up. With -tls the fleet gets
+// its own CA and nodes talk to each other over mutual TLS.
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/rem7/servercontrol"
+)
+
+type scenario struct {
+	name string
+	run  func(c *cluster, from, to string) error
+}
+
+// setups prepare the cluster of a scenario before its nodes start
+var setups = map[string]func(c *cluster) error{
+	"deploy-lock": func(c *cluster) error { c.lockTTL = 3 * time.Second; return nil },
+	"auto-deploy": autoDeploySetup,
+	"freeze":      freezeSetup,
+	"approval":    func(c *cluster) error { c.approvalTTL = 20 * time.Second; return nil },
+}
+
+var scenarios = []scenario{
+	{"rolling", rollingScenario},
+	{"build-failure", buildFailureScenario},
+	{"boot-failure", bootFailureScenario},
+	{"peer-auth", peerAuthScenario},
+	{"scopes", scopesScenario},
+	{"secret-rotation", secretRotationScenario},
+	{"rollback", rollbackScenario},
+	{"deploy-lock", deployLockScenario},
+	{"plan", planScenario},
+	{"unhealthy", unhealthyScenario},
+	{"smoke-failure", smokeFailureScenario},
+	{"bake-rollback", bakeRollbackScenario},
+	{"refs", refsScenario},
+	{"changelog", changelogScenario},
+	{"unsigned", unsignedScenario},
+	{"git-webhook", gitWebhookScenario},
+	{"auto-deploy", autoDeployScenario},
+	{"freeze", freezeScenario},
+	{"approval", approvalScenario},
+}
+
+func main() {
+
+	if len(os.Args) > 1 && os.Args[1] == "node" {
+		runNode(os.Args[2:])
+		return
+	}
+
+	size := flag.Int("n", 3, "number of nodes")
+	port := flag.Int("port", 18080, "service port every node listens on")
+	only := flag.String("scenario", "all", "scenario to run")
+	timeout := flag.Int("timeout", 20, "seconds a node waits for a peer to restart")
+	buildDelay := flag.Int("build-delay", 1, "seconds the fake builder takes")
+	keep := flag.Bool("keep", false, "keep the working directory and node logs")
+	tlsMode := flag.String("tls", "", "run the fleet with mutual TLS, identifying peers by \"ip\" or \"spiffe\"")
+	lockMode := flag.String("lock", "file", "keep the deploy lock in a \"file\" or the fake \"dynamo\"")
+	script := flag.String("update-script", updateScript(), "git_update_to_hash.sh the nodes build with")
+	flag.Parse()
+
+	root, err := ioutil.TempDir("", "scsim")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !*keep {
+		defer os.RemoveAll(root)
+	}
+
+	key, allowedSigners, err := makeSigningKey(root)
+	if err != nil {
+		log.Fatal(err)
+	}
+	repo, hashes, err := makeRepo(filepath.Join(root, "origin"), 2, key)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := 0
+	for _, s := range scenarios {
+		if *only != "all" && *only != s.name {
+			continue
+		}
+
+		log.Printf("=== %s", s.name)
+		c, err := newCluster(root, clusterOptions{
+			name:       s.name,
+			size:       *size,
+			port:       *port,
+			timeout:    *timeout,
+			buildDelay: *buildDelay,
+			repoURL:    repo,
+			script:     *script,
+			version:    hashes[0],
+			tls:        *tlsMode,
+			lock:       *lockMode,
+			signers:    allowedSigners,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if setup, ok := setups[s.name]; ok {
+			if err := setup(c); err != nil {
+				log.Fatal(err)
+			}
+		}
+		c.start()
+		err = c.waitForVersion(c.allOn(hashes[0]), 30*time.Second)
+		if err == nil {
+			err = s.run(c, hashes[0], hashes[1])
+		}
+		c.stop()
+
+		if err != nil {
+			failed++
+			log.Printf("--- FAIL %s: %v (logs in %s)", s.name, err, c.dir)
+		} else {
+			log.Printf("--- PASS %s", s.name)
+		}
+	}
+
+	if failed > 0 {
+		if !*keep {
+			log.Printf("rerun with -keep to inspect node logs")
+		}
+		os.Exit(1)
+	}
+}
+
+// updateScript is the git_update_to_hash.sh of the source tree scsim was
+// built from
+func updateScript() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "..", "..", "git_update_to_hash.sh")
+}
+
+// makeSigningKey creates the SSH key the repository is signed with and an
+// allowed signers file trusting it
+func makeSigningKey(root string) (string, string, error) {
+
+	key := filepath.Join(root, "signing-key")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "scsim", "-f", key).CombinedOutput(); err != nil {
+		return "", "", fmt.Errorf("ssh-keygen: %v\n%s", err, out)
+	}
+	pub, err := ioutil.ReadFile(key + ".pub")
+	if err != nil {
+		return "", "", err
+	}
+
+	signers := filepath.Join(root, "allowed-signers")
+	return key, signers, ioutil.WriteFile(signers, append([]byte("scsim@localhost "), pub...), 0644)
+}
+
+// makeRepo creates a git repository on master with the given number of
+// commits and returns its path and the commit hashes, oldest first. The
+// first commit is signed with key, the last only through its signed tag
+// v1.1.0, and the unsigned branch has one more commit that isn't signed
+// at all. The tag hotfix is on a signed commit no branch reaches.
+func makeRepo(dir string, commits int, key string) (string, []string, error) {
+
+	git := func(args ...string) (string, error) {
+		args = append([]string{"-c", "user.name=scsim", "-c", "user.email=scsim@localhost",
+			"-c", "gpg.format=ssh", "-c", "user.signingkey=" + key}, args...)
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", nil, err
+	}
+	if _, err := git("init", "-q"); err != nil {
+		return "", nil, err
+	}
+	if _, err := git("symbolic-ref", "HEAD", "refs/heads/master"); err != nil {
+		return "", nil, err
+	}
+
+	commit := func(i int, sign bool) (string, error) {
+		if err := ioutil.WriteFile(filepath.Join(dir, "VERSION"), []byte(fmt.Sprintf("%d\n", i)), 0644); err != nil {
+			return "", err
+		}
+		if _, err := git("add", "VERSION"); err != nil {
+			return "", err
+		}
+		args := []string{"commit", "-q", "-m", fmt.Sprintf("v%d", i)}
+		if sign {
+			args = append(args, "-S")
+		}
+		if _, err := git(args...); err != nil {
+			return "", err
+		}
+		return git("rev-parse", "HEAD")
+	}
+
+	hashes := []string{}
+	for i := 1; i <= commits; i++ {
+		hash, err := commit(i, i == 1)
+		if err != nil {
+			return "", nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+
+	// tags and a branch for deploying by ref, v1.1.0 annotated so it has to
+	// be peeled
+	if _, err := git("tag", "v1.0.0", hashes[0]); err != nil {
+		return "", nil, err
+	}
+	if _, err := git("tag", "-s", "-m", "v1.1.0", "v1.1.0", hashes[len(hashes)-1]); err != nil {
+		return "", nil, err
+	}
+	if _, err := git("branch", "release", hashes[0]); err != nil {
+		return "", nil, err
+	}
+
+	if _, err := git("checkout", "-q", "-b", "unsigned"); err != nil {
+		return "", nil, err
+	}
+	if _, err := commit(commits+1, false); err != nil {
+		return "", nil, err
+	}
+
+	if _, err := git("checkout", "-q", "--detach", hashes[0]); err != nil {
+		return "", nil, err
+	}
+	if _, err := commit(commits+2, true); err != nil {
+		return "", nil, err
+	}
+	if _, err := git("tag", "hotfix"); err != nil {
+		return "", nil, err
+	}
+	if _, err := git("checkout", "-q", "master"); err != nil {
+		return "", nil, err
+	}
+
+	return dir, hashes, nil
+}
+
+func rollingScenario(c *cluster, from, to string) error {
+
+	code, body, err := c.updateService(c.nodes[0], to)
+	if err != nil {
+		return err
+	}
+	if code != 200 || !strings.Contains(body, "Successful") {
+		return fmt.Errorf("update_service returned %d: %s", code, body)
+	}
+
+	if err := c.waitForVersion(c.allOn(to), 30*time.Second); err != nil {
+		return err
+	}
+
+	if h := c.launchConfigHash(); h != to {
+		return fmt.Errorf("launch configuration has GO_GIT_HASH=%s, want %s", h, to)
+	}
+
+	entry, err := c.lastAudit(c.nodes[0], "update_service")
+	if err != nil {
+		return err
+	}
+	if entry.Outcome != "ok" || entry.Hash != to {
+		return fmt.Errorf("update_service audited as %s for %s", entry.Outcome, entry.Hash)
+	}
+
+	for _, n := range c.nodes[1:] {
+		if _, err := c.lastAudit(n, "restart_server"); err != nil {
+			return err
+		}
+	}
+
+	// every node's part in the deploy is logged under the same id
+	id, err := c.deploymentID(c.nodes[0])
+	if err != nil {
+		return err
+	}
+	for _, n := range c.nodes[1:] {
+		if err := c.logged(n, servercontrol.FieldDeployment+"="+id); err != nil {
+			return err
+		}
+	}
+
+	events, err := c.hooks.waitFor(servercontrol.EventDeployFinished, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	count := map[servercontrol.EventType]int{}
+	for _, e := range events {
+		if e.DeploymentID != id {
+			return fmt.Errorf("%s event for deployment %s, want %s", e.Type, e.DeploymentID, id)
+		}
+		count[e.Type]++
+	}
+	want := map[servercontrol.EventType]int{
+		servercontrol.EventDeployStarted:     1,
+		servercontrol.EventInstanceBuilt:     len(c.nodes),
+		servercontrol.EventInstanceRestarted: len(c.nodes) - 1,
+		servercontrol.EventASGUpdated:        1,
+		servercontrol.EventDeployFinished:    1,
+	}
+	for t, n := range want {
+		if count[t] != n {
+			return fmt.Errorf("got %d %s events, want %d", count[t], t, n)
+		}
+	}
+	return nil
+}
+
+func buildFailureScenario(c *cluster, from, to string) error {
+
+	broken := c.nodes[len(c.nodes)-1]
+	if err := c.failBuild(broken, to); err != nil {
+		return err
+	}
+
+	_, body, err := c.updateService(c.nodes[0], to)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(body, "instance "+broken.id+" failed") {
+		return fmt.Errorf("update_service did not report the failed build: %s", body)
+	}
+
+	// nothing may be restarted when any build fails
+	time.Sleep(2 * time.Second)
+	if err := c.waitForVersion(c.allOn(from), 5*time.Second); err != nil {
+		return err
+	}
+
+	if h := c.launchConfigHash(); h != from {
+		return fmt.Errorf("launch configuration changed to GO_GIT_HASH=%s", h)
+	}
+
+	metrics := []struct {
+		node   *node
+		series string
+	}{
+		{c.nodes[0], `servercontrol_deploys_total{outcome="failed"}`},
+		{c.nodes[0], `servercontrol_deploy_phase_duration_seconds_count{phase="build",outcome="failed"}`},
+		{c.nodes[0], `servercontrol_peer_requests_total{service="prime_build",code="500"}`},
+		{broken, `servercontrol_builds_total{outcome="failed"}`},
+	}
+	for _, m := range metrics {
+		if err := c.hasMetric(m.node, m.series); err != nil {
+			return err
+		}
+	}
+
+	events, err := c.hooks.waitFor(servercontrol.EventDeployFailed, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		if e.Type == servercontrol.EventDeployFailed && (e.Phase != "build" || !strings.Contains(e.Error, broken.id)) {
+			return fmt.Errorf("deploy_failed event in phase %s: %s", e.Phase, e.Error)
+		}
+	}
+	return nil
+}
+
+func bootFailureScenario(c *cluster, from, to string) error {
+
+	if len(c.nodes) < 2 {
+		return fmt.Errorf("needs at least 2 nodes")
+	}
+
+	broken := c.nodes[len(c.nodes)-1]
+	if err := c.crashOnBoot(broken, to); err != nil {
+		return err
+	}
+
+	_, body, err := c.updateService(c.nodes[0], to)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(body, "failed restarting server") {
+		return fmt.Errorf("update_service did not report the failed restart: %s", body)
+	}
+
+	// the coordinator must not install the new version or touch the asg
+	// once a peer fails to come back
+	if err := c.waitForVersion(map[*node]string{c.nodes[0]: from}, 5*time.Second); err != nil {
+		return err
+	}
+
+	entry, err := c.lastAudit(c.nodes[0], "update_service")
+	if err != nil {
+		return err
+	}
+	if entry.Outcome != "failed" {
+		return fmt.Errorf("failed update_service audited as %s", entry.Outcome)
+	}
+
+	if h := c.launchConfigHash(); h != from {
+		return fmt.Errorf("launch configuration changed to GO_GIT_HASH=%s", h)
+	}
+	return nil
+}
+
+// peerAuthScenario checks that with mutual TLS only fleet members can ask a
+// node to restart, whatever secret the caller holds
+func peerAuthScenario(c *cluster, from, to string) error {
+
+	if c.ca == nil {
+		log.Printf("peer-auth needs -tls, skipping")
+		return nil
+	}
+
+	target := c.url(c.nodes[0], "restart_server")
+	body := map[string]string{"hash": from}
+
+	code, _, err := c.request("GET", target, body, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusForbidden {
+		return fmt.Errorf("restart_server without a client certificate returned %d", code)
+	}
+
+	rogue, err := newCertAuthority("rogue ca")
+	if err != nil {
+		return err
+	}
+	certFile, keyFile, err := rogue.issue(c.dir, "rogue", []net.IP{net.ParseIP("127.0.0.1")})
+	if err != nil {
+		return err
+	}
+	cert, err := keyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	transport := c.client.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	code, _, err = c.do(&http.Client{Transport: transport}, "", "GET", target, body, 5*time.Second)
+	if err == nil && code != http.StatusForbidden {
+		return fmt.Errorf("restart_server with a certificate from another ca returned %d", code)
+	}
+
+	return c.waitForVersion(c.allOn(from), 5*time.Second)
+}
+
+// scopesScenario checks tokens only reach the endpoints their scopes allow
+func scopesScenario(c *cluster, from, to string) error {
+
+	checks := []struct {
+		token   string
+		service string
+		want    int
+	}{
+		{"viewer", "server_version", http.StatusOK},
+		{"viewer", "update_service", http.StatusForbidden},
+		{"viewer", "restart_server", http.StatusForbidden},
+		{"deployer", "server_version", http.StatusForbidden},
+		{"deployer", "prime_build", http.StatusForbidden},
+	}
+
+	body := map[string]string{"hash": to}
+	for _, check := range checks {
+		code, _, err := c.do(c.client, check.token, "GET", c.url(c.nodes[0], check.service), body, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		if code != check.want {
+			return fmt.Errorf("%s calling %s got %d, want %d", check.token, check.service, code, check.want)
+		}
+	}
+
+	return c.waitForVersion(c.allOn(from), 5*time.Second)
+}
+
+// secretRotationScenario rolls a new secret out one node at a time and
+// checks peers keep talking to each other throughout
+func secretRotationScenario(c *cluster, from, to string) error {
+
+	old, next := c.secret, "rotated-secret"
+
+	// only the first node knows the new secret, it signs with it and has to
+	// fall back to the old one for everyone else
+	if err := c.setSecrets(c.nodes[0], next, old); err != nil {
+		return err
+	}
+	time.Sleep(1500 * time.Millisecond)
+
+	code, body, err := c.request("GET", c.url(c.nodes[0], "service_data"), nil, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	data := servercontrol.ServiceData{}
+	if err := json.Unmarshal(body, &data); err != nil || code != http.StatusOK {
+		return fmt.Errorf("service_data returned %d: %s", code, body)
+	}
+	for _, i := range data.InstanceList {
+		if i.GitCommitHash != from {
+			return fmt.Errorf("%s could not be reached with the old secret", i.InstanceID)
+		}
+	}
+
+	// finish the rotation and retire the old secret
+	for _, n := range c.nodes {
+		if err := c.setSecrets(n, next); err != nil {
+			return err
+		}
+	}
+	time.Sleep(1500 * time.Millisecond)
+
+	code, _, err = c.request("GET", c.url(c.nodes[1], "server_version"), nil, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusForbidden {
+		return fmt.Errorf("retired secret still accepted, got %d", code)
+	}
+
+	c.secret = next
+	return c.waitForVersion(c.allOn(from), 5*time.Second)
+}
+
+// rollbackScenario deploys a new version then rolls back to the one before
+// it as recorded in the coordinator's deployment history
+func rollbackScenario(c *cluster, from, to string) error {
+
+	code, body, err := c.request("GET", c.url(c.nodes[0], "rollback"), nil, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusConflict {
+		return fmt.Errorf("rollback with no history returned %d: %s", code, body)
+	}
+
+	if err := rollingScenario(c, from, to); err != nil {
+		return err
+	}
+
+	code, body, err = c.request("GET", c.url(c.nodes[0], "rollback"), nil, 60*time.Second)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK || !strings.Contains(string(body), from) {
+		return fmt.Errorf("rollback returned %d: %s", code, body)
+	}
+
+	if err := c.waitForVersion(c.allOn(from), 30*time.Second); err != nil {
+		return err
+	}
+	if h := c.launchConfigHash(); h != from {
+		return fmt.Errorf("launch configuration has GO_GIT_HASH=%s after rollback, want %s", h, from)
+	}
+
+	if _, err := c.hooks.waitFor(servercontrol.EventRollback, 10*time.Second); err != nil {
+		return err
+	}
+
+	history, err := c.history(c.nodes[0])
+	if err != nil {
+		return err
+	}
+	if len(history) != 2 {
+		return fmt.Errorf("history has %d deployments, want 2", len(history))
+	}
+	deployed, rolledBack := history[0], history[1]
+	if deployed.Hash != to || deployed.PreviousHash != from || deployed.Outcome != servercontrol.DeployOK {
+		return fmt.Errorf("deployment recorded as %+v", deployed)
+	}
+	if rolledBack.Kind != "rollback" || rolledBack.Hash != from || rolledBack.Outcome != servercontrol.DeployOK {
+		return fmt.Errorf("rollback recorded as %+v", rolledBack)
+	}
+	for _, i := range rolledBack.Instances {
+		if !i.Built || !i.Restarted {
+			return fmt.Errorf("rollback recorded %s as %+v", i.InstanceID, i)
+		}
+	}
+
+	// nothing ran before from, rolling back again mustn't return to to
+	code, body, err = c.request("GET", c.url(c.nodes[0], "rollback"), nil, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusConflict {
+		return fmt.Errorf("second rollback returned %d: %s", code, body)
+	}
+	return nil
+}
+
+// deployLockScenario checks a deployment can't start while another holds
+// the fleet's deploy lock, and that a lock left behind can be broken
+func deployLockScenario(c *cluster, from, to string) error {
+
+	// a coordinator that died mid deployment
+	stale := servercontrol.LockHolder{
+		DeploymentID: "crashed",
+		Instance:     c.nodes[1].id,
+		Caller:       "fleet",
+		Hash:         to,
+		Acquired:     time.Now(),
+		Expires:      time.Now().Add(time.Hour),
+	}
+	if err := c.plantLock(stale); err != nil {
+		return err
+	}
+
+	code, body, err := c.updateService(c.nodes[0], to)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusConflict || !strings.Contains(body, "crashed") {
+		return fmt.Errorf("update_service under a stale lock returned %d: %s", code, body)
+	}
+
+	code, _, err = c.do(c.client, "deployer", "POST", c.url(c.nodes[0], "unlock"), nil, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusForbidden {
+		return fmt.Errorf("unlock with a deploy-fleet token returned %d", code)
+	}
+
+	code, released, err := c.request("POST", c.url(c.nodes[0], "unlock"), nil, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK || !strings.Contains(string(released), "crashed") {
+		return fmt.Errorf("unlock returned %d: %s", code, released)
+	}
+
+	// two deployments started from different nodes at once
+	first := make(chan error, 1)
+	go func() {
+		code, body, err := c.updateService(c.nodes[0], to)
+		if err == nil && code != http.StatusOK {
+			err = fmt.Errorf("first update_service returned %d: %s", code, body)
+		}
+		first <- err
+	}()
+
+	var holder *servercontrol.LockHolder
+	for i := 0; i < 50 && holder == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if holder, err = c.lockHolder(c.nodes[1]); err != nil {
+			return err
+		}
+	}
+	if holder == nil || holder.Instance != c.nodes[0].id {
+		return fmt.Errorf("lock held by %+v while %s deploys", holder, c.nodes[0].id)
+	}
+
+	code, body, err = c.updateService(c.nodes[1], to)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusConflict || !strings.Contains(body, holder.DeploymentID) {
+		return fmt.Errorf("concurrent update_service returned %d: %s", code, body)
+	}
+
+	if err := <-first; err != nil {
+		return err
+	}
+	if err := c.waitForVersion(c.allOn(to), 30*time.Second); err != nil {
+		return err
+	}
+
+	if holder, err = c.lockHolder(c.nodes[1]); err != nil {
+		return err
+	}
+	if holder != nil {
+		return fmt.Errorf("lock still held by %s after the deployment", holder.DeploymentID)
+	}
+
+	// a deployment whose lock is taken over stops before restarting anyone
+	// else, the first peer may have been restarted already
+	go func() {
+		code, body, err := c.updateService(c.nodes[0], from)
+		if err == nil && (code != http.StatusConflict || !strings.Contains(body, "no longer held")) {
+			err = fmt.Errorf("update_service after losing the lock returned %d: %s", code, body)
+		}
+		first <- err
+	}()
+	for holder = nil; holder == nil; {
+		time.Sleep(100 * time.Millisecond)
+		if holder, err = c.lockHolder(c.nodes[1]); err != nil {
+			return err
+		}
+	}
+	usurper := servercontrol.LockHolder{
+		DeploymentID: "usurper",
+		Instance:     c.nodes[2].id,
+		Caller:       "fleet",
+		Hash:         from,
+		Acquired:     time.Now(),
+		Expires:      time.Now().Add(time.Hour),
+	}
+	if err := c.plantLock(usurper); err != nil {
+		return err
+	}
+	if err := <-first; err != nil {
+		return err
+	}
+	if err := c.waitForVersion(map[*node]string{c.nodes[0]: to, c.nodes[2]: to}, 5*time.Second); err != nil {
+		return err
+	}
+	history, err := c.history(c.nodes[0])
+	if err != nil {
+		return err
+	}
+	if d := history[len(history)-1]; d.ID != holder.DeploymentID || d.Outcome != servercontrol.DeployFailed {
+		return fmt.Errorf("deployment that lost the lock recorded as %+v", d)
+	}
+	if holder, err = c.lockHolder(c.nodes[1]); err != nil || holder == nil || holder.DeploymentID != "usurper" {
+		return fmt.Errorf("lock held by %+v after losing it: %v", holder, err)
+	}
+	return nil
+}
+
+// planScenario checks plan=true describes the deployment without making it
+func planScenario(c *cluster, from, to string) error {
+
+	code, body, err := c.request("GET", c.url(c.nodes[0], "update_service")+"?plan=true",
+		map[string]string{"hash": to}, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return fmt.Errorf("plan returned %d: %s", code, body)
+	}
+
+	plan := servercontrol.DeployPlan{}
+	if err := json.Unmarshal(body, &plan); err != nil {
+		return err
+	}
+
+	if len(plan.Builds) != len(c.nodes) || len(plan.Restarts) != len(c.nodes) {
+		return fmt.Errorf("plan has %d builds and %d restarts for %d nodes", len(plan.Builds), len(plan.Restarts), len(c.nodes))
+	}
+	if last := plan.Restarts[len(plan.Restarts)-1]; last.InstanceID != c.nodes[0].id {
+		return fmt.Errorf("plan restarts %s last, want the coordinator %s", last.InstanceID, c.nodes[0].id)
+	}
+	for _, t := range plan.Restarts {
+		if t.CurrentHash != from || t.TargetHash != to {
+			return fmt.Errorf("plan moves %s from %s to %s", t.InstanceID, t.CurrentHash, t.TargetHash)
+		}
+	}
+	if plan.NewLaunchConfiguration != c.name+"-lc-2" {
+		return fmt.Errorf("plan would create launch configuration %s", plan.NewLaunchConfiguration)
+	}
+	if !strings.Contains(plan.UserDataDiff, "-GO_GIT_HASH="+from) || !strings.Contains(plan.UserDataDiff, "+GO_GIT_HASH="+to) {
+		return fmt.Errorf("plan user data diff:\n%s", plan.UserDataDiff)
+	}
+
+	// and nothing moved
+	time.Sleep(2 * time.Second)
+	if err := c.waitForVersion(c.allOn(from), 5*time.Second); err != nil {
+		return err
+	}
+	if h := c.launchConfigHash(); h != from {
+		return fmt.Errorf("launch configuration changed to GO_GIT_HASH=%s", h)
+	}
+	history, err := c.history(c.nodes[0])
+	if err != nil {
+		return err
+	}
+	if len(history) != 0 {
+		return fmt.Errorf("plan recorded %d deployments", len(history))
+	}
+	return nil
+}
+
+// unhealthyScenario checks a rolling restart stops at a peer that comes back
+// on the new version but never passes its health checks
+func unhealthyScenario(c *cluster, from, to string) error {
+
+	if len(c.nodes) < 2 {
+		return fmt.Errorf("needs at least 2 nodes")
+	}
+
+	sick := c.nodes[len(c.nodes)-1]
+	if err := c.unhealthyOn(sick, to); err != nil {
+		return err
+	}
+
+	_, body, err := c.updateService(c.nodes[0], to)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(body, "failed restarting server") {
+		return fmt.Errorf("update_service did not report the failed restart: %s", body)
+	}
+
+	// the peer did come back on the new version, it just isn't healthy
+	if err := c.waitForVersion(map[*node]string{c.nodes[0]: from, sick: to}, 5*time.Second); err != nil {
+		return err
+	}
+	// asked the way a load balancer would, without signing
+	code, health, err := c.scrape(sick, "health", "")
+	if err != nil {
+		return err
+	}
+	if code != http.StatusServiceUnavailable || !strings.Contains(string(health), "marked unhealthy") {
+		return fmt.Errorf("health of the unhealthy peer returned %d: %s", code, health)
+	}
+
+	if h := c.launchConfigHash(); h != from {
+		return fmt.Errorf("launch configuration changed to GO_GIT_HASH=%s", h)
+	}
+	return nil
+}
+
+// smokeFailureScenario checks a rolling restart stops at a peer that is
+// healthy on the new version but fails its smoke test
+func smokeFailureScenario(c *cluster, from, to string) error {
+
+	if len(c.nodes) < 2 {
+		return fmt.Errorf("needs at least 2 nodes")
+	}
+
+	broken := c.nodes[len(c.nodes)-1]
+	if err := c.brokenOn(broken, to); err != nil {
+		return err
+	}
+
+	_, body, err := c.updateService(c.nodes[0], to)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(body, "failed restarting server") || !strings.Contains(body, "smoke test ping failed") {
+		return fmt.Errorf("update_service did not report the failed smoke test: %s", body)
+	}
+
+	if err := c.waitForVersion(map[*node]string{c.nodes[0]: from, broken: to}, 5*time.Second); err != nil {
+		return err
+	}
+	if h := c.launchConfigHash(); h != from {
+		return fmt.Errorf("launch configuration changed to GO_GIT_HASH=%s", h)
+	}
+
+	history, err := c.history(c.nodes[0])
+	if err != nil {
+		return err
+	}
+	if len(history) == 0 || history[len(history)-1].Outcome != servercontrol.DeployFailed {
+		return fmt.Errorf("smoke test failure not recorded as a failed deployment: %+v", history)
+	}
+	return nil
+}
+
+// bakeRollbackScenario checks a deployment that goes through but then
+// reports errors while baking is rolled back without anyone asking
+func bakeRollbackScenario(c *cluster, from, to string) error {
+
+	if len(c.nodes) < 2 {
+		return fmt.Errorf("needs at least 2 nodes")
+	}
+
+	erroring := c.nodes[len(c.nodes)-1]
+	if err := c.erroringOn(erroring, to); err != nil {
+		return err
+	}
+
+	code, body, err := c.updateService(c.nodes[0], to)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return fmt.Errorf("update_service returned %d: %s", code, body)
+	}
+
+	if _, err := c.hooks.waitFor(servercontrol.EventBakeFailed, 30*time.Second); err != nil {
+		return err
+	}
+	if err := c.waitForVersion(c.allOn(from), 60*time.Second); err != nil {
+		return err
+	}
+	if h := c.launchConfigHash(); h != from {
+		return fmt.Errorf("launch configuration has GO_GIT_HASH=%s after rollback, want %s", h, from)
+	}
+
+	history, err := c.history(c.nodes[0])
+	if err != nil {
+		return err
+	}
+	if len(history) != 2 {
+		return fmt.Errorf("history has %d deployments, want 2", len(history))
+	}
+	deployed, rolledBack := history[0], history[1]
+	if deployed.Bake != servercontrol.BakeFailed || !strings.Contains(deployed.BakeError, erroring.id) {
+		return fmt.Errorf("deployment recorded as %+v", deployed)
+	}
+	if rolledBack.Kind != "rollback" || rolledBack.Hash != from || rolledBack.Caller != "bake-watcher" ||
+		rolledBack.Outcome != servercontrol.DeployOK {
+		return fmt.Errorf("rollback recorded as %+v", rolledBack)
+	}
+
+	entry, err := c.lastAudit(c.nodes[0], "rollback")
+	if err != nil {
+		return err
+	}
+	if entry.Caller != "bake-watcher" || entry.Outcome != "ok" {
+		return fmt.Errorf("automatic rollback audited as %+v", entry)
+	}
+	return nil
+}
+
+// refsScenario checks deployments can name a branch, a tag or a semver
+// constraint instead of a hash, resolved once by the coordinator
+func refsScenario(c *cluster, from, to string) error {
+
+	plan := func(ref string) (int, string, error) {
+		code, body, err := c.request("GET", c.url(c.nodes[0], "update_service")+"?plan=true",
+			map[string]string{"ref": ref}, 30*time.Second)
+		if err != nil || code != http.StatusOK {
+			return code, string(body), err
+		}
+		p := servercontrol.DeployPlan{}
+		if err := json.Unmarshal(body, &p); err != nil {
+			return code, "", err
+		}
+		return code, p.Hash, nil
+	}
+
+	for ref, want := range map[string]string{
+		"release": from,
+		"v1.0.0":  from,
+		"v1.1.0":  to,
+		"^1.0":    to,
+		"~1.0":    from,
+		"<1.1.0":  from,
+		"1.x":     to,
+		to:        to,
+	} {
+		code, hash, err := plan(ref)
+		if err != nil {
+			return err
+		}
+		if code != http.StatusOK || hash != want {
+			return fmt.Errorf("ref %s resolved to %d %s, want %s", ref, code, hash, want)
+		}
+	}
+
+	for _, ref := range []string{"nope", "^2", "v1"} {
+		code, body, err := plan(ref)
+		if err != nil {
+			return err
+		}
+		if code != http.StatusBadRequest {
+			return fmt.Errorf("unknown ref %s returned %d: %s", ref, code, body)
+		}
+	}
+
+	code, body, err := c.request("GET", c.url(c.nodes[0], "service_data"), nil, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	data := servercontrol.ServiceData{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return fmt.Errorf("service_data returned %d: %v", code, err)
+	}
+	if data.Branch != "master" || data.BranchGitHash != to {
+		return fmt.Errorf("service_data reports %s at %s, want master at %s", data.Branch, data.BranchGitHash, to)
+	}
+
+	code, body, err = c.request("GET", c.url(c.nodes[0], "update_service"),
+		map[string]string{"ref": "^1.0"}, 5*time.Minute)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return fmt.Errorf("update_service by ref returned %d: %s", code, body)
+	}
+	if err := c.waitForVersion(c.allOn(to), 30*time.Second); err != nil {
+		return err
+	}
+
+	history, err := c.history(c.nodes[0])
+	if err != nil {
+		return err
+	}
+	if len(history) != 1 || history[0].Ref != "^1.0" || history[0].Hash != to {
+		return fmt.Errorf("deployment by ref recorded as %+v", history)
+	}
+
+	// a tag on no branch is fetched by the update script too
+	out, err := exec.Command("git", "-C", c.repoURL, "rev-parse", "hotfix^{commit}").Output()
+	if err != nil {
+		return err
+	}
+	hotfix := strings.TrimSpace(string(out))
+	code, body, err = c.request("GET", c.url(c.nodes[0], "update_service"),
+		map[string]string{"ref": "hotfix"}, 5*time.Minute)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return fmt.Errorf("update_service of hotfix returned %d: %s", code, body)
+	}
+	return c.waitForVersion(c.allOn(hotfix), 30*time.Second)
+}
+
+// changelogScenario checks what would go out is listed by /changelog, in
+// the plan and in the deploy_started event
+func changelogScenario(c *cluster, from, to string) error {
+
+	changelog := func(query string) (*servercontrol.Changelog, error) {
+		code, body, err := c.request("GET", c.url(c.nodes[0], "changelog")+query, nil, 30*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		if code != http.StatusOK {
+			return nil, fmt.Errorf("changelog%s returned %d: %s", query, code, body)
+		}
+		cl := &servercontrol.Changelog{}
+		return cl, json.Unmarshal(body, cl)
+	}
+
+	// the fleet to the head of master
+	cl, err := changelog("")
+	if err != nil {
+		return err
+	}
+	if err := checkChangelog(cl, to); err != nil {
+		return err
+	}
+
+	// and back, a rollback only removes
+	back, err := changelog("?from=" + to + "&to=v1.0.0")
+	if err != nil {
+		return err
+	}
+	if back.To != from || len(back.Commits) != 0 || len(back.Removed) != 1 || back.Removed[0].Hash != to {
+		return fmt.Errorf("changelog back to v1.0.0 is %+v", back)
+	}
+
+	code, body, err := c.request("GET", c.url(c.nodes[0], "update_service")+"?plan=true",
+		map[string]string{"hash": to}, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	plan := servercontrol.DeployPlan{}
+	if err := json.Unmarshal(body, &plan); err != nil {
+		return fmt.Errorf("plan returned %d: %v", code, err)
+	}
+	if plan.Changelog == nil {
+		return fmt.Errorf("plan has no changelog: %v", plan.Warnings)
+	}
+	if err := checkChangelog(plan.Changelog, to); err != nil {
+		return err
+	}
+
+	if code, body, err := c.updateService(c.nodes[0], to); err != nil || code != http.StatusOK {
+		return fmt.Errorf("update_service returned %d %s: %v", code, body, err)
+	}
+	events, err := c.hooks.waitFor(servercontrol.EventDeployStarted, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		if e.Type == servercontrol.EventDeployStarted {
+			if e.Changelog == nil {
+				return fmt.Errorf("deploy_started has no changelog")
+			}
+			return checkChangelog(e.Changelog, to)
+		}
+	}
+	return nil
+}
+
+// checkChangelog wants to as the only commit, touching VERSION
+func checkChangelog(cl *servercontrol.Changelog, to string) error {
+
+	if cl.To != to || len(cl.Commits) != 1 || len(cl.Removed) != 0 {
+		return fmt.Errorf("changelog is %+v", cl)
+	}
+	c := cl.Commits[0]
+	if c.Hash != to || c.Subject != "v2" || c.Author != "scsim" || len(c.Files) != 1 || c.Files[0] != "VERSION" {
+		return fmt.Errorf("changelog commit is %+v", c)
+	}
+	return nil
+}
+
+// unsignedScenario checks a commit signed neither itself nor through a tag
+// is refused, and that the verification of a deployment is recorded
+func unsignedScenario(c *cluster, from, to string) error {
+
+	code, body, err := c.request("GET", c.url(c.nodes[0], "update_service"),
+		map[string]string{"ref": "unsigned"}, time.Minute)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusConflict || !strings.Contains(string(body), "not signed") {
+		return fmt.Errorf("update_service of an unsigned commit returned %d: %s", code, body)
+	}
+
+	// a peer refuses to build it too, whoever asks
+	code, body, err = c.request("GET", c.url(c.nodes[1], "update_server"),
+		map[string]string{"ref": "unsigned"}, time.Minute)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusInternalServerError {
+		return fmt.Errorf("update_server of an unsigned commit returned %d: %s", code, body)
+	}
+	if err := c.hasMetric(c.nodes[1], `servercontrol_builds_total{outcome="refused"}`); err != nil {
+		return err
+	}
+
+	if err := c.waitForVersion(c.allOn(from), 5*time.Second); err != nil {
+		return err
+	}
+	history, err := c.history(c.nodes[0])
+	if err != nil {
+		return err
+	}
+	if len(history) != 1 {
+		return fmt.Errorf("history has %d deployments, want 1", len(history))
+	}
+	refused := history[0]
+	if refused.Outcome != servercontrol.DeployFailed || refused.Phase != "verify" ||
+		refused.Verification == nil || refused.Verification.Verified {
+		return fmt.Errorf("refused deployment recorded as %+v", refused)
+	}
+
+	// to is only signed through its tag
+	if code, body, err := c.updateService(c.nodes[0], to); err != nil || code != http.StatusOK {
+		return fmt.Errorf("update_service returned %d %s: %v", code, body, err)
+	}
+	if err := c.waitForVersion(c.allOn(to), 30*time.Second); err != nil {
+		return err
+	}
+	if history, err = c.history(c.nodes[0]); err != nil {
+		return err
+	}
+	v := history[len(history)-1].Verification
+	if v == nil || !v.Verified || v.Tag != "v1.1.0" || !strings.HasPrefix(v.SignedBy, "scsim@localhost") {
+		return fmt.Errorf("deployment verification recorded as %+v", v)
+	}
+	return nil
+}
+
+// gitWebhookScenario checks pushes to the tracked branch are deployed and
+// anything else a git host sends is refused or ignored
+func gitWebhookScenario(c *cluster, from, to string) error {
+
+	n := c.nodes[0]
+	push := func(ref, hash string) map[string]string {
+		return map[string]string{"ref": ref, "after": hash}
+	}
+
+	checks := []struct {
+		what, event, delivery, secret string
+		body                          interface{}
+		code                          int
+		contains                      string
+	}{
+		{"bad signature", "push", "d1", "wrong", push("refs/heads/master", to), http.StatusForbidden, ""},
+		{"bad gitlab token", "Push Hook", "", "wrong", push("refs/heads/master", to), http.StatusForbidden, ""},
+		{"ping", "ping", "d2", "git-secret", map[string]string{}, http.StatusOK, "pong"},
+		{"other branch", "push", "d3", "git-secret", push("refs/heads/release", to), http.StatusAccepted, "ignoring"},
+		{"issue event", "issues", "d4", "git-secret", map[string]string{}, http.StatusAccepted, "ignoring"},
+		{"deletion", "push", "d5", "git-secret", push("refs/heads/master", strings.Repeat("0", 40)), http.StatusAccepted, "ignoring"},
+		{"bad hash", "push", "d6", "git-secret", push("refs/heads/master", "nope"), http.StatusBadRequest, ""},
+		{"replay", "ping", "d2", "git-secret", map[string]string{}, http.StatusForbidden, ""},
+		{"stale push", "Push Hook", "", "git-secret", push("refs/heads/master", strings.Repeat("1", 40)), http.StatusConflict, "stale"},
+	}
+	for _, ch := range checks {
+		code, body, err := c.gitPush(n, ch.event, ch.delivery, ch.secret, ch.body)
+		if err != nil {
+			return err
+		}
+		if code != ch.code || !strings.Contains(string(body), ch.contains) {
+			return fmt.Errorf("%s returned %d: %s", ch.what, code, body)
+		}
+	}
+
+	if err := c.waitForVersion(c.allOn(from), 5*time.Second); err != nil {
+		return err
+	}
+
+	code, body, err := c.gitPush(n, "push", "d7", "git-secret", push("refs/heads/master", to))
+	if err != nil {
+		return err
+	}
+	if code != http.StatusAccepted || !strings.Contains(string(body), "deploying") {
+		return fmt.Errorf("push returned %d: %s", code, body)
+	}
+	if err := c.waitForVersion(c.allOn(to), 60*time.Second); err != nil {
+		return err
+	}
+
+	// the deployment finishes after the response, a moment after the fleet
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		history, err := c.history(n)
+		if err != nil {
+			return err
+		}
+		if len(history) == 1 && history[0].Caller == "git" && history[0].Hash == to &&
+			history[0].Outcome == servercontrol.DeployOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("pushed deployment recorded as %+v", history)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	// once running, the same head pushed again from GitLab changes nothing
+	code, body, err = c.gitPush(n, "Push Hook", "", "git-secret", push("refs/heads/master", to))
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK || !strings.Contains(string(body), "already running") {
+		return fmt.Errorf("repeated push returned %d: %s", code, body)
+	}
+	return nil
+}
+
+// autoDeploySetup has the fleet poll its branch, paused from the start so
+// nothing deploys before the scenario is ready
+func autoDeploySetup(c *cluster) error {
+
+	c.autoDeploy = time.Second
+	return c.plantPause(servercontrol.LockHolder{
+		DeploymentID: "setup",
+		Caller:       "scsim",
+		Acquired:     time.Now(),
+		Expires:      time.Now().Add(time.Hour),
+	})
+}
+
+// autoDeployScenario checks the fleet follows its branch once auto-deploy
+// is resumed, backing off while the head fails to build, and that pausing
+// or rolling back stops it
+func autoDeployScenario(c *cluster, from, to string) error {
+
+	n := c.nodes[0]
+
+	status := func(n *node) (*servercontrol.AutoDeployStatus, error) {
+		code, body, err := c.request("GET", c.url(n, "auto_deploy"), nil, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		if code != http.StatusOK {
+			return nil, fmt.Errorf("auto_deploy returned %d: %s", code, body)
+		}
+		s := &servercontrol.AutoDeployStatus{}
+		return s, json.Unmarshal(body, s)
+	}
+
+	s, err := status(n)
+	if err != nil {
+		return err
+	}
+	if !s.Enabled || s.Paused == nil || s.Paused.Caller != "scsim" {
+		return fmt.Errorf("auto-deploy status before resuming is %+v", s)
+	}
+	time.Sleep(3 * time.Second)
+	if err := c.waitForVersion(c.allOn(from), 5*time.Second); err != nil {
+		return err
+	}
+
+	code, _, err := c.do(c.client, "viewer", "POST", c.url(n, "resume_auto_deploy"), nil, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusForbidden {
+		return fmt.Errorf("resume_auto_deploy with a read token returned %d", code)
+	}
+
+	if err := c.failBuild(c.nodes[1], to); err != nil {
+		return err
+	}
+	code, body, err := c.do(c.client, "deployer", "POST", c.url(n, "resume_auto_deploy"), nil, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK || !strings.Contains(string(body), "scsim") {
+		return fmt.Errorf("resume_auto_deploy returned %d: %s", code, body)
+	}
+
+	// the head fails to build until the failure is cleared
+	failing := false
+	for deadline := time.Now().Add(30 * time.Second); !failing && time.Now().Before(deadline); {
+		time.Sleep(500 * time.Millisecond)
+		for _, n := range c.nodes {
+			if s, err := status(n); err == nil && s.Failures > 0 && s.Head == to {
+				failing = true
+			}
+		}
+	}
+	if !failing {
+		return errors.New("no node reported the failing auto-deploy")
+	}
+	if err := c.waitForVersion(c.allOn(from), 5*time.Second); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(c.nodes[1].dir, "fail-build")); err != nil {
+		return err
+	}
+	if err := c.waitForVersion(c.allOn(to), 60*time.Second); err != nil {
+		return err
+	}
+
+	// whichever node deployed recorded it
+	var coordinator *node
+	for deadline := time.Now().Add(10 * time.Second); coordinator == nil && time.Now().Before(deadline); {
+		time.Sleep(200 * time.Millisecond)
+		for _, n := range c.nodes {
+			history, err := c.history(n)
+			if err != nil {
+				return err
+			}
+			if len(history) > 0 {
+				d := history[len(history)-1]
+				if d.Caller == "auto-deploy" && d.Hash == to && d.Ref == "master" && d.Outcome == servercontrol.DeployOK {
+					coordinator = n
+				}
+			}
+		}
+	}
+	if coordinator == nil {
+		return errors.New("no node recorded the auto-deployment")
+	}
+
+	code, body, err = c.do(c.client, "deployer", "POST", c.url(n, "pause_auto_deploy"),
+		map[string]string{"for": "1h"}, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return fmt.Errorf("pause_auto_deploy returned %d: %s", code, body)
+	}
+	code, body, err = c.request("POST", c.url(c.nodes[2], "pause_auto_deploy"), nil, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusConflict || !strings.Contains(string(body), "deployer") {
+		return fmt.Errorf("second pause_auto_deploy returned %d: %s", code, body)
+	}
+
+	// pushes wait for auto-deploy too
+	code, body, err = c.gitPush(n, "push", "a1", "git-secret", map[string]string{"ref": "refs/heads/master", "after": from})
+	if err != nil {
+		return err
+	}
+	if code != http.StatusConflict || !strings.Contains(string(body), "paused") {
+		return fmt.Errorf("push while paused returned %d: %s", code, body)
+	}
+
+	// a rollback leaves auto-deploy paused so the head isn't deployed again
+	if code, body, err = c.do(c.client, "deployer", "POST", c.url(n, "resume_auto_deploy"), nil, 5*time.Second); err != nil || code != http.StatusOK {
+		return fmt.Errorf("resume_auto_deploy returned %d %s: %v", code, body, err)
+	}
+	code, body, err = c.request("POST", c.url(coordinator, "rollback"), nil, 60*time.Second)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return fmt.Errorf("rollback returned %d: %s", code, body)
+	}
+	if err := c.waitForVersion(c.allOn(from), 30*time.Second); err != nil {
+		return err
+	}
+	if s, err = status(c.nodes[2]); err != nil {
+		return err
+	}
+	if s.Paused == nil || s.Paused.Caller != "fleet" {
+		return fmt.Errorf("auto-deploy status after rollback is %+v", s)
+	}
+	time.Sleep(3 * time.Second)
+	return c.waitForVersion(c.allOn(from), 5*time.Second)
+}
+
+// freezeSetup puts the fleet in two freezes, a date range and a weekly one
+// that started ten minutes ago, both in New York time
+func freezeSetup(c *cluster) error {
+
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		return err
+	}
+	now := time.Now().In(ny)
+	started := now.Add(-10 * time.Minute)
+
+	data, err := json.Marshal([]servercontrol.Freeze{
+		{
+			Name:     "release-week",
+			Start:    now.Add(-time.Hour).Format("2006-01-02 15:04"),
+			End:      now.Add(time.Hour).Format("2006-01-02 15:04"),
+			Location: "America/New_York",
+		},
+		{
+			Name:     "weekly",
+			Schedule: fmt.Sprintf("%d %d * * %d", started.Minute(), started.Hour(), started.Weekday()),
+			Duration: 2 * time.Hour,
+			Location: "America/New_York",
+		},
+	})
+	c.freezes = string(data)
+	return err
+}
+
+// freezeScenario checks deploys are refused during a freeze unless they
+// override it with the scope to, and that scheduled deploys start on time,
+// even across a restart, unless cancelled
+func freezeScenario(c *cluster, from, to string) error {
+
+	n := c.nodes[0]
+
+	code, body, err := c.request("GET", c.url(n, "freeze"), nil, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	status := servercontrol.FreezeStatus{}
+	if err := json.Unmarshal(body, &status); err != nil || code != http.StatusOK {
+		return fmt.Errorf("freeze returned %d: %s", code, body)
+	}
+	if !status.Frozen || status.Name != "weekly" {
+		return fmt.Errorf("freeze status is %+v", status)
+	}
+
+	refusals := []struct {
+		what  string
+		props map[string]interface{}
+		code  int
+	}{
+		{"deploy", map[string]interface{}{"hash": to}, http.StatusConflict},
+		{"override without the scope", map[string]interface{}{"hash": to, "override_freeze": true}, http.StatusForbidden},
+	}
+	for _, r := range refusals {
+		code, body, err := c.do(c.client, "deployer", "POST", c.url(n, "update_service"), r.props, 30*time.Second)
+		if err != nil {
+			return err
+		}
+		if code != r.code {
+			return fmt.Errorf("%s during a freeze returned %d: %s", r.what, code, body)
+		}
+	}
+
+	code, body, err = c.do(c.client, "deployer", "POST", c.url(n, "update_service")+"?plan=true",
+		map[string]string{"hash": to}, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK || !strings.Contains(string(body), "frozen by weekly") {
+		return fmt.Errorf("plan during a freeze returned %d: %s", code, body)
+	}
+
+	code, body, err = c.request("POST", c.url(n, "update_service"),
+		map[string]interface{}{"hash": to, "override_freeze": true}, time.Minute)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return fmt.Errorf("update_service overriding the freeze returned %d: %s", code, body)
+	}
+	if err := c.waitForVersion(c.allOn(to), 30*time.Second); err != nil {
+		return err
+	}
+	history, err := c.history(n)
+	if err != nil {
+		return err
+	}
+	if d := history[len(history)-1]; d.FreezeOverridden != "weekly" || d.Outcome != servercontrol.DeployOK {
+		return fmt.Errorf("deployment overriding the freeze recorded as %+v", d)
+	}
+
+	// scheduling
+	scheduler := c.nodes[1]
+	schedule := func(token string, at time.Time, override bool) (int, []byte, error) {
+		return c.do(c.client, token, "POST", c.url(scheduler, "schedule_deploy"), map[string]interface{}{
+			"hash": from, "at": at.Format(time.RFC3339), "override_freeze": override,
+		}, 10*time.Second)
+	}
+	scheduled := func() ([]servercontrol.ScheduledDeploy, error) {
+		code, body, err := c.request("GET", c.url(scheduler, "scheduled_deploys"), nil, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		list := []servercontrol.ScheduledDeploy{}
+		if err := json.Unmarshal(body, &list); err != nil || code != http.StatusOK {
+			return nil, fmt.Errorf("scheduled_deploys returned %d: %s", code, body)
+		}
+		return list, nil
+	}
+
+	if code, body, err = schedule("deployer", time.Now().Add(time.Minute), false); err != nil {
+		return err
+	}
+	if code != http.StatusConflict || !strings.Contains(string(body), "falls in freeze") {
+		return fmt.Errorf("scheduling into a freeze returned %d: %s", code, body)
+	}
+
+	ids := []string{}
+	for _, at := range []time.Time{time.Now().Add(25 * time.Second), time.Now().Add(time.Hour)} {
+		code, body, err := schedule("", at, true)
+		if err != nil {
+			return err
+		}
+		d := servercontrol.ScheduledDeploy{}
+		if err := json.Unmarshal(body, &d); err != nil || code != http.StatusOK {
+			return fmt.Errorf("schedule_deploy returned %d: %s", code, body)
+		}
+		ids = append(ids, d.ID)
+	}
+
+	cancel := map[string]string{"id": ids[1]}
+	if code, body, err = c.do(c.client, "deployer", "POST", c.url(scheduler, "cancel_scheduled_deploy"), cancel, 5*time.Second); err != nil {
+		return err
+	}
+	if code != http.StatusOK || !strings.Contains(string(body), "cancelled") {
+		return fmt.Errorf("cancel_scheduled_deploy returned %d: %s", code, body)
+	}
+	if code, body, err = c.do(c.client, "deployer", "POST", c.url(scheduler, "cancel_scheduled_deploy"), cancel, 5*time.Second); err != nil {
+		return err
+	}
+	if code != http.StatusNotFound {
+		return fmt.Errorf("cancelling twice returned %d: %s", code, body)
+	}
+
+	list, err := scheduled()
+	if err != nil {
+		return err
+	}
+	if len(list) != 1 || list[0].ID != ids[0] || list[0].Caller != "fleet" {
+		return fmt.Errorf("scheduled deploys are %+v", list)
+	}
+
+	// the scheduler is restarted before its deploy is due
+	code, body, err = c.request("POST", c.url(n, "update_service"),
+		map[string]interface{}{"hash": to, "override_freeze": true}, time.Minute)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return fmt.Errorf("redeploying returned %d: %s", code, body)
+	}
+
+	if err := c.waitForVersion(c.allOn(from), time.Minute); err != nil {
+		return err
+	}
+	if list, err = scheduled(); err != nil || len(list) != 0 {
+		return fmt.Errorf("scheduled deploys after starting are %+v: %v", list, err)
+	}
+
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		history, err := c.history(scheduler)
+		if err != nil {
+			return err
+		}
+		if len(history) > 0 {
+			d := history[len(history)-1]
+			if d.Caller == "fleet" && d.Hash == from && d.FreezeOverridden == "weekly" && d.Outcome == servercontrol.DeployOK {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("scheduled deployment recorded as %+v", history)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// approvalScenario checks update_service only makes a deploy request that
+// someone else has to approve before it expires
+func approvalScenario(c *cluster, from, to string) error {
+
+	n := c.nodes[0]
+
+	request := func(hash string) (*servercontrol.DeployRequest, error) {
+		code, body, err := c.do(c.client, "deployer", "POST", c.url(n, "update_service"),
+			map[string]string{"hash": hash}, 30*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		r := &servercontrol.DeployRequest{}
+		if err := json.Unmarshal(body, r); err != nil || code != http.StatusAccepted {
+			return nil, fmt.Errorf("update_service returned %d: %s", code, body)
+		}
+		return r, nil
+	}
+	approve := func(token, id string) (int, []byte, error) {
+		return c.do(c.client, token, "POST", c.url(n, "approve"), map[string]string{"id": id}, time.Minute)
+	}
+	pending := func() ([]servercontrol.DeployRequest, error) {
+		code, body, err := c.do(c.client, "viewer", "GET", c.url(n, "deploy_requests"), nil, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		list := []servercontrol.DeployRequest{}
+		if err := json.Unmarshal(body, &list); err != nil || code != http.StatusOK {
+			return nil, fmt.Errorf("deploy_requests returned %d: %s", code, body)
+		}
+		return list, nil
+	}
+
+	r, err := request(to)
+	if err != nil {
+		return err
+	}
+	if again, err := request(to); err != nil || again.ID != r.ID {
+		return fmt.Errorf("asking twice made request %+v: %v", again, err)
+	}
+	if list, err := pending(); err != nil || len(list) != 1 || list[0].Caller != "deployer" {
+		return fmt.Errorf("pending deploy requests are %+v: %v", list, err)
+	}
+	if err := c.waitForVersion(c.allOn(from), 5*time.Second); err != nil {
+		return err
+	}
+
+	refusals := []struct {
+		token string
+		code  int
+	}{
+		{"deployer", http.StatusForbidden},
+		{"viewer", http.StatusForbidden},
+	}
+	for _, ref := range refusals {
+		code, body, err := approve(ref.token, r.ID)
+		if err != nil {
+			return err
+		}
+		if code != ref.code {
+			return fmt.Errorf("approval by %s returned %d: %s", ref.token, code, body)
+		}
+	}
+
+	code, body, err := approve("", r.ID)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return fmt.Errorf("approve returned %d: %s", code, body)
+	}
+	if err := c.waitForVersion(c.allOn(to), 30*time.Second); err != nil {
+		return err
+	}
+	history, err := c.history(n)
+	if err != nil {
+		return err
+	}
+	if d := history[len(history)-1]; d.Caller != "deployer" || d.ApprovedBy != "fleet" || d.Hash != to {
+		return fmt.Errorf("approved deployment recorded as %+v", d)
+	}
+	if code, body, err = approve("", r.ID); err != nil || code != http.StatusNotFound {
+		return fmt.Errorf("approving twice returned %d %s: %v", code, body, err)
+	}
+
+	// an approval refused while another deployment holds the lock leaves
+	// the request pending
+	if r, err = request(from); err != nil {
+		return err
+	}
+	if err := c.plantLock(servercontrol.LockHolder{
+		DeploymentID: "other",
+		Instance:     c.nodes[1].id,
+		Caller:       "scsim",
+		Acquired:     time.Now(),
+		Expires:      time.Now().Add(time.Hour),
+	}); err != nil {
+		return err
+	}
+	if code, body, err = approve("", r.ID); err != nil || code != http.StatusConflict {
+		return fmt.Errorf("approving under a held lock returned %d %s: %v", code, body, err)
+	}
+	if code, body, err = c.request("POST", c.url(n, "unlock"), nil, 5*time.Second); err != nil || code != http.StatusOK {
+		return fmt.Errorf("unlock returned %d %s: %v", code, body, err)
+	}
+
+	// and pending across a restart of the server it was made to
+	if code, body, err = c.request("POST", c.url(n, "update_server"), map[string]string{"hash": to}, time.Minute); err != nil || code != http.StatusOK {
+		return fmt.Errorf("update_server returned %d %s: %v", code, body, err)
+	}
+	time.Sleep(2 * time.Second)
+	var list []servercontrol.DeployRequest
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(200 * time.Millisecond) {
+		if list, err = pending(); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil || len(list) != 1 || list[0].ID != r.ID {
+		return fmt.Errorf("pending deploy requests after a restart are %+v: %v", list, err)
+	}
+	if code, body, err = approve("", r.ID); err != nil || code != http.StatusOK {
+		return fmt.Errorf("approving after a restart returned %d %s: %v", code, body, err)
+	}
+	if err := c.waitForVersion(c.allOn(from), 30*time.Second); err != nil {
+		return err
+	}
+
+	// a request nobody approves in time goes away
+	if r, err = request(to); err != nil {
+		return err
+	}
+	time.Sleep(21 * time.Second)
+	if code, body, err = approve("", r.ID); err != nil || code != http.StatusGone {
+		return fmt.Errorf("approving an expired request returned %d %s: %v", code, body, err)
+	}
+	if list, err := pending(); err != nil || len(list) != 0 {
+		return fmt.Errorf("pending deploy requests after expiry are %+v: %v", list, err)
+	}
+	return c.waitForVersion(c.allOn(from), 5*time.Second)
+}
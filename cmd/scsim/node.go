@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rem7/servercontrol"
+)
+
+// runNode is what every simulated instance executes. It embeds servercontrol
+// the same way a real app would and exits cleanly when servercontrol asks
+// for a restart, leaving it to the supervisor to start the installed binary.
+func runNode(args []string) {
+
+	fs := flag.NewFlagSet("node", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8080", "listen address")
+	version := fs.String("version", "", "git hash this binary was built from")
+	app := fs.String("app", "scsim", "app name")
+	repoURL := fs.String("repo-url", "", "git remote the fleet tracks")
+	repoDir := fs.String("repo-dir", "", "checkout directory")
+	updateScript := fs.String("update-script", "", "build script")
+	secret := fs.String("secret", "", "shared secret")
+	secretsFile := fs.String("secrets-file", "", "file of accepted secrets, newest first")
+	auditLog := fs.String("audit-log", "", "audit log path")
+	historyFile := fs.String("history", "", "deployment history path")
+	scheduleFile := fs.String("schedule-file", "", "scheduled deploys path")
+	freezesJSON := fs.String("freezes", "", "freeze windows as a JSON list")
+	requireApproval := fs.Bool("require-approval", false, "only deploy requests a second caller approves")
+	approvalTTL := fs.Duration("approval-ttl", 0, "how long a deploy request waits for approval")
+	approvalFile := fs.String("approval-file", "", "pending deploy requests path")
+	lockFile := fs.String("lock-file", "", "deploy lock shared by the fleet")
+	lockTable := fs.String("lock-table", "", "DynamoDB table holding the deploy lock")
+	lockKey := fs.String("lock-key", "", "key of the fleet's deploy lock")
+	lockTTL := fs.Duration("lock-ttl", 0, "how long the deploy lock is held between renewals")
+	timeout := fs.Int("timeout", 20, "seconds to wait for a peer to restart")
+	noLegacy := fs.Bool("disable-legacy-auth", false, "only accept signed requests")
+	caFile := fs.String("tls-ca", "", "fleet CA for mutual TLS")
+	certFile := fs.String("tls-cert", "", "node certificate")
+	keyFile := fs.String("tls-key", "", "node key")
+	trustDomain := fs.String("trust-domain", "", "identify peers by spiffe id in this trust domain")
+	webhook := fs.String("webhook", "", "url deploy events are posted to")
+	webhookSecret := fs.String("webhook-secret", "", "secret webhook deliveries are signed with")
+	unhealthyFile := fs.String("unhealthy-file", "", "report unhealthy while running a hash listed in this file")
+	brokenFile := fs.String("broken-file", "", "fail /ping while running a hash listed in this file")
+	erroringFile := fs.String("erroring-file", "", "report errors while running a hash listed in this file")
+	allowedSigners := fs.String("allowed-signers", "", "only build commits signed by these SSH keys")
+	bakeTime := fs.Duration("bake", 0, "how long to watch the fleet after a deployment")
+	bakeInterval := fs.Duration("bake-interval", time.Second, "how often to sample the fleet while baking")
+	gitWebhookToken := fs.String("git-webhook-token", "", "token git push webhooks are signed with")
+	autoDeploy := fs.Duration("auto-deploy", 0, "how often to poll the branch and deploy its head")
+	autoDeployBackoff := fs.Duration("auto-deploy-max-backoff", 0, "longest wait between polls after failures")
+	metricsToken := fs.String("metrics-token", "", "bearer token /metrics can be scraped with")
+	publicHealth := fs.Bool("public-health", false, "serve /health without auth, as a load balancer needs")
+	tokens := tokenFlags{}
+	fs.Var(&tokens, "token", "extra token as name:secret:scope,scope (repeatable)")
+	fs.Parse(args)
+
+	_, portStr, err := net.SplitHostPort(*addr)
+	if err != nil {
+		log.Fatalf("bad addr %s: %v", *addr, err)
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	logger := log.New(os.Stderr, "["+*addr+" "+short(*version)+"] ", log.LstdFlags)
+
+	var freezes []servercontrol.Freeze
+	if *freezesJSON != "" {
+		if err := json.Unmarshal([]byte(*freezesJSON), &freezes); err != nil {
+			log.Fatalf("bad freezes: %v", err)
+		}
+	}
+
+	var webhooks []servercontrol.Webhook
+	if *webhook != "" {
+		webhooks = append(webhooks, servercontrol.Webhook{URL: *webhook, Secret: *webhookSecret})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sc, err := servercontrol.New(servercontrol.ServerControlConfig{
+		AppName:      *app,
+		RepoUrl:      *repoURL,
+		RepoDir:      *repoDir,
+		ServicePort:  port,
+		Secret:       *secret,
+		UpdateScript: *updateScript,
+		Version:      *version,
+		Timeout:      *timeout,
+		ShutdownFunc: cancel,
+		Log:          logger,
+
+		DisableLegacyAuth:    *noLegacy,
+		TLSCAFile:            *caFile,
+		TLSCertFile:          *certFile,
+		TLSKeyFile:           *keyFile,
+		TrustDomain:          *trustDomain,
+		Tokens:               tokens,
+		GitWebhookToken:      *gitWebhookToken,
+		AutoDeployInterval:   *autoDeploy,
+		AutoDeployMaxBackoff: *autoDeployBackoff,
+		SecretsFile:          *secretsFile,
+		AuditLog:             *auditLog,
+		Webhooks:             webhooks,
+		HistoryFile:          *historyFile,
+		ScheduleFile:         *scheduleFile,
+		Freezes:              freezes,
+		RequireApproval:      *requireApproval,
+		ApprovalTTL:          *approvalTTL,
+		ApprovalFile:         *approvalFile,
+		LockFile:             *lockFile,
+		LockTable:            *lockTable,
+		LockKey:              *lockKey,
+		LockTTL:              *lockTTL,
+		HealthCheck:          healthCheck(*unhealthyFile, *version),
+		SmokeTests: []servercontrol.SmokeTest{
+			{Name: "ping", Path: "/ping", Body: "^pong ", MaxLatency: 2 * time.Second},
+		},
+		AllowedSigners:   *allowedSigners,
+		BakeTime:         *bakeTime,
+		BakeInterval:     *bakeInterval,
+		BakeSignals:      signals(*erroringFile, *version),
+		BakeMaxErrorRate: 0.5,
+
+		MetricsBearerToken: *metricsToken,
+		PublicHealth:       *publicHealth,
+	})
+	if err != nil {
+		logger.Fatalf("servercontrol: %v", err)
+	}
+
+	// the app itself only answers /ping, which the smoke test checks
+	mux := http.NewServeMux()
+	mux.Handle("/server-control/", sc)
+	mux.HandleFunc("/ping", func(res http.ResponseWriter, req *http.Request) {
+		if listed(*brokenFile, *version) {
+			res.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(res, "broken")
+			return
+		}
+		fmt.Fprintf(res, "pong %s", *version)
+	})
+
+	srv := &http.Server{Addr: *addr, Handler: mux, TLSConfig: sc.ServerTLSConfig()}
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Fatalf("listen: %v", err)
+		}
+	}()
+	logger.Printf("serving")
+
+	<-ctx.Done()
+	logger.Printf("shutting down")
+
+	shutdownCtx, done := context.WithTimeout(context.Background(), 5*time.Second)
+	defer done()
+	srv.Shutdown(shutdownCtx)
+}
+
+// healthCheck fails while version is listed in file, standing in for an
+// app that starts but can't serve
+func healthCheck(file, version string) func() error {
+
+	return func() error {
+		if listed(file, version) {
+			return fmt.Errorf("%s is marked unhealthy", short(version))
+		}
+		return nil
+	}
+}
+
+// signals reports every request failing while version is listed in file
+func signals(file, version string) func() (servercontrol.Signals, error) {
+
+	return func() (servercontrol.Signals, error) {
+		if listed(file, version) {
+			return servercontrol.Signals{ErrorRate: 1, Latency: 10 * time.Millisecond}, nil
+		}
+		return servercontrol.Signals{Latency: 10 * time.Millisecond}, nil
+	}
+}
+
+// listed reports whether version is one of the hashes in file
+func listed(file, version string) bool {
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Fields(string(data)) {
+		if line == version {
+			return true
+		}
+	}
+	return false
+}
+
+type tokenFlags []servercontrol.Token
+
+func (t *tokenFlags) String() string {
+	return fmt.Sprint(*t)
+}
+
+func (t *tokenFlags) Set(v string) error {
+
+	parts := strings.SplitN(v, ":", 3)
+	if len(parts) != 3 {
+		return fmt.Errorf("token %q is not name:secret:scopes", v)
+	}
+
+	token := servercontrol.Token{Name: parts[0], Secret: parts[1]}
+	for _, s := range strings.Split(parts[2], ",") {
+		token.Scopes = append(token.Scopes, servercontrol.Scope(s))
+	}
+	*t = append(*t, token)
+	return nil
+}
+
+func short(hash string) string {
+	if len(hash) > 8 {
+		return hash[:8]
+	}
+	return hash
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rem7/servercontrol"
+)
+
+const simWebhookSecret = "scsim-webhook-secret"
+
+// hookReceiver collects the events a fleet posts. It turns the first
+// delivery away so every run exercises the retries.
+type hookReceiver struct {
+	url string
+	srv *http.Server
+
+	mu       sync.Mutex
+	seen     int
+	events   []servercontrol.Event
+	rejected int
+}
+
+func newHookReceiver() (*hookReceiver, error) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	h := &hookReceiver{url: "http://" + l.Addr().String() + "/hook"}
+	h.srv = &http.Server{Handler: h}
+	go h.srv.Serve(l)
+	return h, nil
+}
+
+func (h *hookReceiver) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seen++
+	if h.seen == 1 {
+		res.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	ts, sig := req.Header.Get("X-Sc-Timestamp"), req.Header.Get("X-Sc-Signature")
+	if !servercontrol.VerifyWebhook(simWebhookSecret, ts, body, sig) {
+		h.rejected++
+		res.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	e := servercontrol.Event{}
+	if err := json.Unmarshal(body, &e); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	h.events = append(h.events, e)
+}
+
+// waitFor returns the events received once one of type t has arrived
+func (h *hookReceiver) waitFor(t servercontrol.EventType, timeout time.Duration) ([]servercontrol.Event, error) {
+
+	deadline := time.Now().Add(timeout)
+	for {
+		h.mu.Lock()
+		events := append([]servercontrol.Event{}, h.events...)
+		rejected := h.rejected
+		h.mu.Unlock()
+
+		if rejected > 0 {
+			return nil, fmt.Errorf("%d webhook deliveries had a bad signature", rejected)
+		}
+		for _, e := range events {
+			if e.Type == t {
+				return events, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("no %s event after %s, got %d events", t, timeout, len(events))
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func (h *hookReceiver) close() {
+	h.srv.Close()
+}
@@ -0,0 +1,269 @@
+package servercontrol
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType names something that happened during a deploy.
+type EventType string
+
+const (
+	EventDeployStarted     EventType = "deploy_started"
+	EventInstanceBuilt     EventType = "instance_built"
+	EventInstanceRestarted EventType = "instance_restarted"
+	EventASGUpdated        EventType = "asg_updated"
+	EventDeployFinished    EventType = "deploy_finished"
+	EventDeployFailed      EventType = "deploy_failed"
+	EventRollback          EventType = "rollback" // sent instead of deploy_started by a rollback
+	EventBakeFailed        EventType = "bake_failed"
+)
+
+// Event is the JSON payload posted to webhooks.
+type Event struct {
+	Type         EventType `json:"type"`
+	Time         string    `json:"time"`
+	AppName      string    `json:"app_name"`
+	DeploymentID string    `json:"deployment_id,omitempty"`
+	Hash         string    `json:"hash,omitempty"`
+	Instance     string    `json:"instance_id,omitempty"`
+	Phase        string    `json:"phase,omitempty"`
+	Caller       string    `json:"caller,omitempty"`
+	Error        string    `json:"error,omitempty"`
+
+	// Changelog is what deploy_started and rollback put out
+	Changelog *Changelog `json:"changelog,omitempty"`
+}
+
+// Webhook is a URL events are posted to. With a Secret every delivery
+// carries X-Sc-Signature, the hex HMAC-SHA256 of the X-Sc-Timestamp value,
+// a newline and the body. Format "slack" posts a Slack compatible message
+// instead of the Event itself. Events lists what to send, all when empty.
+type Webhook struct {
+	URL    string
+	Secret string
+	Format string
+	Events []EventType
+}
+
+const (
+	headerEvent = "X-Sc-Event"
+
+	webhookAttempts = 5
+	webhookBackoff  = time.Second
+
+	// slackCommits is how many commits of a changelog a Slack message lists
+	slackCommits = 10
+)
+
+// notifier delivers events to webhooks in the background, retrying with
+// exponential backoff
+type notifier struct {
+	hooks   []Webhook
+	app     string
+	client  *http.Client
+	log     *fieldLogger
+	backoff time.Duration
+	pending sync.WaitGroup
+}
+
+func newNotifier(config ServerControlConfig, log *fieldLogger) (*notifier, error) {
+
+	for _, h := range config.Webhooks {
+		if h.URL == "" {
+			return nil, fmt.Errorf("webhook without a URL")
+		}
+		if h.Format != "" && h.Format != "slack" {
+			return nil, fmt.Errorf("webhook %s has unknown format %q", h.URL, h.Format)
+		}
+	}
+
+	return &notifier{
+		hooks:   config.Webhooks,
+		app:     config.AppName,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		log:     log,
+		backoff: webhookBackoff,
+	}, nil
+}
+
+func (n *notifier) send(e Event) {
+
+	e.AppName = n.app
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+
+	for _, h := range n.hooks {
+		if len(h.Events) > 0 && !containsEvent(h.Events, e.Type) {
+			continue
+		}
+		n.pending.Add(1)
+		go func(h Webhook) {
+			defer n.pending.Done()
+			n.deliver(h, e)
+		}(h)
+	}
+}
+
+func (n *notifier) deliver(h Webhook, e Event) {
+
+	var body []byte
+	var err error
+	if h.Format == "slack" {
+		body, err = json.Marshal(SlackMessage(e))
+	} else {
+		body, err = json.Marshal(e)
+	}
+	if err != nil {
+		n.log.error("unable to encode event", errField(err))
+		return
+	}
+
+	log := n.log.with(field("webhook", h.URL), field("event", e.Type))
+	delay := n.backoff
+	for attempt := 1; ; attempt++ {
+
+		err = n.post(h, e.Type, body)
+		if err == nil {
+			log.debug("delivered event")
+			return
+		}
+		if attempt == webhookAttempts {
+			log.error("giving up delivering event", errField(err))
+			return
+		}
+
+		log.warn("event delivery failed, retrying", field("attempt", attempt), errField(err))
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (n *notifier) post(h Webhook, event EventType, body []byte) error {
+
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerEvent, string(event))
+	req.Header.Set(headerTimestamp, ts)
+	if h.Secret != "" {
+		req.Header.Set(headerSignature, webhookSignature(h.Secret, ts, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// wait gives deliveries in flight up to timeout to finish
+func (n *notifier) wait(timeout time.Duration) {
+
+	done := make(chan struct{})
+	go func() {
+		n.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		n.log.warn("shutting down with event deliveries still in flight")
+	}
+}
+
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks the signature of a webhook delivery, for use by
+// receivers. It does not check how old timestamp is.
+func VerifyWebhook(secret, timestamp string, body []byte, signature string) bool {
+	want := webhookSignature(secret, timestamp, body)
+	return hmac.Equal([]byte(want), []byte(signature))
+}
+
+func containsEvent(list []EventType, e EventType) bool {
+	for _, l := range list {
+		if l == e {
+			return true
+		}
+	}
+	return false
+}
+
+// SlackMessage formats an event for a Slack incoming webhook.
+func SlackMessage(e Event) map[string]string {
+
+	icon := ":information_source:"
+	switch e.Type {
+	case EventDeployFinished:
+		icon = ":white_check_mark:"
+	case EventDeployFailed, EventBakeFailed:
+		icon = ":x:"
+	case EventRollback:
+		icon = ":rewind:"
+	}
+
+	text := fmt.Sprintf("%s *%s* %s", icon, e.AppName, strings.Replace(string(e.Type), "_", " ", -1))
+	if e.Hash != "" {
+		text += fmt.Sprintf(" `%s`", shortHash(e.Hash))
+	}
+	if e.Instance != "" {
+		text += " on " + e.Instance
+	}
+	if e.Caller != "" {
+		text += " by " + e.Caller
+	}
+	if e.Error != "" {
+		text += "\n> " + e.Error
+	}
+	if cl := e.Changelog; cl != nil {
+		text += fmt.Sprintf("\n%d commits, %d removed, %d files", len(cl.Commits), len(cl.Removed), len(cl.Files))
+		for i, c := range cl.Commits {
+			if i == slackCommits {
+				text += fmt.Sprintf("\n• and %d more", len(cl.Commits)-i)
+				break
+			}
+			text += fmt.Sprintf("\n• `%s` %s (%s)", shortHash(c.Hash), c.Subject, c.Author)
+		}
+	}
+	if e.DeploymentID != "" {
+		text += "\ndeployment " + e.DeploymentID
+	}
+
+	return map[string]string{"text": text}
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 8 {
+		return hash[:8]
+	}
+	return hash
+}
+
+// event fills in what's known about the request's deploy
+func (sc *ServerControl) event(t EventType, props defaultProps) Event {
+	return Event{Type: t, DeploymentID: props.DeploymentID, Hash: props.Hash}
+}
@@ -0,0 +1,276 @@
+package servercontrol
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxFreezeDuration bounds a recurring freeze, finding the start of the
+// one in progress looks back at most this far a minute at a time
+const maxFreezeDuration = 7 * 24 * time.Hour
+
+// Freeze is a window deployments are refused in, unless they set
+// override_freeze and their caller has the override-freeze scope. It is
+// either a date range from Start to End, or recurring, starting whenever
+// Schedule matches and lasting Duration. Schedule is a cron expression of
+// minute, hour, day of month, month and day of week. Times are in
+// Location, UTC by default.
+type Freeze struct {
+	Name     string
+	Start    string // "2006-01-02 15:04", "2006-01-02" or RFC 3339
+	End      string
+	Schedule string
+	Duration time.Duration
+	Location string
+}
+
+// FreezeStatus is the freeze in effect, if any, as served at /freeze.
+type FreezeStatus struct {
+	Frozen bool   `json:"frozen"`
+	Name   string `json:"name,omitempty"`
+	Until  string `json:"until,omitempty"`
+}
+
+type freeze struct {
+	name       string
+	start, end time.Time
+	cron       *cronSpec
+	duration   time.Duration
+	loc        *time.Location
+}
+
+func newFreezes(config []Freeze) ([]freeze, error) {
+
+	freezes := []freeze{}
+	for _, c := range config {
+
+		if c.Name == "" {
+			return nil, errors.New("freezes need a name")
+		}
+		f := freeze{name: c.Name, duration: c.Duration, loc: time.UTC}
+
+		if c.Location != "" {
+			loc, err := time.LoadLocation(c.Location)
+			if err != nil {
+				return nil, fmt.Errorf("freeze %s: %v", c.Name, err)
+			}
+			f.loc = loc
+		}
+
+		switch {
+		case c.Schedule != "" && (c.Start != "" || c.End != ""):
+			return nil, fmt.Errorf("freeze %s has both a schedule and a date range", c.Name)
+		case c.Schedule != "":
+			if c.Duration <= 0 || c.Duration > maxFreezeDuration {
+				return nil, fmt.Errorf("freeze %s needs a duration of up to %s", c.Name, maxFreezeDuration)
+			}
+			cron, err := parseCron(c.Schedule)
+			if err != nil {
+				return nil, fmt.Errorf("freeze %s: %v", c.Name, err)
+			}
+			f.cron = cron
+		default:
+			var err error
+			if f.start, err = parseFreezeTime(c.Start, f.loc); err != nil {
+				return nil, fmt.Errorf("freeze %s start: %v", c.Name, err)
+			}
+			if f.end, err = parseFreezeTime(c.End, f.loc); err != nil {
+				return nil, fmt.Errorf("freeze %s end: %v", c.Name, err)
+			}
+			if !f.end.After(f.start) {
+				return nil, fmt.Errorf("freeze %s ends before it starts", c.Name)
+			}
+		}
+		freezes = append(freezes, f)
+	}
+	return freezes, nil
+}
+
+func parseFreezeTime(s string, loc *time.Location) (time.Time, error) {
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad time %q", s)
+}
+
+// active returns when f ends if t falls in it
+func (f freeze) active(t time.Time) (time.Time, bool) {
+
+	if f.cron == nil {
+		return f.end, !t.Before(f.start) && t.Before(f.end)
+	}
+
+	// the latest start no more than duration ago
+	for start := t.Truncate(time.Minute); t.Sub(start) < f.duration; start = start.Add(-time.Minute) {
+		if f.cron.matches(start.In(f.loc)) {
+			return start.Add(f.duration), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// frozen is the freeze t falls in, the one ending last when several do
+func (sc *ServerControl) frozen(t time.Time) FreezeStatus {
+
+	status := FreezeStatus{}
+	var until time.Time
+	for _, f := range sc.freezes {
+		if end, ok := f.active(t); ok && end.After(until) {
+			until = end
+			status = FreezeStatus{Frozen: true, Name: f.name, Until: end.UTC().Format(time.RFC3339)}
+		}
+	}
+	return status
+}
+
+// checkFreeze answers the request itself when deploying now is refused by
+// a freeze, returning the name of a freeze being overridden otherwise
+func (sc *ServerControl) checkFreeze(res http.ResponseWriter, req *http.Request, props defaultProps, log *fieldLogger) (string, bool) {
+
+	if props.OverrideFreeze {
+		if c, _ := CallerFromContext(req.Context()); !c.Allowed(ScopeOverrideFreeze) {
+			log.warn("refused freeze override, caller lacks scope", field("caller", callerName(req)))
+			res.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(res, "override_freeze needs the %s scope", ScopeOverrideFreeze)
+			return "", false
+		}
+	}
+
+	status := sc.frozen(time.Now())
+	if !status.Frozen {
+		return "", true
+	}
+
+	if !props.OverrideFreeze {
+		log.warn("refused during freeze", field("freeze", status.Name), field("until", status.Until))
+		res.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(res, "deploys are frozen by %s until %s", status.Name, status.Until)
+		return "", false
+	}
+
+	log.warn("overriding freeze", field("freeze", status.Name), field("caller", callerName(req)))
+	return status.Name, true
+}
+
+// freezeStatus serves the freeze in effect
+func (sc *ServerControl) freezeStatus(res http.ResponseWriter, req *http.Request) {
+
+	res.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate")
+	res.Header().Add("Content-Type", "application/json")
+
+	if j, err := ToJsonString(sc.frozen(time.Now())); err == nil {
+		fmt.Fprint(res, j)
+	} else {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+	}
+}
+
+// cronSpec is a parsed cron expression, each field a bitset of the values
+// it matches
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+
+	// day of month and day of week match either way when both are given
+	domAny, dowAny bool
+}
+
+func parseCron(s string) (*cronSpec, error) {
+
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q needs 5 fields", s)
+	}
+
+	c := &cronSpec{}
+	var err error
+	if c.minute, _, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hour, _, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.dom, c.domAny, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.month, _, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.dow, c.dowAny, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// 7 is Sunday as well as 0
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// parseCronField reads a comma separated list of *, n, n-m, each with an
+// optional /step, reporting whether it was a bare *
+func parseCronField(f string, min, max int) (uint64, bool, error) {
+
+	var bits uint64
+	for _, part := range strings.Split(f, ",") {
+
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, false, fmt.Errorf("bad step in %q", f)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, false, fmt.Errorf("bad value in %q", f)
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, false, fmt.Errorf("bad value in %q", f)
+				}
+			} else if step > 1 {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, false, fmt.Errorf("%q is outside %d-%d", f, min, max)
+		}
+
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, f == "*", nil
+}
+
+func (c *cronSpec) matches(t time.Time) bool {
+
+	has := func(bits uint64, v int) bool { return bits&(1<<uint(v)) != 0 }
+
+	if !has(c.minute, t.Minute()) || !has(c.hour, t.Hour()) || !has(c.month, int(t.Month())) {
+		return false
+	}
+
+	dom, dow := has(c.dom, t.Day()), has(c.dow, int(t.Weekday()))
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,169 @@
+package servercontrol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFreezeActive(t *testing.T) {
+
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	at := func(loc *time.Location, s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	tests := []struct {
+		name   string
+		freeze Freeze
+		at     time.Time
+		active bool
+		until  time.Time
+	}{
+		// a nightly window running past midnight
+		{"before midnight", Freeze{Schedule: "0 22 * * *", Duration: 4 * time.Hour},
+			at(time.UTC, "2026-10-19 23:59"), true, at(time.UTC, "2026-10-20 02:00")},
+		{"after midnight", Freeze{Schedule: "0 22 * * *", Duration: 4 * time.Hour},
+			at(time.UTC, "2026-10-20 01:59"), true, at(time.UTC, "2026-10-20 02:00")},
+		{"at its end", Freeze{Schedule: "0 22 * * *", Duration: 4 * time.Hour},
+			at(time.UTC, "2026-10-20 02:00"), false, time.Time{}},
+		{"at its start", Freeze{Schedule: "0 22 * * *", Duration: 4 * time.Hour},
+			at(time.UTC, "2026-10-19 22:00"), true, at(time.UTC, "2026-10-20 02:00")},
+		{"just before", Freeze{Schedule: "0 22 * * *", Duration: 4 * time.Hour},
+			at(time.UTC, "2026-10-19 21:59"), false, time.Time{}},
+
+		// the schedule is read in Location, the duration is elapsed time
+		{"weekend across the end of DST", Freeze{Schedule: "0 18 * * 5", Duration: 63 * time.Hour, Location: "America/New_York"},
+			at(ny, "2026-11-02 07:59"), true, at(ny, "2026-11-02 08:00")},
+		{"weekend over an hour early", Freeze{Schedule: "0 18 * * 5", Duration: 63 * time.Hour, Location: "America/New_York"},
+			at(ny, "2026-11-02 08:00"), false, time.Time{}},
+		{"night across the start of DST", Freeze{Schedule: "0 0 * * *", Duration: 4 * time.Hour, Location: "America/New_York"},
+			at(ny, "2026-03-08 04:59"), true, at(ny, "2026-03-08 05:00")},
+		{"repeated hour, second time", Freeze{Schedule: "30 1 * * *", Duration: 30 * time.Minute, Location: "America/New_York"},
+			at(time.UTC, "2026-11-01 06:45"), true, at(time.UTC, "2026-11-01 07:00")},
+		{"repeated hour, in between", Freeze{Schedule: "30 1 * * *", Duration: 30 * time.Minute, Location: "America/New_York"},
+			at(time.UTC, "2026-11-01 06:15"), false, time.Time{}},
+		// 02:30 doesn't exist the night DST starts, so neither does the window
+		{"skipped hour", Freeze{Schedule: "30 2 * * *", Duration: time.Hour, Location: "America/New_York"},
+			at(time.UTC, "2026-03-08 07:45"), false, time.Time{}},
+
+		// date ranges, in Location unless given as RFC 3339
+		{"holidays", Freeze{Start: "2026-12-24", End: "2026-12-27", Location: "America/New_York"},
+			at(ny, "2026-12-26 23:59"), true, at(ny, "2026-12-27 00:00")},
+		{"holidays over", Freeze{Start: "2026-12-24", End: "2026-12-27", Location: "America/New_York"},
+			at(time.UTC, "2026-12-27 05:00"), false, time.Time{}},
+		{"range across the start of DST", Freeze{Start: "2026-03-08 01:00", End: "2026-03-08 04:00", Location: "America/New_York"},
+			at(ny, "2026-03-08 03:30"), true, at(ny, "2026-03-08 04:00")},
+		{"range across the start of DST, over", Freeze{Start: "2026-03-08 01:00", End: "2026-03-08 04:00", Location: "America/New_York"},
+			at(ny, "2026-03-08 04:00"), false, time.Time{}},
+		{"rfc 3339", Freeze{Start: "2026-10-19T22:00:00Z", End: "2026-10-20T02:00:00Z", Location: "America/New_York"},
+			at(time.UTC, "2026-10-20 01:00"), true, at(time.UTC, "2026-10-20 02:00")},
+	}
+
+	for _, tt := range tests {
+		tt.freeze.Name = tt.name
+		freezes, err := newFreezes([]Freeze{tt.freeze})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		until, active := freezes[0].active(tt.at)
+		if active != tt.active || (active && !until.Equal(tt.until)) {
+			t.Errorf("%s: active at %s = %v until %s, want %v until %s",
+				tt.name, tt.at.UTC(), active, until.UTC(), tt.active, tt.until.UTC())
+		}
+	}
+}
+
+func TestNewFreezesRejects(t *testing.T) {
+
+	tests := map[string]Freeze{
+		"no name":            {Start: "2026-12-24", End: "2026-12-27"},
+		"schedule and range": {Name: "f", Schedule: "0 0 * * *", Duration: time.Hour, Start: "2026-12-24"},
+		"no duration":        {Name: "f", Schedule: "0 0 * * *"},
+		"too long":           {Name: "f", Schedule: "0 0 * * *", Duration: maxFreezeDuration + time.Minute},
+		"bad schedule":       {Name: "f", Schedule: "0 0 * *", Duration: time.Hour},
+		"ends first":         {Name: "f", Start: "2026-12-27", End: "2026-12-24"},
+		"empty range":        {Name: "f", Start: "2026-12-24", End: "2026-12-24"},
+		"bad date":           {Name: "f", Start: "24/12/2026", End: "2026-12-27"},
+		"bad location":       {Name: "f", Start: "2026-12-24", End: "2026-12-27", Location: "Mars/Olympus_Mons"},
+	}
+
+	for name, f := range tests {
+		if _, err := newFreezes([]Freeze{f}); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestCron(t *testing.T) {
+
+	at := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	tests := []struct {
+		spec  string
+		match []string
+		miss  []string
+	}{
+		{"*/15 * * * *", []string{"2026-10-19 10:00", "2026-10-19 10:45"}, []string{"2026-10-19 10:05"}},
+		{"0 9-17/2 * * 1-5", []string{"2026-10-19 09:00", "2026-10-23 17:00"}, []string{"2026-10-19 10:00", "2026-10-24 09:00"}},
+		{"5/20 * * * *", []string{"2026-10-19 10:05", "2026-10-19 10:45"}, []string{"2026-10-19 10:00"}},
+		{"0 0 * * 0", []string{"2026-10-25 00:00"}, []string{"2026-10-19 00:00"}},
+		{"0 0 * * 7", []string{"2026-10-25 00:00"}, []string{"2026-10-19 00:00"}},
+		{"0 0 1,15 * *", []string{"2026-10-01 00:00", "2026-10-15 00:00"}, []string{"2026-10-02 00:00"}},
+		{"0 0 * 12 *", []string{"2026-12-03 00:00"}, []string{"2026-11-03 00:00"}},
+		// day of month or day of week when both are given
+		{"0 0 13 * 5", []string{"2026-11-13 00:00", "2026-10-13 00:00", "2026-10-23 00:00"}, []string{"2026-10-14 00:00"}},
+		// both when either is *
+		{"0 0 * * 5", []string{"2026-10-23 00:00"}, []string{"2026-10-13 00:00"}},
+		{"0 0 13 * *", []string{"2026-10-13 00:00"}, []string{"2026-10-23 00:00"}},
+	}
+
+	for _, tt := range tests {
+		c, err := parseCron(tt.spec)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.spec, err)
+			continue
+		}
+		for _, s := range tt.match {
+			if !c.matches(at(s)) {
+				t.Errorf("%q does not match %s", tt.spec, s)
+			}
+		}
+		for _, s := range tt.miss {
+			if c.matches(at(s)) {
+				t.Errorf("%q matches %s", tt.spec, s)
+			}
+		}
+	}
+
+	for _, spec := range []string{
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1-a * * * *",
+	} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("parseCron(%q): no error", spec)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 #!/bin/bash
  
-source <( curl "http://169.254.169.254/latest/user-data" 2>/dev/null )
+metadata=${SERVERCONTROL_METADATA_ENDPOINT:-http://169.254.169.254}
+token=$( curl -s -X PUT "$metadata/latest/api/token" -H "X-aws-ec2-metadata-token-ttl-seconds: 60" 2>/dev/null )
+source <( curl -s -H "X-aws-ec2-metadata-token: $token" "$metadata/latest/user-data" 2>/dev/null )
 
 if [ "$#" -lt 1 ]; then
     echo "Usage: $git_hash <app_name> <git_hash> [revert_hash]"
@@ -18,16 +20,20 @@ build_name=$1-$2
 echo "Discard any local changes"
 git checkout -f 
 # git clean -f
-echo "Checkout master"
-git checkout -q master
+# fetch from servercontrol's RepoUrl, which refs were resolved against,
+# rather than whatever origin the checkout has
+repo=${SERVERCONTROL_REPO_URL:-origin}
+echo "Fetching branches and tags from $repo. -- forced"
+git fetch -q -f --tags "$repo" '+refs/heads/*:refs/remotes/origin/*'
 if [ "$?" -ne 0 ]; then
-    echo " - Checkout master failed."
+    echo " - Fetch failed."
     exit 1
 fi
+# a commit no branch or tag reaches is fetched by itself, where the remote allows it
+if ! git cat-file -e "$git_hash^{commit}" 2>/dev/null; then
+    git fetch -q "$repo" $git_hash
+fi
  
-echo "Pulling latest. -- forced"
-git fetch origin master
-git reset --hard FETCH_HEAD
 git clean -df
 if [ "$?" -ne 0 ]; then
     echo " - Pull failed."
@@ -50,7 +56,7 @@ if [ "$?" -ne 0 ]; then
 else
 
     echo ". building "
-    /var/go/src/go/bin/vgo build -v -ldflags "-X main.gitHash=`git rev-parse HEAD`" -o /tmp/$build_name
+    ${SERVERCONTROL_GO:-/var/go/src/go/bin/vgo} build -v -ldflags "-X main.gitHash=`git rev-parse HEAD`" -o /tmp/$build_name
     if [ "$?" -ne 0 ]; then 
         echo " - Compiling failed."
         echo "Reverting to git_hash $revert_hash."
@@ -0,0 +1,179 @@
+package servercontrol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Push webhooks from GitHub are signed with an HMAC of the body, GitLab
+// sends the secret itself. Neither carries a timestamp, so a delivery id
+// seen before is refused instead.
+const (
+	headerGitHubSignature = "X-Hub-Signature-256"
+	headerGitHubEvent     = "X-GitHub-Event"
+	headerGitHubDelivery  = "X-GitHub-Delivery"
+	headerGitLabToken     = "X-Gitlab-Token"
+	headerGitLabEvent     = "X-Gitlab-Event"
+
+	gitWebhookRoute = "/git_webhook"
+)
+
+var (
+	errNoGitWebhook       = errors.New("git webhook not enabled")
+	errBadGitSignature    = errors.New("git webhook signature mismatch")
+	errReplayedGitWebhook = errors.New("git webhook delivery already seen")
+)
+
+// pushPayload is the part of a GitHub or GitLab push event that matters
+type pushPayload struct {
+	Ref     string `json:"ref"`
+	After   string `json:"after"`
+	Deleted bool   `json:"deleted"`
+}
+
+// gitWebhookCaller authenticates a push webhook as GitWebhookToken, whose
+// scopes then decide what it may do like any other token's
+func (sc *ServerControl) gitWebhookCaller(r *http.Request) (Caller, error) {
+
+	var token *Token
+	for i, t := range sc.config.Tokens {
+		if t.Name == sc.config.GitWebhookToken && sc.config.GitWebhookToken != "" {
+			token = &sc.config.Tokens[i]
+		}
+	}
+	if token == nil {
+		return Caller{}, errNoGitWebhook
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return Caller{}, err
+	}
+
+	if sig := r.Header.Get(headerGitHubSignature); sig != "" {
+		mac := hmac.New(sha256.New, []byte(token.Secret))
+		mac.Write(body)
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(sig), []byte(expected)) {
+			return Caller{}, errBadGitSignature
+		}
+	} else if subtle.ConstantTimeCompare([]byte(r.Header.Get(headerGitLabToken)), []byte(token.Secret)) != 1 {
+		return Caller{}, errBadGitSignature
+	}
+
+	if id := r.Header.Get(headerGitHubDelivery); id != "" {
+		if !sc.nonces.add("git:"+id, time.Now().Add(24*time.Hour)) {
+			return Caller{}, errReplayedGitWebhook
+		}
+	}
+
+	return Caller{Name: token.Name, Scopes: token.Scopes}, nil
+}
+
+// gitWebhook deploys the new head of Branch when a push moves it. The
+// deployment runs after the response, git hosts don't wait minutes for one.
+func (sc *ServerControl) gitWebhook(res http.ResponseWriter, req *http.Request) {
+
+	event := req.Header.Get(headerGitHubEvent)
+	if event == "" {
+		event = req.Header.Get(headerGitLabEvent)
+	}
+	if event == "ping" {
+		fmt.Fprint(res, "pong")
+		return
+	}
+	if event != "push" && event != "Push Hook" {
+		res.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(res, "ignoring %s event", event)
+		return
+	}
+
+	push := pushPayload{}
+	if err := json.NewDecoder(req.Body).Decode(&push); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "%s", err.Error())
+		return
+	}
+
+	log := sc.log.with(field("ref", push.Ref), field(FieldHash, push.After))
+
+	switch {
+	case push.Ref != "refs/heads/"+sc.config.Branch:
+		res.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(res, "ignoring push to %s, deploying %s", push.Ref, sc.config.Branch)
+		return
+	case push.Deleted || strings.Trim(push.After, "0") == "":
+		res.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(res, "ignoring deletion of %s", push.Ref)
+		return
+	case !fullHash.MatchString(push.After):
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "bad commit %q", push.After)
+		return
+	case push.After == sc.config.Version:
+		fmt.Fprintf(res, "already running %s", push.After)
+		return
+	}
+
+	if paused, err := sc.paused.Holder(); err == nil && paused != nil {
+		log.warn("not deploying push, auto-deploy paused", field("paused_by", paused.Caller))
+		res.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(res, "auto-deploy paused by %s", paused.Caller)
+		return
+	}
+
+	if status := sc.frozen(time.Now()); status.Frozen {
+		log.warn("not deploying push, deploys frozen", field("freeze", status.Name))
+		res.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(res, "deploys are frozen by %s until %s", status.Name, status.Until)
+		return
+	}
+
+	if holder, err := sc.lock.Holder(); err == nil && holder != nil {
+		log.warn("not deploying push, deploy lock held", field("holder", holder.describe()))
+		res.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(res, "%s holds the deploy lock", holder.describe())
+		return
+	}
+
+	// the delivery check doesn't outlive a restart and GitLab has none, so
+	// only the branch's current head is deployed, never a replayed or
+	// late push of an older one
+	head, err := branchHead(sc.config.RepoUrl, sc.config.Branch)
+	if err != nil {
+		log.error("unable to resolve branch head", errField(err))
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "unable to resolve %s\n%s", sc.config.Branch, err.Error())
+		return
+	}
+	if head != push.After {
+		log.warn("not deploying stale push", field("head", head))
+		res.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(res, "stale push, %s is at %s, not %s", sc.config.Branch, head, push.After)
+		return
+	}
+
+	caller, _ := CallerFromContext(req.Context())
+	log.info("deploying push", field("caller", caller.Name))
+
+	go func() {
+		r, err := sc.internalRequest("/update_service", sc.audited("update_service", sc.updateService),
+			caller, defaultProps{Hash: push.After})
+		if err != nil {
+			log.error("unable to deploy push", errField(err))
+		} else if r.status >= 400 {
+			log.error("deploying push failed", field("status", r.status), field("response", r.body.String()))
+		}
+	}()
+
+	res.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(res, "deploying %s", push.After)
+}
@@ -1,7 +1,9 @@
-module "github.com/rem7/servercontrol"
+module github.com/rem7/servercontrol
+
+go 1.27.1
 
 require (
-	"github.com/aws/aws-sdk-go" v1.13.3
-	"github.com/gorilla/mux" v1.6.1
-	"github.com/urfave/negroni" v0.3.0
+	github.com/aws/aws-sdk-go v1.13.3
+	github.com/gorilla/mux v1.6.1
+	github.com/urfave/negroni v0.3.0
 )
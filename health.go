@@ -0,0 +1,132 @@
+package servercontrol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultHealthChecks   = 3
+	defaultHealthInterval = time.Second
+
+	healthRoute = "/health"
+)
+
+// Health is what /health reports.
+type Health struct {
+	Healthy       bool   `json:"healthy"`
+	GitCommitHash string `json:"git_commit_hash"`
+	Error         string `json:"error,omitempty"`
+}
+
+// checkHealth runs HealthCheck and fetches HealthURL, whichever are set
+func (sc *ServerControl) checkHealth() error {
+
+	if sc.config.HealthCheck != nil {
+		if err := sc.config.HealthCheck(); err != nil {
+			return err
+		}
+	}
+
+	if sc.config.HealthURL != "" {
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Get(sc.config.HealthURL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("%s returned %d", sc.config.HealthURL, resp.StatusCode)
+		}
+	}
+
+	return nil
+}
+
+// healthCaller lets a load balancer check /health without a token of its
+// own when PublicHealth or HealthBearerToken allow it
+func (sc *ServerControl) healthCaller(r *http.Request) (Caller, bool) {
+	return bearerCaller(r, "health", sc.config.PublicHealth, sc.config.HealthBearerToken)
+}
+
+func (sc *ServerControl) health(res http.ResponseWriter, req *http.Request) {
+
+	res.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate")
+	res.Header().Add("Content-Type", "application/json")
+
+	h := Health{Healthy: true, GitCommitHash: sc.sv.GitCommitHash}
+	if err := sc.checkHealth(); err != nil {
+		h.Healthy = false
+		h.Error = err.Error()
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if j, err := ToJsonString(h); err == nil {
+		fmt.Fprint(res, j)
+	} else {
+		fmt.Fprintf(res, "%s", err.Error())
+	}
+}
+
+// waitForHealthy polls an instance's /health until it passes HealthChecks
+// times in a row. An instance without /health, running an older
+// servercontrol, is taken as healthy.
+func (sc *ServerControl) waitForHealthy(instance Instance, log *fieldLogger) error {
+
+	url := sc.getServiceForInstance(instance, "health")
+	deadline := time.Now().Add(time.Duration(sc.config.Timeout) * time.Second)
+
+	passed := 0
+	lastErr := errors.New("no health check completed")
+	for time.Now().Before(deadline) {
+
+		err := sc.peerHealth(url)
+		if err == errNoHealthEndpoint {
+			log.warn("instance has no health endpoint, not waiting for it to be healthy")
+			return nil
+		}
+
+		if err == nil {
+			passed++
+			log.debug("instance healthy", field("passed", passed))
+			if passed >= sc.config.HealthChecks {
+				return nil
+			}
+		} else {
+			passed = 0
+			lastErr = err
+			log.debug("instance unhealthy", errField(err))
+		}
+
+		time.Sleep(sc.config.HealthInterval)
+	}
+
+	return fmt.Errorf("instance never passed %d health checks in a row: %v", sc.config.HealthChecks, lastErr)
+}
+
+var errNoHealthEndpoint = errors.New("no health endpoint")
+
+func (sc *ServerControl) peerHealth(url string) error {
+
+	resp, err := sc.apiRequest(url, "GET", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errNoHealthEndpoint
+	}
+
+	h := Health{}
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+		return fmt.Errorf("health returned %d: %v", resp.StatusCode, err)
+	}
+	if !h.Healthy {
+		return errors.New(h.Error)
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package servercontrol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Outcomes a Deployment can have.
+const (
+	DeployInProgress  = "in_progress"
+	DeployOK          = "ok"
+	DeployFailed      = "failed"
+	DeployInterrupted = "interrupted"
+)
+
+var errNoPreviousVersion = errors.New("no previous version to roll back to")
+
+// Deployment is one update_service or rollback run, as coordinated by this
+// server.
+type Deployment struct {
+	ID               string           `json:"id"`
+	Kind             string           `json:"kind"`
+	Hash             string           `json:"hash"`
+	Ref              string           `json:"ref,omitempty"`
+	PreviousHash     string           `json:"previous_hash"`
+	Caller           string           `json:"caller"`
+	Started          string           `json:"started"`
+	Finished         string           `json:"finished,omitempty"`
+	Outcome          string           `json:"outcome"`
+	Phase            string           `json:"phase,omitempty"`
+	Error            string           `json:"error,omitempty"`
+	Verification     *Verification    `json:"verification,omitempty"`
+	FreezeOverridden string           `json:"freeze_overridden,omitempty"`
+	ApprovedBy       string           `json:"approved_by,omitempty"`
+	Bake             string           `json:"bake,omitempty"`
+	BakeError        string           `json:"bake_error,omitempty"`
+	Instances        []InstanceResult `json:"instances"`
+}
+
+// InstanceResult is how far a deployment got on one instance.
+type InstanceResult struct {
+	InstanceID string `json:"instance_id"`
+	Built      bool   `json:"built"`
+	Restarted  bool   `json:"restarted"`
+	Error      string `json:"error,omitempty"`
+}
+
+func (d *Deployment) instance(id string) *InstanceResult {
+
+	for i := range d.Instances {
+		if d.Instances[i].InstanceID == id {
+			return &d.Instances[i]
+		}
+	}
+	d.Instances = append(d.Instances, InstanceResult{InstanceID: id})
+	return &d.Instances[len(d.Instances)-1]
+}
+
+// historyStore keeps deployments in a single file of JSON lines. Every
+// change to a deployment appends its new state, the file is compacted to
+// the latest state of each when it is opened.
+type historyStore struct {
+	mu          sync.Mutex
+	path        string
+	deployments []*Deployment
+}
+
+// openHistory loads the deployment history, marking any deployment that
+// was still running when the process went away as interrupted and dropping
+// a last line it left half written
+func openHistory(path string, log *fieldLogger) (*historyStore, error) {
+
+	h := &historyStore{path: path}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	index := map[string]int{}
+	lines := 0
+	partial, err := readJSONLines(f, func(n int, line []byte) error {
+		lines = n
+		d := &Deployment{}
+		if err := json.Unmarshal(line, d); err != nil {
+			return fmt.Errorf("history line %d: %v", n, err)
+		}
+		if i, ok := index[d.ID]; ok {
+			h.deployments[i] = d
+		} else {
+			index[d.ID] = len(h.deployments)
+			h.deployments = append(h.deployments, d)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if partial >= 0 {
+		log.warn("dropping partly written history line", field("path", path), field("offset", partial))
+	}
+
+	interrupted := false
+	for _, d := range h.deployments {
+		if d.Outcome == DeployInProgress {
+			d.Outcome = DeployInterrupted
+			interrupted = true
+		}
+	}
+
+	if interrupted || lines > len(h.deployments) || partial >= 0 {
+		if err := h.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// compact rewrites the file with one line per deployment
+func (h *historyStore) compact() error {
+
+	buf := &bytes.Buffer{}
+	for _, d := range h.deployments {
+		line, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+
+	tmp := h.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path)
+}
+
+// put records the current state of d. It does nothing without a history
+// file so deploys don't need to check.
+func (h *historyStore) put(d *Deployment) error {
+
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	line, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	copied := *d
+	copied.Instances = append([]InstanceResult{}, d.Instances...)
+	for i, existing := range h.deployments {
+		if existing.ID == d.ID {
+			h.deployments[i] = &copied
+			return nil
+		}
+	}
+	h.deployments = append(h.deployments, &copied)
+	return nil
+}
+
+func (h *historyStore) list() []Deployment {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	list := make([]Deployment, len(h.deployments))
+	for i, d := range h.deployments {
+		list[i] = *d
+	}
+	return list
+}
+
+// latest is the most recent deployment, nil when there is none
+func (h *historyStore) latest() *Deployment {
+
+	if h == nil {
+		return nil
+	}
+
+	list := h.list()
+	if len(list) == 0 {
+		return nil
+	}
+	return &list[len(list)-1]
+}
+
+// previous is the version the fleet ran before its latest successful
+// deployment, what a rollback goes back to. Rollbacks and the deployments
+// they undid are passed over, so rolling back again goes further back
+// rather than returning to what was just rolled back.
+func (h *historyStore) previous() (string, error) {
+
+	if h == nil {
+		return "", errNoPreviousVersion
+	}
+
+	list := h.list()
+	undone := 0
+	for i := len(list) - 1; i >= 0; i-- {
+		d := list[i]
+		switch {
+		case d.Outcome != DeployOK:
+			continue
+		case d.Kind == "rollback":
+			undone++
+			continue
+		case undone > 0:
+			undone--
+			continue
+		}
+		if d.PreviousHash == "" || d.PreviousHash == d.Hash {
+			break
+		}
+		return d.PreviousHash, nil
+	}
+	return "", errNoPreviousVersion
+}
+
+// record saves d, logging rather than failing the deploy when it can't
+func (sc *ServerControl) record(d *Deployment) {
+	if err := sc.history.put(d); err != nil {
+		sc.log.error("unable to write deployment history", field(FieldDeployment, d.ID), errField(err))
+	}
+}
+
+// historyQuery serves the deployment history filtered by hash and outcome,
+// most recent limit deployments, oldest first
+func (sc *ServerControl) historyQuery(res http.ResponseWriter, req *http.Request) {
+
+	res.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate")
+	res.Header().Add("Content-Type", "application/json")
+
+	if sc.history == nil {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(res, "deployment history not enabled")
+		return
+	}
+
+	q := req.URL.Query()
+
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			res.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(res, "bad limit")
+			return
+		}
+	}
+
+	matched := []Deployment{}
+	for _, d := range sc.history.list() {
+		switch {
+		case q.Get("hash") != "" && d.Hash != q.Get("hash"):
+		case q.Get("outcome") != "" && d.Outcome != q.Get("outcome"):
+		default:
+			matched = append(matched, d)
+		}
+	}
+	if len(matched) > limit {
+		matched = matched[len(matched)-limit:]
+	}
+
+	previous, _ := sc.history.previous()
+	result := struct {
+		Previous    string       `json:"previous_hash,omitempty"`
+		Deployments []Deployment `json:"deployments"`
+	}{previous, matched}
+
+	if j, err := ToJsonString(result); err == nil {
+		fmt.Fprint(res, j)
+	} else {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+	}
+}
+
+func timestamp() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
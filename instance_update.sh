@@ -1,9 +1,14 @@
 #!/bin/bash
-source <( curl "http://169.254.169.254/latest/user-data" 2>/dev/null )
+
+metadata=${SERVERCONTROL_METADATA_ENDPOINT:-http://169.254.169.254}
+token=$( curl -s -X PUT "$metadata/latest/api/token" -H "X-aws-ec2-metadata-token-ttl-seconds: 60" 2>/dev/null )
+source <( curl -s -H "X-aws-ec2-metadata-token: $token" "$metadata/latest/user-data" 2>/dev/null )
  
 if [ "${GO_GIT_HASH}" != "" ]; then
   pushd $PROJECT_DIR >/dev/null 2>/dev/null
-  su go -c "vendor/github.com/rem7/servercontrol/git_update_to_hash.sh ${GO_PROJECT} ${GO_GIT_HASH}" >> /tmp/instance-update.log 2>&1
+  # the user data sets SERVERCONTROL_REPO_URL to servercontrol's RepoUrl
+  # when the checkout's origin is somewhere else
+  su go -c "SERVERCONTROL_METADATA_ENDPOINT='$metadata' SERVERCONTROL_REPO_URL='${SERVERCONTROL_REPO_URL}' vendor/github.com/rem7/servercontrol/git_update_to_hash.sh ${GO_PROJECT} ${GO_GIT_HASH}" >> /tmp/instance-update.log 2>&1
   popd >/dev/null 2>/dev/null
   ln -s /etc/sv/$GO_PROJECT /etc/service/$GO_PROJECT
 fi
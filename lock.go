@@ -0,0 +1,574 @@
+package servercontrol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const defaultLockTTL = 2 * time.Minute
+
+// ErrLocked is returned by Locker.Acquire while someone else holds the lock.
+var ErrLocked = errors.New("another deployment holds the deploy lock")
+
+// errLockLost is returned when renewing or releasing a lock that expired
+// and was taken by someone else
+var errLockLost = errors.New("deploy lock no longer held")
+
+// LockHolder describes who holds the deploy lock.
+type LockHolder struct {
+	DeploymentID string    `json:"deployment_id"`
+	Instance     string    `json:"instance_id"`
+	Caller       string    `json:"caller"`
+	Hash         string    `json:"hash"`
+	Acquired     time.Time `json:"acquired"`
+	Expires      time.Time `json:"expires"`
+}
+
+func (h *LockHolder) describe() string {
+	if h == nil {
+		return "another deployment"
+	}
+	return fmt.Sprintf("deployment %s of %s by %s from %s until %s",
+		h.DeploymentID, h.Hash, h.Caller, h.Instance, h.Expires.Format(time.RFC3339))
+}
+
+// Locker is the fleet wide lock a deployment holds from start to finish so
+// two can't interleave. Holders are told apart by DeploymentID, a lock
+// whose Expires has passed may be taken over.
+type Locker interface {
+	// Acquire takes the lock for h, returning ErrLocked and the current
+	// holder when it is taken.
+	Acquire(h LockHolder) (*LockHolder, error)
+	// Renew moves Expires of a lock h holds.
+	Renew(h LockHolder) error
+	// Release gives up a lock h holds.
+	Release(h LockHolder) error
+	// Holder returns the current holder, nil when the lock is free.
+	Holder() (*LockHolder, error)
+	// ForceUnlock releases the lock whoever holds it.
+	ForceUnlock() error
+}
+
+// NewMemoryLocker returns a Locker that only coordinates within this
+// process.
+func NewMemoryLocker() Locker {
+	return &memoryLocker{}
+}
+
+type memoryLocker struct {
+	mu     sync.Mutex
+	holder *LockHolder
+}
+
+func (l *memoryLocker) Acquire(h LockHolder) (*LockHolder, error) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.holder != nil && time.Now().Before(l.holder.Expires) {
+		current := *l.holder
+		return &current, ErrLocked
+	}
+	l.holder = &h
+	return &h, nil
+}
+
+func (l *memoryLocker) Renew(h LockHolder) error {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.holder == nil || l.holder.DeploymentID != h.DeploymentID {
+		return errLockLost
+	}
+	l.holder.Expires = h.Expires
+	return nil
+}
+
+func (l *memoryLocker) Release(h LockHolder) error {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.holder == nil || l.holder.DeploymentID != h.DeploymentID {
+		return errLockLost
+	}
+	l.holder = nil
+	return nil
+}
+
+func (l *memoryLocker) Holder() (*LockHolder, error) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.holder == nil || time.Now().After(l.holder.Expires) {
+		return nil, nil
+	}
+	current := *l.holder
+	return &current, nil
+}
+
+func (l *memoryLocker) ForceUnlock() error {
+	l.mu.Lock()
+	l.holder = nil
+	l.mu.Unlock()
+	return nil
+}
+
+// NewFileLocker returns a Locker keeping the holder in a file, for fleets
+// that share a filesystem such as several instances on one box. Changes
+// are serialized with flock on path.lock.
+func NewFileLocker(path string) Locker {
+	return &fileLocker{path: path}
+}
+
+type fileLocker struct {
+	path string
+}
+
+// update runs fn with the current holder under the file lock and stores
+// what it returns
+func (l *fileLocker) update(fn func(current *LockHolder) (*LockHolder, error)) error {
+
+	f, err := os.OpenFile(l.path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	current, err := l.read()
+	if err != nil {
+		return err
+	}
+
+	next, err := fn(current)
+	if err != nil {
+		return err
+	}
+
+	if next == nil {
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(next)
+	if err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+func (l *fileLocker) read() (*LockHolder, error) {
+
+	data, err := ioutil.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	h := &LockHolder{}
+	if err := json.Unmarshal(data, h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (l *fileLocker) Acquire(h LockHolder) (*LockHolder, error) {
+
+	var holder *LockHolder
+	err := l.update(func(current *LockHolder) (*LockHolder, error) {
+		if current != nil && time.Now().Before(current.Expires) {
+			holder = current
+			return nil, ErrLocked
+		}
+		holder = &h
+		return &h, nil
+	})
+	return holder, err
+}
+
+func (l *fileLocker) Renew(h LockHolder) error {
+	return l.update(func(current *LockHolder) (*LockHolder, error) {
+		if current == nil || current.DeploymentID != h.DeploymentID {
+			return nil, errLockLost
+		}
+		current.Expires = h.Expires
+		return current, nil
+	})
+}
+
+func (l *fileLocker) Release(h LockHolder) error {
+	return l.update(func(current *LockHolder) (*LockHolder, error) {
+		if current == nil || current.DeploymentID != h.DeploymentID {
+			return nil, errLockLost
+		}
+		return nil, nil
+	})
+}
+
+func (l *fileLocker) Holder() (*LockHolder, error) {
+
+	h, err := l.read()
+	if err != nil || h == nil || time.Now().After(h.Expires) {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (l *fileLocker) ForceUnlock() error {
+	return l.update(func(current *LockHolder) (*LockHolder, error) {
+		return nil, nil
+	})
+}
+
+// dynamoLocker keeps the holder in a DynamoDB item keyed by lock_key, taken
+// and given up with conditional writes. The table needs a string hash key
+// named lock_key.
+type dynamoLocker struct {
+	table  string
+	key    string
+	client func() (*dynamodb.DynamoDB, error)
+}
+
+func (l *dynamoLocker) itemKey() map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"lock_key": {S: aws.String(l.key)},
+	}
+}
+
+func (l *dynamoLocker) Acquire(h LockHolder) (*LockHolder, error) {
+
+	db, err := l.client()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+
+	item := l.itemKey()
+	item["deployment_id"] = &dynamodb.AttributeValue{S: aws.String(h.DeploymentID)}
+	item["expires"] = &dynamodb.AttributeValue{N: aws.String(fmt.Sprint(h.Expires.Unix()))}
+	item["holder"] = &dynamodb.AttributeValue{S: aws.String(string(data))}
+
+	_, err = db.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(l.table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(lock_key) OR expires < :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {N: aws.String(fmt.Sprint(time.Now().Unix()))},
+		},
+	})
+	if isConditionFailed(err) {
+		current, err := l.Holder()
+		if err != nil {
+			return nil, err
+		}
+		return current, ErrLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+func (l *dynamoLocker) Renew(h LockHolder) error {
+
+	db, err := l.client()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(l.table),
+		Key:                 l.itemKey(),
+		UpdateExpression:    aws.String("SET expires = :expires, holder = :holder"),
+		ConditionExpression: aws.String("deployment_id = :id"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":expires": {N: aws.String(fmt.Sprint(h.Expires.Unix()))},
+			":holder":  {S: aws.String(string(data))},
+			":id":      {S: aws.String(h.DeploymentID)},
+		},
+	})
+	if isConditionFailed(err) {
+		return errLockLost
+	}
+	return err
+}
+
+func (l *dynamoLocker) Release(h LockHolder) error {
+
+	db, err := l.client()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           aws.String(l.table),
+		Key:                 l.itemKey(),
+		ConditionExpression: aws.String("deployment_id = :id"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":id": {S: aws.String(h.DeploymentID)},
+		},
+	})
+	if isConditionFailed(err) {
+		return errLockLost
+	}
+	return err
+}
+
+func (l *dynamoLocker) Holder() (*LockHolder, error) {
+
+	db, err := l.client()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(l.table),
+		Key:            l.itemKey(),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	attr, ok := out.Item["holder"]
+	if !ok || attr.S == nil {
+		return nil, nil
+	}
+
+	h := &LockHolder{}
+	if err := json.Unmarshal([]byte(*attr.S), h); err != nil {
+		return nil, err
+	}
+	if time.Now().After(h.Expires) {
+		return nil, nil
+	}
+	return h, nil
+}
+
+func (l *dynamoLocker) ForceUnlock() error {
+
+	db, err := l.client()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(l.table),
+		Key:       l.itemKey(),
+	})
+	return err
+}
+
+func isConditionFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// newLocker picks Lock, then a DynamoDB table, then a file, and otherwise
+// only guards against concurrent deployments coordinated by this process
+func (sc *ServerControl) newLocker() Locker {
+
+	if sc.config.Lock != nil {
+		return sc.config.Lock
+	}
+	return sc.sharedLocker("")
+}
+
+// sharedLocker is a lock kept next to the deploy lock in LockTable or
+// LockFile, told apart from it by suffix
+func (sc *ServerControl) sharedLocker(suffix string) Locker {
+
+	switch {
+	case sc.config.LockTable != "":
+		return &dynamoLocker{
+			table: sc.config.LockTable,
+			key:   sc.config.LockKey + suffix,
+			client: func() (*dynamodb.DynamoDB, error) {
+				if err := sc.connect(); err != nil {
+					return nil, err
+				}
+				return dynamodb.New(sc.sess), nil
+			},
+		}
+	case sc.config.LockFile != "":
+		return NewFileLocker(sc.config.LockFile + suffix)
+	}
+	return NewMemoryLocker()
+}
+
+// deployLock is a held lock, renewed in the background until released.
+// lost is closed once it is found held by someone else.
+type deployLock struct {
+	sc       *ServerControl
+	holder   LockHolder
+	stop     chan struct{}
+	done     chan struct{}
+	lost     chan struct{}
+	lostOnce sync.Once
+}
+
+// lockDeploy takes the deploy lock for a deployment, returning the current
+// holder along with ErrLocked when someone else has it
+func (sc *ServerControl) lockDeploy(props defaultProps, caller string) (*deployLock, *LockHolder, error) {
+
+	now := time.Now()
+	h := LockHolder{
+		DeploymentID: props.DeploymentID,
+		Instance:     sc.instanceID(),
+		Caller:       caller,
+		Hash:         props.Hash,
+		Acquired:     now,
+		Expires:      now.Add(sc.config.LockTTL),
+	}
+
+	current, err := sc.lock.Acquire(h)
+	if err != nil {
+		return nil, current, err
+	}
+
+	l := &deployLock{sc: sc, holder: h, stop: make(chan struct{}), done: make(chan struct{}), lost: make(chan struct{})}
+	go l.renew()
+	return l, nil, nil
+}
+
+func (l *deployLock) renew() {
+
+	defer close(l.done)
+
+	log := l.sc.log.with(field(FieldDeployment, l.holder.DeploymentID))
+	ticker := time.NewTicker(l.sc.config.LockTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.holder.Expires = time.Now().Add(l.sc.config.LockTTL)
+			err := l.sc.lock.Renew(l.holder)
+			if err == errLockLost {
+				log.error("deploy lock lost", errField(err))
+				l.lostOnce.Do(func() { close(l.lost) })
+				return
+			}
+			if err != nil {
+				log.error("unable to renew deploy lock", errField(err))
+			}
+		}
+	}
+}
+
+// held returns errLockLost once the lock has been lost, the deployment
+// holding it checks between steps and stops. Renewals are too far apart to
+// catch a takeover between two instances, so the holder is read as well.
+func (l *deployLock) held() error {
+
+	select {
+	case <-l.lost:
+		return errLockLost
+	default:
+	}
+
+	current, err := l.sc.lock.Holder()
+	if err == nil && (current == nil || current.DeploymentID != l.holder.DeploymentID) {
+		l.lostOnce.Do(func() { close(l.lost) })
+		return errLockLost
+	}
+	return nil
+}
+
+func (l *deployLock) release() {
+
+	close(l.stop)
+	<-l.done
+
+	// whoever has the lock now keeps it
+	if l.held() != nil {
+		return
+	}
+
+	if err := l.sc.lock.Release(l.holder); err != nil {
+		l.sc.log.error("unable to release deploy lock", field(FieldDeployment, l.holder.DeploymentID), errField(err))
+	}
+}
+
+// lockStatus serves who holds the deploy lock, null when it is free
+func (sc *ServerControl) lockStatus(res http.ResponseWriter, req *http.Request) {
+
+	res.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate")
+	res.Header().Add("Content-Type", "application/json")
+
+	holder, err := sc.lock.Holder()
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+		return
+	}
+
+	result := struct {
+		Holder *LockHolder `json:"holder"`
+	}{holder}
+
+	if j, err := ToJsonString(result); err == nil {
+		fmt.Fprint(res, j)
+	} else {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+	}
+}
+
+// forceUnlock releases the deploy lock whoever holds it, for when a
+// coordinator died mid deployment and waiting out the lease isn't an option
+func (sc *ServerControl) forceUnlock(res http.ResponseWriter, req *http.Request) {
+
+	holder, _ := sc.lock.Holder()
+
+	if err := sc.lock.ForceUnlock(); err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+		return
+	}
+
+	if holder != nil {
+		sc.log.warn("deploy lock forcibly released", field("caller", callerName(req)),
+			field(FieldDeployment, holder.DeploymentID), field(FieldInstance, holder.Instance))
+		fmt.Fprintf(res, "released lock held by deployment %s", holder.DeploymentID)
+	} else {
+		fmt.Fprint(res, "lock was not held")
+	}
+}
@@ -0,0 +1,175 @@
+package servercontrol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message. The zero value is LevelInfo.
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch {
+	case l < LevelInfo:
+		return "debug"
+	case l < LevelWarn:
+		return "info"
+	case l < LevelError:
+		return "warn"
+	}
+	return "error"
+}
+
+// Field is a key/value pair attached to a log message.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Keys of the fields servercontrol attaches to its messages.
+const (
+	FieldDeployment = "deployment_id"
+	FieldInstance   = "instance_id"
+	FieldHash       = "hash"
+	FieldPhase      = "phase"
+	FieldError      = "error"
+)
+
+// StructuredLogger receives leveled messages with key/value fields. It is
+// only handed messages at or above the configured LogLevel.
+type StructuredLogger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+// LoggerFunc adapts an ordinary function to StructuredLogger.
+type LoggerFunc func(level Level, msg string, fields ...Field)
+
+func (f LoggerFunc) Log(level Level, msg string, fields ...Field) {
+	f(level, msg, fields...)
+}
+
+// AdaptLogger turns a Printf style Logger into a StructuredLogger, writing
+// the level, message and fields as one logfmt style line. Fatalf is never
+// called.
+func AdaptLogger(l Logger) StructuredLogger {
+	return LoggerFunc(func(level Level, msg string, fields ...Field) {
+		l.Printf("%s", formatLine(level, msg, fields))
+	})
+}
+
+// NewTextLogger writes one logfmt style line per message to w.
+func NewTextLogger(w io.Writer) StructuredLogger {
+
+	mu := &sync.Mutex{}
+	return LoggerFunc(func(level Level, msg string, fields ...Field) {
+		line := time.Now().UTC().Format(time.RFC3339) + " " + formatLine(level, msg, fields) + "\n"
+		mu.Lock()
+		io.WriteString(w, line)
+		mu.Unlock()
+	})
+}
+
+func formatLine(level Level, msg string, fields []Field) string {
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "level=%s msg=%s", level, quoteValue(msg))
+	for _, f := range fields {
+		fmt.Fprintf(b, " %s=%s", f.Key, quoteValue(fmt.Sprint(f.Value)))
+	}
+	return b.String()
+}
+
+func quoteValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// fieldLogger is what the rest of the package logs through, it drops
+// messages below the configured level and carries fields bound with with
+type fieldLogger struct {
+	out    StructuredLogger
+	min    Level
+	fields []Field
+}
+
+// newFieldLogger picks StructuredLog, then Log through AdaptLogger, then
+// stderr. DEBUG lowers the level to LevelDebug.
+func newFieldLogger(config ServerControlConfig) *fieldLogger {
+
+	l := &fieldLogger{out: config.StructuredLog, min: config.LogLevel}
+	if l.out == nil && config.Log != nil {
+		l.out = AdaptLogger(config.Log)
+	}
+	if l.out == nil {
+		l.out = NewTextLogger(os.Stderr)
+	}
+	if DEBUG {
+		l.min = LevelDebug
+	}
+	return l
+}
+
+func (l *fieldLogger) with(fields ...Field) *fieldLogger {
+
+	bound := make([]Field, 0, len(l.fields)+len(fields))
+	bound = append(bound, l.fields...)
+	bound = append(bound, fields...)
+	return &fieldLogger{out: l.out, min: l.min, fields: bound}
+}
+
+func (l *fieldLogger) log(level Level, msg string, fields []Field) {
+
+	if level < l.min {
+		return
+	}
+	if len(l.fields) > 0 {
+		fields = append(append([]Field{}, l.fields...), fields...)
+	}
+	l.out.Log(level, msg, fields...)
+}
+
+func (l *fieldLogger) debug(msg string, fields ...Field) { l.log(LevelDebug, msg, fields) }
+func (l *fieldLogger) info(msg string, fields ...Field)  { l.log(LevelInfo, msg, fields) }
+func (l *fieldLogger) warn(msg string, fields ...Field)  { l.log(LevelWarn, msg, fields) }
+func (l *fieldLogger) error(msg string, fields ...Field) { l.log(LevelError, msg, fields) }
+
+func field(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+func errField(err error) Field {
+	return Field{Key: FieldError, Value: err}
+}
+
+// newDeploymentID identifies one update_service run across the fleet
+func newDeploymentID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestLog carries the hash and deployment a request is part of
+func (sc *ServerControl) requestLog(props defaultProps) *fieldLogger {
+
+	log := sc.log.with(field(FieldHash, props.Hash))
+	if props.DeploymentID != "" {
+		log = log.with(field(FieldDeployment, props.DeploymentID))
+	}
+	return log
+}
@@ -0,0 +1,357 @@
+package servercontrol
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// ErrNotOnEC2 is returned by anything that needs the instance metadata
+// service or the AWS apis when neither is available, either because
+// NotOnEC2 is set or because the metadata service could not be reached.
+var ErrNotOnEC2 = errors.New("servercontrol: not running on ec2")
+
+type Metadata struct {
+	InstanceID       string
+	Region           string
+	AvailabilityZone string
+	InstanceType     string
+	UserData         string
+}
+
+const (
+	metadataTokenTTL      = 6 * time.Hour
+	metadataTimeout       = 2 * time.Second
+	metadataRetries       = 3
+	metadataRetryInterval = 250 * time.Millisecond
+
+	// a failed load is retried no sooner than this, doubling up to
+	// metadataMaxReload while it keeps failing
+	metadataReload    = 5 * time.Second
+	metadataMaxReload = 5 * time.Minute
+)
+
+// errMetadataNotFound is returned for paths the metadata service doesn't
+// have, like user-data on an instance launched without any
+var errMetadataNotFound = errors.New("metadata not found")
+
+// metadataClient reads the instance metadata service using the IMDSv2
+// session token flow, falling back to plain requests when the endpoint
+// doesn't issue tokens.
+type metadataClient struct {
+	endpoint string
+	client   *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+	v1      bool
+}
+
+func newMetadataClient(endpoint string) *metadataClient {
+	return &metadataClient{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		client:   &http.Client{Timeout: metadataTimeout},
+	}
+}
+
+func (c *metadataClient) getToken(refresh bool) (string, error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.v1 {
+		return "", nil
+	}
+
+	if !refresh && c.token != "" && time.Now().Before(c.expires) {
+		return c.token, nil
+	}
+
+	req, err := http.NewRequest("PUT", c.endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	ttl := int(metadataTokenTTL / time.Second)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(ttl))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		// no token support, talk IMDSv1 from now on
+		c.v1 = true
+		return "", nil
+	default:
+		return "", errors.New("metadata token request returned " + resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	c.token = string(data)
+	// refresh a little early so a token never expires mid request
+	c.expires = time.Now().Add(metadataTokenTTL - time.Minute)
+	return c.token, nil
+}
+
+// get reads a path under /latest, retrying network errors and server
+// errors, and fetching a new token if the current one is rejected
+func (c *metadataClient) get(p string) (string, error) {
+
+	var lastErr error
+	refresh := false
+	for i := 0; i < metadataRetries; i++ {
+
+		if i > 0 {
+			time.Sleep(metadataRetryInterval * time.Duration(i))
+		}
+
+		token, err := c.getToken(refresh)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		refresh = false
+
+		req, err := http.NewRequest("GET", c.endpoint+"/latest/"+p, nil)
+		if err != nil {
+			return "", err
+		}
+		if token != "" {
+			req.Header.Set("X-aws-ec2-metadata-token", token)
+		}
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		switch {
+		case err != nil:
+			lastErr = err
+		case resp.StatusCode == http.StatusOK:
+			return string(data), nil
+		case resp.StatusCode == http.StatusNotFound:
+			return "", errMetadataNotFound
+		case resp.StatusCode == http.StatusUnauthorized:
+			refresh = true
+			lastErr = errors.New("metadata token rejected")
+		case resp.StatusCode >= 500:
+			lastErr = errors.New("metadata service returned " + resp.Status)
+		default:
+			return "", errors.New("metadata service returned " + resp.Status)
+		}
+	}
+
+	return "", lastErr
+}
+
+// Metadata returns what this instance knows about itself. Nothing is read
+// until the first call, after which a successful result is cached since it
+// never changes for the life of the instance. A failure, such as the
+// metadata service timing out at boot, is returned until it is retried,
+// less often the longer it keeps failing.
+func (sc *ServerControl) Metadata() (Metadata, error) {
+
+	sc.metaMu.Lock()
+	defer sc.metaMu.Unlock()
+
+	if sc.metaLoaded || time.Now().Before(sc.metaRetry) {
+		return sc.meta, sc.metaErr
+	}
+
+	sc.meta, sc.metaErr = sc.loadMetadata()
+	if sc.metaErr == nil || sc.config.NotOnEC2 {
+		sc.metaLoaded = true
+	} else {
+		sc.metaRetry = time.Now().Add(backoff(metadataReload, sc.metaFailures, metadataMaxReload))
+		sc.metaFailures++
+	}
+	return sc.meta, sc.metaErr
+}
+
+func (sc *ServerControl) loadMetadata() (Metadata, error) {
+
+	m := Metadata{
+		InstanceID: sc.config.InstanceID,
+		Region:     sc.config.Region,
+	}
+
+	if m.InstanceID != "" && m.Region != "" {
+		return m, nil
+	}
+
+	if sc.config.NotOnEC2 {
+		return m, ErrNotOnEC2
+	}
+
+	client := sc.metaClient
+
+	if m.InstanceID == "" {
+		id, err := client.get("meta-data/instance-id")
+		if err != nil {
+			sc.log.warn("failed to get instance id, assuming not on ec2", errField(err))
+			return m, ErrNotOnEC2
+		}
+		m.InstanceID = id
+	}
+
+	if m.Region == "" {
+		doc, err := client.get("dynamic/instance-identity/document")
+		if err != nil {
+			sc.log.warn("failed to get region, assuming not on ec2", errField(err))
+			return m, ErrNotOnEC2
+		}
+
+		identity := struct {
+			Region string `json:"region"`
+		}{}
+		if err := json.Unmarshal([]byte(doc), &identity); err != nil || identity.Region == "" {
+			sc.log.warn("unable to read region from instance identity document")
+			return m, ErrNotOnEC2
+		}
+		m.Region = identity.Region
+	}
+
+	var err error
+	if m.AvailabilityZone, err = client.get("meta-data/placement/availability-zone"); err != nil {
+		sc.log.warn("failed to get availability zone", errField(err))
+	}
+
+	if m.InstanceType, err = client.get("meta-data/instance-type"); err != nil {
+		sc.log.warn("failed to get instance type", errField(err))
+	}
+
+	if m.UserData, err = client.get("user-data"); err != nil && err != errMetadataNotFound {
+		sc.log.warn("failed to get user data from instance")
+	}
+
+	return m, nil
+}
+
+// metadataCredentials provides the instance profile's credentials through
+// metadataClient, the sdk's own ec2 role provider only speaks IMDSv1
+type metadataCredentials struct {
+	credentials.Expiry
+	client *metadataClient
+}
+
+func (p *metadataCredentials) Retrieve() (credentials.Value, error) {
+
+	roles, err := p.client.get("meta-data/iam/security-credentials/")
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	role := strings.TrimSpace(strings.Split(roles, "\n")[0])
+	if role == "" {
+		return credentials.Value{}, errors.New("no instance profile attached")
+	}
+
+	data, err := p.client.get("meta-data/iam/security-credentials/" + role)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	creds := struct {
+		Code            string
+		AccessKeyId     string
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}{}
+	if err := json.Unmarshal([]byte(data), &creds); err != nil {
+		return credentials.Value{}, err
+	}
+	if creds.Code != "Success" {
+		return credentials.Value{}, errors.New("instance profile credentials: " + creds.Code)
+	}
+
+	p.SetExpiration(creds.Expiration, 5*time.Minute)
+
+	return credentials.Value{
+		AccessKeyID:     creds.AccessKeyId,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.Token,
+		ProviderName:    "servercontrolMetadata",
+	}, nil
+}
+
+// instanceID is the best effort id of this instance for messages and logs
+func (sc *ServerControl) instanceID() string {
+	m, _ := sc.Metadata()
+	return m.InstanceID
+}
+
+// connect sets up the AWS clients the first time they are needed, trying
+// again on the next call when it fails
+func (sc *ServerControl) connect() error {
+
+	sc.connectMu.Lock()
+	defer sc.connectMu.Unlock()
+
+	if sc.sess != nil {
+		return nil
+	}
+
+	m, err := sc.Metadata()
+	if err != nil {
+		return err
+	}
+
+	providers := []credentials.Provider{
+		&credentials.EnvProvider{},
+		&credentials.SharedCredentialsProvider{},
+	}
+	if !sc.config.NotOnEC2 {
+		providers = append(providers, &metadataCredentials{client: sc.metaClient})
+	}
+
+	awsConfig := &aws.Config{
+		Region:      aws.String(m.Region),
+		Credentials: credentials.NewChainCredentials(providers),
+	}
+	if sc.config.AWSEndpoint != "" {
+		awsConfig.Endpoint = aws.String(sc.config.AWSEndpoint)
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return err
+	}
+
+	sc.asg = autoscaling.New(sess)
+	sc.ec2 = ec2.New(sess)
+	sc.sess = sess
+	return nil
+}
+
+func errorStatus(err error) int {
+	if err == ErrNotOnEC2 {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
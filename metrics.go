@@ -0,0 +1,261 @@
+package servercontrol
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricsRoute = "/metrics"
+
+var (
+	buildBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600}
+	peerBuckets  = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	phaseBuckets = []float64{0.1, 0.5, 1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800}
+)
+
+// metrics is a small registry written out in the Prometheus text
+// exposition format. Every ServerControl has its own.
+type metrics struct {
+	start time.Time
+
+	builds        *counterVec
+	buildDuration *histogramVec
+	restarts      *counterVec
+	peerRestarts  *counterVec
+	deploys       *counterVec
+	deployPhases  *histogramVec
+	peerRequests  *counterVec
+	peerLatency   *histogramVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		start: time.Now(),
+
+		builds: newCounterVec("servercontrol_builds_total",
+			"Builds by outcome, cached when the binary already existed, refused when the commit is not signed.", "outcome"),
+		buildDuration: newHistogramVec("servercontrol_build_duration_seconds",
+			"Time taken to pull and compile a version.", buildBuckets, "outcome"),
+		restarts: newCounterVec("servercontrol_restarts_total",
+			"Restarts of this server by the endpoint that triggered them.", "reason"),
+		peerRestarts: newCounterVec("servercontrol_peer_restarts_total",
+			"Peers asked to restart during a deploy, by outcome.", "outcome"),
+		deploys: newCounterVec("servercontrol_deploys_total",
+			"Fleet deploys coordinated by this server, by outcome.", "outcome"),
+		deployPhases: newHistogramVec("servercontrol_deploy_phase_duration_seconds",
+			"Time spent in each phase of a fleet deploy.", phaseBuckets, "phase", "outcome"),
+		peerRequests: newCounterVec("servercontrol_peer_requests_total",
+			"Requests made to peers by service and response code, error when none came back.", "service", "code"),
+		peerLatency: newHistogramVec("servercontrol_peer_request_duration_seconds",
+			"Latency of requests made to peers.", peerBuckets, "service"),
+	}
+}
+
+// phase records how long a deploy phase took since start
+func (m *metrics) phase(name string, start time.Time, err error) {
+	m.deployPhases.observe(time.Since(start).Seconds(), name, outcome(err))
+}
+
+// peerRequest records a call to a peer made through apiRequest
+func (m *metrics) peerRequest(service string, start time.Time, resp *http.Response, err error) {
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	m.peerRequests.inc(service, code)
+	m.peerLatency.observe(time.Since(start).Seconds(), service)
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "failed"
+	}
+	return "ok"
+}
+
+func (m *metrics) write(buf *bytes.Buffer, sv ServerVersion) {
+
+	fmt.Fprintln(buf, "# HELP servercontrol_version_info Version this server is running.")
+	fmt.Fprintln(buf, "# TYPE servercontrol_version_info gauge")
+	fmt.Fprintf(buf, "servercontrol_version_info%s 1\n",
+		labelString([]string{"git_commit_hash", "hostname"}, []string{sv.GitCommitHash, sv.Hostname}))
+
+	fmt.Fprintln(buf, "# HELP servercontrol_start_time_seconds Unix time this server started.")
+	fmt.Fprintln(buf, "# TYPE servercontrol_start_time_seconds gauge")
+	fmt.Fprintf(buf, "servercontrol_start_time_seconds %s\n", formatFloat(float64(m.start.UnixNano())/1e9))
+
+	fmt.Fprintln(buf, "# HELP servercontrol_uptime_seconds Seconds since this server started.")
+	fmt.Fprintln(buf, "# TYPE servercontrol_uptime_seconds gauge")
+	fmt.Fprintf(buf, "servercontrol_uptime_seconds %s\n", formatFloat(time.Since(m.start).Seconds()))
+
+	m.builds.write(buf)
+	m.buildDuration.write(buf)
+	m.restarts.write(buf)
+	m.peerRestarts.write(buf)
+	m.deploys.write(buf)
+	m.deployPhases.write(buf)
+	m.peerRequests.write(buf)
+	m.peerLatency.write(buf)
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.mu.Lock()
+	c.values[labelString(c.labels, values)]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(buf *bytes.Buffer) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(buf, "# TYPE %s counter\n", c.name)
+	for _, labels := range sortedKeys(c.values) {
+		fmt.Fprintf(buf, "%s%s %s\n", c.name, labels, formatFloat(c.values[labels]))
+	}
+}
+
+type histogram struct {
+	values []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := labelString(h.labels, values)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) write(buf *bytes.Buffer) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(buf, "# TYPE %s histogram\n", h.name)
+
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	bucketLabels := append(append([]string{}, h.labels...), "le")
+	for _, k := range keys {
+		s := h.series[k]
+		for i, le := range h.buckets {
+			values := append(append([]string{}, s.values...), formatFloat(le))
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, labelString(bucketLabels, values), s.counts[i])
+		}
+		values := append(append([]string{}, s.values...), "+Inf")
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, labelString(bucketLabels, values), s.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", h.name, k, formatFloat(s.sum))
+		fmt.Fprintf(buf, "%s_count%s %d\n", h.name, k, s.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelString renders {name="value",...}, or nothing without labels
+func labelString(names, values []string) string {
+
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = name + `="` + labelEscaper.Replace(v) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metricsCaller lets a scraper read /metrics without a token of its own
+// when PublicMetrics or MetricsBearerToken allow it
+func (sc *ServerControl) metricsCaller(r *http.Request) (Caller, bool) {
+	return bearerCaller(r, "metrics", sc.config.PublicMetrics, sc.config.MetricsBearerToken)
+}
+
+// serveMetrics exposes the metrics in the Prometheus text format
+func (sc *ServerControl) serveMetrics(res http.ResponseWriter, req *http.Request) {
+
+	buf := &bytes.Buffer{}
+	sc.metrics.write(buf, sc.sv)
+
+	res.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate")
+	res.Header().Add("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	res.Write(buf.Bytes())
+}
@@ -0,0 +1,174 @@
+package servercontrol
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DeployPlan is what update_service would do for a hash, worked out from
+// the same reads a deployment makes without changing anything.
+type DeployPlan struct {
+	Hash           string       `json:"hash"`
+	Ref            string       `json:"ref,omitempty"`
+	Coordinator    string       `json:"coordinator"`
+	AutoScaleGroup string       `json:"auto_scale_group"`
+	Builds         []PlanTarget `json:"builds"`
+	Restarts       []PlanTarget `json:"restarts"`
+
+	CurrentLaunchConfiguration string `json:"current_launch_configuration"`
+	NewLaunchConfiguration     string `json:"new_launch_configuration"`
+	UserDataDiff               string `json:"user_data_diff"`
+
+	Changelog    *Changelog    `json:"changelog,omitempty"`
+	Verification *Verification `json:"verification,omitempty"`
+	LockHolder   *LockHolder   `json:"lock_holder,omitempty"`
+	Warnings     []string      `json:"warnings,omitempty"`
+}
+
+// PlanTarget is one instance in the plan. Builds all run at once,
+// restarts run in order, the coordinator last.
+type PlanTarget struct {
+	Order       int    `json:"order"`
+	InstanceID  string `json:"instance_id"`
+	PrivateIP   string `json:"private_ip"`
+	CurrentHash string `json:"current_hash"`
+	TargetHash  string `json:"target_hash"`
+}
+
+func wantsPlan(req *http.Request, props defaultProps) bool {
+	return props.Plan || req.URL.Query().Get("plan") == "true"
+}
+
+func (sc *ServerControl) plan(hash string) (*DeployPlan, error) {
+
+	data, err := sc.getServiceData()
+	if err != nil {
+		return nil, err
+	}
+
+	lc := data.AutoScaleGroup.LaunchConfiguration
+	newName := nextLaunchConfigName(lc.Name)
+	p := &DeployPlan{
+		Hash:           hash,
+		Coordinator:    data.InstanceID,
+		AutoScaleGroup: data.AutoScaleGroup.Name,
+		Builds:         []PlanTarget{},
+		Restarts:       []PlanTarget{},
+
+		CurrentLaunchConfiguration: lc.Name,
+		NewLaunchConfiguration:     newName,
+		UserDataDiff:               userDataDiff(lc.Name, newName, lc.UserData, string(sc.setUserDataHash([]byte(lc.UserData), hash))),
+	}
+
+	p.addTargets(data.InstanceList)
+
+	if !strings.Contains(lc.UserData, "GO_GIT_HASH") {
+		p.Warnings = append(p.Warnings, "launch configuration user data has no GO_GIT_HASH line, new instances would not get "+hash)
+	}
+
+	if p.Changelog, err = sc.changelog(fleetHashes(data), hash); err != nil {
+		p.Warnings = append(p.Warnings, "unable to build changelog: "+err.Error())
+	}
+
+	if p.Verification, err = sc.verifyCommit(hash); err != nil {
+		p.Warnings = append(p.Warnings, err.Error()+", the deployment would be refused")
+	}
+
+	if status := sc.frozen(time.Now()); status.Frozen {
+		p.Warnings = append(p.Warnings, fmt.Sprintf("deploys are frozen by %s until %s, the deployment would be refused without override_freeze",
+			status.Name, status.Until))
+	}
+
+	if p.LockHolder, err = sc.lock.Holder(); err != nil {
+		p.Warnings = append(p.Warnings, "unable to read deploy lock: "+err.Error())
+	} else if p.LockHolder != nil {
+		p.Warnings = append(p.Warnings, p.LockHolder.describe()+" holds the deploy lock, the deployment would be refused")
+	}
+
+	return p, nil
+}
+
+// addTargets plans building on every instance at once, then restarting
+// them one at a time, the coordinator last
+func (p *DeployPlan) addTargets(instances []Instance) {
+
+	var coordinator *PlanTarget
+	for _, instance := range instances {
+		t := PlanTarget{
+			Order:       1,
+			InstanceID:  instance.InstanceID,
+			PrivateIP:   instance.PrivateIP,
+			CurrentHash: instance.GitCommitHash,
+			TargetHash:  p.Hash,
+		}
+		p.Builds = append(p.Builds, t)
+
+		if instance.GitCommitHash == "" {
+			p.Warnings = append(p.Warnings, fmt.Sprintf("%s did not report its version", instance.InstanceID))
+		} else if instance.GitCommitHash == p.Hash {
+			p.Warnings = append(p.Warnings, fmt.Sprintf("%s already runs %s", instance.InstanceID, p.Hash))
+		}
+
+		if instance.InstanceID == p.Coordinator {
+			coordinator = &t
+			continue
+		}
+		t.Order = len(p.Restarts) + 1
+		p.Restarts = append(p.Restarts, t)
+	}
+
+	if coordinator != nil {
+		coordinator.Order = len(p.Restarts) + 1
+		p.Restarts = append(p.Restarts, *coordinator)
+	} else {
+		p.Warnings = append(p.Warnings, fmt.Sprintf("coordinator %s is not in the autoscale group", p.Coordinator))
+	}
+}
+
+// userDataDiff compares user data line by line, the way updateAutoscaleGroup
+// rewrites it, in unified diff style
+func userDataDiff(oldName, newName, before, after string) string {
+
+	a := strings.Split(strings.TrimSuffix(before, "\n"), "\n")
+	b := strings.Split(strings.TrimSuffix(after, "\n"), "\n")
+
+	diff := &strings.Builder{}
+	fmt.Fprintf(diff, "--- %s\n+++ %s\n", oldName, newName)
+	for i := 0; i < len(a) || i < len(b); i++ {
+		switch {
+		case i >= len(a):
+			fmt.Fprintf(diff, "+%s\n", b[i])
+		case i >= len(b):
+			fmt.Fprintf(diff, "-%s\n", a[i])
+		case a[i] != b[i]:
+			fmt.Fprintf(diff, "-%s\n+%s\n", a[i], b[i])
+		default:
+			fmt.Fprintf(diff, " %s\n", a[i])
+		}
+	}
+	return diff.String()
+}
+
+// servePlan answers update_service with plan=true
+func (sc *ServerControl) servePlan(res http.ResponseWriter, props defaultProps) {
+
+	res.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate")
+	res.Header().Add("Content-Type", "application/json")
+
+	p, err := sc.plan(props.Hash)
+	if err != nil {
+		res.WriteHeader(errorStatus(err))
+		fmt.Fprintf(res, "%s", err.Error())
+		return
+	}
+	p.Ref = props.Ref
+
+	if j, err := ToJsonString(p); err == nil {
+		fmt.Fprint(res, j)
+	} else {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+	}
+}
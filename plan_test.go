@@ -0,0 +1,124 @@
+package servercontrol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanTargets(t *testing.T) {
+
+	instances := []Instance{
+		{InstanceID: "i-1", GitCommitHash: "old"},
+		{InstanceID: "i-2", GitCommitHash: "old"},
+		{InstanceID: "i-3", GitCommitHash: "new"},
+		{InstanceID: "i-4"},
+	}
+	ids := func(targets []PlanTarget) []string {
+		ids := []string{}
+		for _, t := range targets {
+			ids = append(ids, t.InstanceID)
+		}
+		return ids
+	}
+
+	tests := []struct {
+		name        string
+		coordinator string
+		restarts    []string
+		warnings    int
+	}{
+		{"coordinator first", "i-1", []string{"i-2", "i-3", "i-4", "i-1"}, 2},
+		{"coordinator in the middle", "i-2", []string{"i-1", "i-3", "i-4", "i-2"}, 2},
+		{"coordinator last", "i-4", []string{"i-1", "i-2", "i-3", "i-4"}, 2},
+		{"coordinator elsewhere", "i-9", []string{"i-1", "i-2", "i-3", "i-4"}, 3},
+	}
+
+	for _, tt := range tests {
+		p := &DeployPlan{Hash: "new", Coordinator: tt.coordinator}
+		p.addTargets(instances)
+
+		// every instance builds at once, then restarts one at a time
+		if got := ids(p.Builds); !reflect.DeepEqual(got, []string{"i-1", "i-2", "i-3", "i-4"}) {
+			t.Errorf("%s: builds %v", tt.name, got)
+		}
+		for _, b := range p.Builds {
+			if b.Order != 1 || b.TargetHash != "new" {
+				t.Errorf("%s: build %+v", tt.name, b)
+			}
+		}
+		for i, r := range p.Restarts {
+			if r.Order != i+1 {
+				t.Errorf("%s: restart %d has order %d", tt.name, i, r.Order)
+			}
+		}
+		if got := ids(p.Restarts); !reflect.DeepEqual(got, tt.restarts) {
+			t.Errorf("%s: restarts %v, want %v", tt.name, got, tt.restarts)
+		}
+		if len(p.Warnings) != tt.warnings {
+			t.Errorf("%s: warnings %q, want %d", tt.name, p.Warnings, tt.warnings)
+		}
+	}
+}
+
+func TestUserDataDiff(t *testing.T) {
+
+	tests := []struct {
+		name          string
+		before, after string
+		want          string
+	}{
+		{"unchanged", "a\nb\n", "a\nb\n", "--- lc-1\n+++ lc-2\n a\n b\n"},
+		{"changed line", "a\nGO_GIT_HASH=1\nb\n", "a\nGO_GIT_HASH=2\nb\n",
+			"--- lc-1\n+++ lc-2\n a\n-GO_GIT_HASH=1\n+GO_GIT_HASH=2\n b\n"},
+		{"added line", "a\n", "a\nb\n", "--- lc-1\n+++ lc-2\n a\n+b\n"},
+		{"removed line", "a\nb\n", "a\n", "--- lc-1\n+++ lc-2\n a\n-b\n"},
+		{"no trailing newline", "a\nb", "a\nb\n", "--- lc-1\n+++ lc-2\n a\n b\n"},
+	}
+
+	for _, tt := range tests {
+		if got := userDataDiff("lc-1", "lc-2", tt.before, tt.after); got != tt.want {
+			t.Errorf("%s: userDataDiff =\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSetUserDataHash(t *testing.T) {
+
+	sc := &ServerControl{log: newFieldLogger(ServerControlConfig{})}
+
+	tests := []struct {
+		name     string
+		userData string
+		want     string
+	}{
+		{"replaced", "GO_PROJECT=app\nGO_GIT_HASH=old\n", "GO_PROJECT=app\nGO_GIT_HASH=new\n"},
+		{"whole line replaced", "export GO_GIT_HASH=old # pinned\n", "GO_GIT_HASH=new\n"},
+		{"no hash line", "GO_PROJECT=app\n", "GO_PROJECT=app\n"},
+		{"no trailing newline", "GO_GIT_HASH=old", "GO_GIT_HASH=new\n"},
+		{"empty", "", ""},
+	}
+
+	for _, tt := range tests {
+		if got := string(sc.setUserDataHash([]byte(tt.userData), "new")); got != tt.want {
+			t.Errorf("%s: setUserDataHash = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNextLaunchConfigName(t *testing.T) {
+
+	tests := map[string]string{
+		"app-lc-7":  "app-lc-8",
+		"app-lc-9":  "app-lc-10",
+		"app-2-3":   "app-2-4",
+		"app-lc":    "app-lc-1",
+		"app":       "app-1",
+		"app-lc-01": "app-lc-2",
+	}
+
+	for name, want := range tests {
+		if got := nextLaunchConfigName(name); got != want {
+			t.Errorf("nextLaunchConfigName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package servercontrol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const defaultBranch = "master"
+
+var (
+	errUnknownRef = errors.New("no such branch or tag")
+
+	fullHash = regexp.MustCompile(`^[0-9a-f]{40}$`)
+)
+
+// remoteRefs lists the refs of remote with the commit each points at,
+// annotated tags peeled to their commit
+func remoteRefs(remote string, patterns ...string) (map[string]string, error) {
+
+	args := append([]string{"ls-remote", remote}, patterns...)
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		if exiterr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("git ls-remote: %v\n%s", err, exiterr.Stderr)
+		}
+		return nil, err
+	}
+
+	refs := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		hash, name := fields[0], fields[1]
+		if strings.HasSuffix(name, "^{}") {
+			refs[strings.TrimSuffix(name, "^{}")] = hash
+		} else if _, peeled := refs[name]; !peeled {
+			refs[name] = hash
+		}
+	}
+	return refs, scanner.Err()
+}
+
+// branchHead is the commit at the tip of branch on remote
+func branchHead(remote, branch string) (string, error) {
+
+	refs, err := remoteRefs(remote, "refs/heads/"+branch)
+	if err != nil {
+		return "", err
+	}
+	return refs["refs/heads/"+branch], nil
+}
+
+// resolveRef turns a full hash, a branch, a tag or a semver constraint over
+// the tags into the commit it names on the fleet's remote. A tag wins over
+// a branch of the same name, as it does for git rev-parse.
+func (sc *ServerControl) resolveRef(ref string) (string, error) {
+
+	if fullHash.MatchString(ref) {
+		return ref, nil
+	}
+
+	refs, err := remoteRefs(sc.config.RepoUrl)
+	if err != nil {
+		return "", err
+	}
+
+	for _, name := range []string{ref, "refs/tags/" + ref, "refs/heads/" + ref} {
+		if hash, ok := refs[name]; ok && strings.HasPrefix(name, "refs/") {
+			return hash, nil
+		}
+	}
+
+	c, err := parseConstraint(ref)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", ref, errUnknownRef)
+	}
+
+	var best *semver
+	hash := ""
+	for name, h := range refs {
+		if !strings.HasPrefix(name, "refs/tags/") {
+			continue
+		}
+		v, ok := parseSemver(strings.TrimPrefix(name, "refs/tags/"))
+		if !ok || v.pre != "" || !c.matches(v) {
+			continue
+		}
+		if best == nil || best.less(v) {
+			best, hash = &v, h
+		}
+	}
+	if best == nil {
+		return "", fmt.Errorf("no tag satisfies %s: %w", ref, errUnknownRef)
+	}
+	return hash, nil
+}
+
+// resolveProps fills in props.Hash from props.Ref, answering the request
+// itself when it can't
+func (sc *ServerControl) resolveProps(res http.ResponseWriter, props *defaultProps) bool {
+
+	if props.Ref == "" {
+		if props.Hash == "" {
+			res.WriteHeader(http.StatusBadRequest)
+			return false
+		}
+		return true
+	}
+
+	hash, err := sc.resolveRef(props.Ref)
+	if err != nil {
+		sc.log.warn("unable to resolve ref", field("ref", props.Ref), errField(err))
+		if errors.Is(err, errUnknownRef) {
+			res.WriteHeader(http.StatusBadRequest)
+		} else {
+			res.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(res, "unable to resolve %s\n%s", props.Ref, err.Error())
+		return false
+	}
+
+	if props.Hash != "" && props.Hash != hash {
+		res.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(res, "%s is at %s, not %s", props.Ref, hash, props.Hash)
+		return false
+	}
+
+	sc.log.info("resolved ref", field("ref", props.Ref), field(FieldHash, hash))
+	props.Hash = hash
+	return true
+}
+
+type semver struct {
+	major, minor, patch int
+	pre                 string
+}
+
+// parseSemver reads a tag like v1.4.2 or 1.4.2-rc.1
+func parseSemver(s string) (semver, bool) {
+
+	v := semver{}
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		if s[i] == '-' {
+			v.pre = s[i+1:]
+			if j := strings.IndexByte(v.pre, '+'); j >= 0 {
+				v.pre = v.pre[:j]
+			}
+		}
+		s = s[:i]
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return v, false
+	}
+	nums := make([]int, 3)
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		nums[i] = n
+	}
+	v.major, v.minor, v.patch = nums[0], nums[1], nums[2]
+	return v, true
+}
+
+func (v semver) compare(o semver) int {
+
+	switch {
+	case v.major != o.major:
+		return v.major - o.major
+	case v.minor != o.minor:
+		return v.minor - o.minor
+	default:
+		return v.patch - o.patch
+	}
+}
+
+func (v semver) less(o semver) bool {
+	return v.compare(o) < 0
+}
+
+// comparator is one bound of a constraint, op being one of = > >= < <=
+type comparator struct {
+	op string
+	v  semver
+}
+
+type constraint []comparator
+
+// parseConstraint reads ^1.4, ~1.4.2, 1.x, or comparisons like
+// ">=1.2, <2" that must all hold. A bare version is never a constraint, it
+// has to name a tag exactly.
+func parseConstraint(s string) (constraint, error) {
+
+	c := constraint{}
+	for _, term := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+
+		op := ""
+		for _, o := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+			if strings.HasPrefix(term, o) {
+				op = o
+				break
+			}
+		}
+		version := strings.TrimPrefix(strings.TrimPrefix(term, op), "v")
+
+		parts := strings.Split(version, ".")
+		wild := len(parts)
+		for i, p := range parts {
+			if p == "x" || p == "X" || p == "*" {
+				wild = i
+				break
+			}
+		}
+		if op == "" && wild == len(parts) {
+			return nil, fmt.Errorf("%q is not a constraint", term)
+		}
+		if wild < len(parts) && op != "" {
+			return nil, fmt.Errorf("%q mixes an operator and a wildcard", term)
+		}
+		if len(parts) > 3 || wild == 0 {
+			return nil, fmt.Errorf("%q is not a constraint", term)
+		}
+
+		nums := []int{0, 0, 0}
+		given := 0
+		for i := 0; i < wild; i++ {
+			n, err := strconv.Atoi(parts[i])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%q is not a constraint", term)
+			}
+			nums[i] = n
+			given++
+		}
+		low := semver{major: nums[0], minor: nums[1], patch: nums[2]}
+
+		switch op {
+		case "", "~":
+			// 1.x and ~1 cover the major, 1.4.x and ~1.4 or ~1.4.2 the minor
+			c = append(c, comparator{">=", low}, comparator{"<", bump(low, given)})
+		case "^":
+			c = append(c, comparator{">=", low}, comparator{"<", caret(low, given)})
+		default:
+			c = append(c, comparator{op, low})
+		}
+	}
+
+	if len(c) == 0 {
+		return nil, errors.New("empty constraint")
+	}
+	return c, nil
+}
+
+// bump is the first version past what a wildcard or tilde range covers,
+// the next major when only the major was given, otherwise the next minor
+func bump(v semver, given int) semver {
+
+	if given == 1 {
+		return semver{major: v.major + 1}
+	}
+	return semver{major: v.major, minor: v.minor + 1}
+}
+
+// caret keeps the left-most non-zero part of v
+func caret(v semver, given int) semver {
+
+	switch {
+	case v.major > 0 || given == 1:
+		return semver{major: v.major + 1}
+	case v.minor > 0 || given == 2:
+		return semver{minor: v.minor + 1}
+	default:
+		return semver{patch: v.patch + 1}
+	}
+}
+
+func (c constraint) matches(v semver) bool {
+
+	for _, b := range c {
+		cmp := v.compare(b.v)
+		var ok bool
+		switch b.op {
+		case "=":
+			ok = cmp == 0
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+package servercontrol
+
+import "testing"
+
+func TestParseSemver(t *testing.T) {
+
+	tests := []struct {
+		tag  string
+		want semver
+		ok   bool
+	}{
+		{"1.4.2", semver{major: 1, minor: 4, patch: 2}, true},
+		{"v1.4.2", semver{major: 1, minor: 4, patch: 2}, true},
+		{"v0.0.0", semver{}, true},
+		{"1.4.2-rc.1", semver{major: 1, minor: 4, patch: 2, pre: "rc.1"}, true},
+		{"1.4.2+build.7", semver{major: 1, minor: 4, patch: 2}, true},
+		{"1.4.2-rc.1+build.7", semver{major: 1, minor: 4, patch: 2, pre: "rc.1"}, true},
+		{"1.4", semver{}, false},
+		{"1.4.2.1", semver{}, false},
+		{"1.a.2", semver{}, false},
+		{"1.-4.2", semver{}, false},
+		{"release", semver{}, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseSemver(tt.tag)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("parseSemver(%q) = %+v, %v, want %+v, %v", tt.tag, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestConstraintMatches(t *testing.T) {
+
+	tests := []struct {
+		constraint string
+		match      []string
+		miss       []string
+	}{
+		// caret keeps the left-most non-zero part
+		{"^1.4", []string{"1.4.0", "1.9.9"}, []string{"1.3.9", "2.0.0"}},
+		{"^1", []string{"1.0.0", "1.9.9"}, []string{"0.9.9", "2.0.0"}},
+		{"^0.2", []string{"0.2.0", "0.2.9"}, []string{"0.1.9", "0.3.0", "1.2.0"}},
+		{"^0.2.3", []string{"0.2.3", "0.2.9"}, []string{"0.2.2", "0.3.0"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.2", "0.0.4", "0.1.3"}},
+		{"^0.0", []string{"0.0.0", "0.0.9"}, []string{"0.1.0"}},
+		{"^0", []string{"0.0.0", "0.9.9"}, []string{"1.0.0"}},
+
+		// tilde covers the major when only it is given, the minor otherwise
+		{"~1", []string{"1.0.0", "1.9.9"}, []string{"0.9.9", "2.0.0"}},
+		{"~1.4", []string{"1.4.0", "1.4.9"}, []string{"1.3.9", "1.5.0"}},
+		{"~1.4.2", []string{"1.4.2", "1.4.9"}, []string{"1.4.1", "1.5.0"}},
+		{"~0", []string{"0.0.0", "0.9.9"}, []string{"1.0.0"}},
+
+		// wildcards
+		{"1.x", []string{"1.0.0", "1.9.9"}, []string{"0.9.9", "2.0.0"}},
+		{"1.4.x", []string{"1.4.0", "1.4.9"}, []string{"1.3.9", "1.5.0"}},
+		{"1.4.*", []string{"1.4.0"}, []string{"1.5.0"}},
+		{"v2.X", []string{"2.1.0"}, []string{"3.0.0"}},
+
+		// comparisons that must all hold, comma or space separated
+		{">=1.2, <2", []string{"1.2.0", "1.9.9"}, []string{"1.1.9", "2.0.0"}},
+		{">=1.2,<2", []string{"1.2.0", "1.9.9"}, []string{"1.1.9", "2.0.0"}},
+		{">1.2.3 <=1.4", []string{"1.2.4", "1.4.0"}, []string{"1.2.3", "1.4.1"}},
+		{"=1.2.3", []string{"1.2.3"}, []string{"1.2.4"}},
+		{"^1.2, <1.5", []string{"1.2.0", "1.4.9"}, []string{"1.5.0", "2.0.0"}},
+		{">=2, <1", nil, []string{"1.0.0", "2.0.0"}},
+	}
+
+	for _, tt := range tests {
+		c, err := parseConstraint(tt.constraint)
+		if err != nil {
+			t.Errorf("parseConstraint(%q): %v", tt.constraint, err)
+			continue
+		}
+		for _, v := range tt.match {
+			if sv, _ := parseSemver(v); !c.matches(sv) {
+				t.Errorf("%q does not match %s", tt.constraint, v)
+			}
+		}
+		for _, v := range tt.miss {
+			if sv, _ := parseSemver(v); c.matches(sv) {
+				t.Errorf("%q matches %s", tt.constraint, v)
+			}
+		}
+	}
+}
+
+func TestParseConstraintRejects(t *testing.T) {
+
+	for _, s := range []string{
+		"",
+		" , ",
+		"1.2.3", // a bare version names a tag, it isn't a range
+		"1.2",
+		"^1.x",
+		">=1.x",
+		"x",
+		"*",
+		"1.2.3.4",
+		"^a",
+		">=1.2, 2",
+		"^-1",
+	} {
+		if c, err := parseConstraint(s); err == nil {
+			t.Errorf("parseConstraint(%q) = %v, want an error", s, c)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package servercontrol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// scheduleGrace is how late a scheduled deploy may still start, as
+	// when the process was restarting at the time
+	scheduleGrace = 10 * time.Minute
+
+	// scheduleResumeDelay gives a restarted process time to start serving
+	// before it starts a deploy it missed
+	scheduleResumeDelay = 10 * time.Second
+)
+
+var errNoSchedules = errors.New("scheduled deploys not enabled")
+
+// ScheduledDeploy is an update_service run waiting for its time. Ref is
+// resolved when it starts, not when it was scheduled.
+type ScheduledDeploy struct {
+	ID             string `json:"id"`
+	Hash           string `json:"hash,omitempty"`
+	Ref            string `json:"ref,omitempty"`
+	At             string `json:"at"`
+	Caller         string `json:"caller"`
+	Created        string `json:"created"`
+	OverrideFreeze bool   `json:"override_freeze,omitempty"`
+}
+
+// scheduleStore keeps the pending scheduled deploys in a JSON file so they
+// survive the restarts deployments make
+type scheduleStore struct {
+	mu      sync.Mutex
+	path    string
+	pending map[string]ScheduledDeploy
+	timers  map[string]*time.Timer
+}
+
+func openSchedules(path string) (*scheduleStore, error) {
+
+	s := &scheduleStore{path: path, pending: map[string]ScheduledDeploy{}, timers: map[string]*time.Timer{}}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	list := []ScheduledDeploy{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, d := range list {
+		s.pending[d.ID] = d
+	}
+	return s, nil
+}
+
+// save rewrites the file, the caller holds mu
+func (s *scheduleStore) save() error {
+
+	data, err := json.Marshal(s.sorted())
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// sorted lists the pending deploys soonest first, the caller holds mu
+func (s *scheduleStore) sorted() []ScheduledDeploy {
+
+	list := make([]ScheduledDeploy, 0, len(s.pending))
+	for _, d := range s.pending {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].At < list[j].At })
+	return list
+}
+
+func (s *scheduleStore) list() []ScheduledDeploy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sorted()
+}
+
+func (s *scheduleStore) add(d ScheduledDeploy, fire func()) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending[d.ID] = d
+	if err := s.save(); err != nil {
+		delete(s.pending, d.ID)
+		return err
+	}
+	s.arm(d, 0, fire)
+	return nil
+}
+
+// arm starts the timer for d, going off no sooner than min from now. The
+// caller holds mu.
+func (s *scheduleStore) arm(d ScheduledDeploy, min time.Duration, fire func()) {
+
+	at, _ := time.Parse(time.RFC3339, d.At)
+	delay := time.Until(at)
+	if delay < min {
+		delay = min
+	}
+	s.timers[d.ID] = time.AfterFunc(delay, fire)
+}
+
+// take removes the deploy with id, whether it is starting or cancelled,
+// so only one of the two happens
+func (s *scheduleStore) take(id string) (ScheduledDeploy, bool, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.pending[id]
+	if !ok {
+		return d, false, nil
+	}
+	if t, ok := s.timers[id]; ok {
+		t.Stop()
+		delete(s.timers, id)
+	}
+	delete(s.pending, id)
+	return d, true, s.save()
+}
+
+// armSchedules starts the timers of the deploys scheduled before this
+// process started, dropping those that are too late
+func (sc *ServerControl) armSchedules() {
+
+	if sc.schedules == nil {
+		return
+	}
+
+	for _, d := range sc.schedules.list() {
+		log := sc.log.with(field("schedule", d.ID), field(FieldHash, d.Hash), field("ref", d.Ref))
+		at, err := time.Parse(time.RFC3339, d.At)
+		if err != nil || time.Since(at) > scheduleGrace {
+			log.error("dropping scheduled deploy, missed its time", field("at", d.At))
+			sc.schedules.take(d.ID)
+			continue
+		}
+		id := d.ID
+		sc.schedules.mu.Lock()
+		sc.schedules.arm(d, scheduleResumeDelay, func() { sc.startScheduled(id) })
+		sc.schedules.mu.Unlock()
+	}
+}
+
+// startScheduled runs update_service as whoever scheduled the deploy
+func (sc *ServerControl) startScheduled(id string) {
+
+	d, ok, err := sc.schedules.take(id)
+	log := sc.log.with(field("schedule", id), field(FieldHash, d.Hash), field("ref", d.Ref))
+	if err != nil {
+		log.error("unable to save scheduled deploys", errField(err))
+	}
+	if !ok {
+		return
+	}
+
+	log.info("starting scheduled deploy", field("caller", d.Caller))
+
+	caller := Caller{Name: d.Caller, Scopes: []Scope{ScopeDeployFleet}}
+	if d.OverrideFreeze {
+		caller.Scopes = append(caller.Scopes, ScopeOverrideFreeze)
+	}
+	r, err := sc.internalRequest("/update_service", sc.audited("update_service", sc.updateService),
+		caller, defaultProps{Hash: d.Hash, Ref: d.Ref, OverrideFreeze: d.OverrideFreeze})
+	if err != nil {
+		log.error("unable to start scheduled deploy", errField(err))
+	} else if r.status >= 400 {
+		log.error("scheduled deploy failed", field("status", r.status), field("response", strings.TrimSpace(r.body.String())))
+	}
+}
+
+// scheduleDeploy schedules an update_service run of hash or ref at a time
+// given in RFC 3339. It is refused if that falls in a freeze, unless it
+// overrides the freeze.
+func (sc *ServerControl) scheduleDeploy(res http.ResponseWriter, req *http.Request) {
+
+	if sc.schedules == nil {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(res, errNoSchedules.Error())
+		return
+	}
+
+	props := struct {
+		defaultProps
+		At string `json:"at"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&props); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "%s", err.Error())
+		return
+	}
+
+	at, err := time.Parse(time.RFC3339, props.At)
+	if err != nil || !at.After(time.Now()) {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "at needs to be a time in the future, in RFC 3339")
+		return
+	}
+
+	// resolving now catches refs that don't exist, the ref is resolved
+	// again when the deploy starts
+	resolved := props.defaultProps
+	if !sc.resolveProps(res, &resolved) {
+		return
+	}
+
+	log := sc.requestLog(resolved)
+	if props.OverrideFreeze {
+		if c, _ := CallerFromContext(req.Context()); !c.Allowed(ScopeOverrideFreeze) {
+			res.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(res, "override_freeze needs the %s scope", ScopeOverrideFreeze)
+			return
+		}
+	} else if status := sc.frozen(at); status.Frozen {
+		res.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(res, "%s falls in freeze %s, which lasts until %s", props.At, status.Name, status.Until)
+		return
+	}
+
+	d := ScheduledDeploy{
+		ID:             newDeploymentID(),
+		Hash:           props.Hash,
+		Ref:            props.Ref,
+		At:             at.UTC().Format(time.RFC3339),
+		Caller:         callerName(req),
+		Created:        timestamp(),
+		OverrideFreeze: props.OverrideFreeze,
+	}
+	if err := sc.schedules.add(d, func() { sc.startScheduled(d.ID) }); err != nil {
+		log.error("unable to save scheduled deploys", errField(err))
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+		return
+	}
+	log.info("deploy scheduled", field("schedule", d.ID), field("at", d.At), field("caller", d.Caller))
+
+	if j, err := ToJsonString(d); err == nil {
+		fmt.Fprint(res, j)
+	} else {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+	}
+}
+
+// scheduledDeploys serves the deploys waiting to start, soonest first
+func (sc *ServerControl) scheduledDeploys(res http.ResponseWriter, req *http.Request) {
+
+	res.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate")
+	res.Header().Add("Content-Type", "application/json")
+
+	if sc.schedules == nil {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(res, errNoSchedules.Error())
+		return
+	}
+
+	if j, err := ToJsonString(sc.schedules.list()); err == nil {
+		fmt.Fprint(res, j)
+	} else {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%s", err.Error())
+	}
+}
+
+// cancelScheduledDeploy drops the scheduled deploy with the given id
+// before it starts
+func (sc *ServerControl) cancelScheduledDeploy(res http.ResponseWriter, req *http.Request) {
+
+	if sc.schedules == nil {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(res, errNoSchedules.Error())
+		return
+	}
+
+	props := struct {
+		ID string `json:"id"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&props); err != nil || props.ID == "" {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(res, "id of the scheduled deploy needed")
+		return
+	}
+
+	d, ok, err := sc.schedules.take(props.ID)
+	if err != nil {
+		sc.log.error("unable to save scheduled deploys", errField(err))
+	}
+	if !ok {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "no scheduled deploy %s, it may have started already", props.ID)
+		return
+	}
+
+	target := d.Ref
+	if target == "" {
+		target = d.Hash
+	}
+	sc.log.info("scheduled deploy cancelled", field("schedule", d.ID), field("caller", callerName(req)),
+		field("scheduled_by", d.Caller))
+	fmt.Fprintf(res, "cancelled deploy of %s scheduled by %s for %s", target, d.Caller, d.At)
+}
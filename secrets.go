@@ -0,0 +1,150 @@
+package servercontrol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often SecretsFile is checked for changes
+const secretsCheckInterval = time.Second
+
+// secretStore holds the shared secrets currently accepted, newest first.
+// They come from SecretsFile, one per line, or SERVERCONTROL_SECRETS,
+// comma separated, followed by Secret. The file is re-read whenever it
+// changes so a new secret can be rolled out without restarting anything.
+// With a file, Secret is only used until the file exists, after that the
+// file alone decides and can retire it.
+type secretStore struct {
+	file     string
+	static   []string
+	fallback bool
+	log      *fieldLogger
+
+	mu      sync.Mutex
+	secrets []string
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+func newSecretStore(config ServerControlConfig, log *fieldLogger) (*secretStore, error) {
+
+	s := &secretStore{
+		file: config.SecretsFile,
+		log:  log.with(field("path", config.SecretsFile)),
+	}
+
+	if s.file == "" {
+		for _, secret := range strings.Split(os.Getenv("SERVERCONTROL_SECRETS"), ",") {
+			if secret = strings.TrimSpace(secret); secret != "" {
+				s.static = append(s.static, secret)
+			}
+		}
+		if config.Secret != "" {
+			s.static = append(s.static, config.Secret)
+		}
+		return s, nil
+	}
+
+	err := s.load()
+	if os.IsNotExist(err) && config.Secret != "" {
+		s.log.warn("no secrets file yet, using Secret until there is")
+		s.secrets = []string{config.Secret}
+		s.fallback = true
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *secretStore) load() error {
+
+	info, err := os.Stat(s.file)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+
+	secrets := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		secrets = append(secrets, line)
+	}
+
+	if len(secrets) == 0 {
+		return errors.New("no secrets in " + s.file)
+	}
+
+	s.secrets = secrets
+	s.fallback = false
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	return nil
+}
+
+// active returns the accepted secrets, newest first
+func (s *secretStore) active() []string {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file != "" && time.Since(s.checked) > secretsCheckInterval {
+		s.checked = time.Now()
+		info, err := os.Stat(s.file)
+		switch {
+		case s.fallback && os.IsNotExist(err):
+			// Secret stays in use until the file shows up
+		case err != nil:
+			s.log.error("unable to stat secrets file, keeping current secrets", errField(err))
+		case !info.ModTime().Equal(s.modTime) || info.Size() != s.size:
+			if err := s.load(); err != nil {
+				s.log.error("unable to reload secrets file, keeping current secrets", errField(err))
+			} else {
+				s.log.info("reloaded secrets", field("count", len(s.secrets)))
+			}
+		}
+	}
+
+	secrets := make([]string, 0, len(s.secrets)+len(s.static))
+	secrets = append(secrets, s.secrets...)
+	for _, secret := range s.static {
+		if !contains(secrets, secret) {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// newest is the secret outgoing requests are signed with
+func (s *secretStore) newest() string {
+	if secrets := s.active(); len(secrets) > 0 {
+		return secrets[0]
+	}
+	return ""
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -3,15 +3,18 @@ package servercontrol // import "github.com/rem7/servercontrol"
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -19,6 +22,8 @@ import (
 	"github.com/urfave/negroni"
 )
 
+// Logger is the original Printf style logger. Messages reach it through
+// AdaptLogger, Fatalf is never called.
 type Logger interface {
 	Printf(string, ...interface{})
 	Fatalf(string, ...interface{})
@@ -28,6 +33,7 @@ type ServerControlConfig struct {
 	AppName      string
 	RepoUrl      string
 	RepoDir      string
+	Branch       string // reported by service_data, master by default
 	ServicePort  int
 	Secret       string
 	Prefix       string
@@ -37,6 +43,170 @@ type ServerControlConfig struct {
 	Timeout      int
 	ShutdownFunc context.CancelFunc
 	Log          Logger
+
+	// StructuredLog takes precedence over Log. Without either messages go
+	// to stderr. Messages below LogLevel are dropped, all of them are kept
+	// when DEBUG is set.
+	StructuredLog StructuredLogger
+	LogLevel      Level
+
+	// MetadataEndpoint and AWSEndpoint default to the real services, or to
+	// SERVERCONTROL_METADATA_ENDPOINT and SERVERCONTROL_AWS_ENDPOINT when set
+	MetadataEndpoint string
+	AWSEndpoint      string
+
+	// InstanceID, Region and Hostname override what would otherwise be read
+	// from the instance metadata service and the os. With NotOnEC2 set the
+	// metadata service is never queried, and endpoints that need AWS fail
+	// with ErrNotOnEC2 unless InstanceID and Region are both given, in
+	// which case AWS is still called with them.
+	InstanceID string
+	Region     string
+	Hostname   string
+	NotOnEC2   bool
+
+	// SignatureSkew is how far a signed request's timestamp may be from
+	// this server's clock, 5 minutes by default. DisableLegacyAuth stops
+	// accepting and sending the plain secret once every peer signs.
+	SignatureSkew     time.Duration
+	DisableLegacyAuth bool
+
+	// SecretsFile lists the shared secrets accepted, one per line and
+	// newest first. It is re-read when it changes and requests to peers
+	// are signed with the newest secret, so a rotation can be rolled out
+	// gradually: add the new secret at the top everywhere, then remove the
+	// old one. Secret is only accepted until the file exists, so it can be
+	// retired like any other by leaving it out. Without a file the secrets
+	// are SERVERCONTROL_SECRETS, comma separated, and Secret.
+	SecretsFile string
+
+	// AuditLog is where every call to a mutating endpoint is recorded, as
+	// hash chained JSON lines. Auditing is off when it is empty.
+	AuditLog string
+
+	// Tokens are extra credentials limited to some scopes, for people and
+	// tools that shouldn't hold Secret, which grants everything.
+	Tokens []Token
+
+	// GitWebhookToken names the token whose secret GitHub or GitLab push
+	// webhooks to /git_webhook are signed with. A push moving Branch
+	// deploys its new head when the token has the deploy-fleet scope.
+	GitWebhookToken string
+
+	// AutoDeployInterval is how often the head of Branch is polled, which
+	// is deployed when it isn't what the fleet runs. Every instance polls
+	// and the deploy lock lets one of them deploy, so polling needs a lock
+	// the fleet shares, Lock, LockTable or LockFile. After a failure the
+	// interval doubles, up to AutoDeployMaxBackoff, 30 minutes by default.
+	// Polling is off when AutoDeployInterval is 0. Pausing auto-deploy,
+	// which also pauses GitWebhookToken pushes, covers the fleet when the
+	// deploy lock is in LockTable or LockFile and only this instance
+	// otherwise.
+	AutoDeployInterval   time.Duration
+	AutoDeployMaxBackoff time.Duration
+
+	// Freezes are windows update_service, rollback and update_server are
+	// refused in, including deploys started by a push, a poll or a
+	// schedule.
+	Freezes []Freeze
+
+	// RequireApproval makes update_service only create a deploy request,
+	// deployed once a caller other than the one that made it calls
+	// /approve with its id within ApprovalTTL, an hour by default. Callers
+	// named in ApprovalExempt, such as auto-deploy, deploy right away and
+	// rollbacks never wait. Requests are kept by the server they were made
+	// to, in ApprovalFile so they outlive its restarts, or only in memory
+	// without one.
+	RequireApproval bool
+	ApprovalTTL     time.Duration
+	ApprovalExempt  []string
+	ApprovalFile    string
+
+	// ScheduleFile keeps the deploys scheduled with schedule_deploy on
+	// this server, which starts them. Scheduling is off without it.
+	ScheduleFile string
+
+	// Webhooks are sent deploy events as they happen.
+	Webhooks []Webhook
+
+	// HistoryFile records every deployment this server coordinates and how
+	// it went on each instance, it is what rollback goes back through.
+	// There is no history or rollback when it is empty.
+	HistoryFile string
+
+	// Lock guards against two deployments running at once. Without one a
+	// DynamoDB table named LockTable is used, then a file at LockFile, and
+	// otherwise the lock only covers deployments coordinated by this
+	// process. The table item is keyed by LockKey, AppName by default. The
+	// lock is held for LockTTL, 2 minutes by default, and renewed until the
+	// deployment ends.
+	Lock      Locker
+	LockTable string
+	LockKey   string
+	LockFile  string
+	LockTTL   time.Duration
+
+	// HealthCheck and HealthURL tell whether the application is healthy,
+	// HealthURL being fetched from this server and expected to answer 2xx.
+	// Both are reported at /health, and a rolling restart only moves on
+	// from an instance once it has passed HealthChecks checks in a row, 3
+	// by default, HealthInterval apart, 1 second by default. /health
+	// needs a token with the read scope unless PublicHealth is set, or it
+	// is called with an Authorization: Bearer HealthBearerToken header, so
+	// an ALB or ASG health check can use it.
+	HealthCheck       func() error
+	HealthURL         string
+	HealthChecks      int
+	HealthInterval    time.Duration
+	HealthBearerToken string
+	PublicHealth      bool
+
+	// SmokeTests are run against each peer's service port once it is back
+	// on the new version and healthy. A failing test stops the deployment
+	// the same way a peer that doesn't come back does.
+	SmokeTests []SmokeTest
+
+	// SigningKeyring, an OpenPGP keyring, and AllowedSigners, an SSH
+	// allowed signers file, are the keys a commit must be signed with, by
+	// itself or by a tag pointing at it, before it is built. Any commit is
+	// built when both are empty.
+	SigningKeyring string
+	AllowedSigners string
+
+	// BakeTime is how long the fleet is watched after a deployment this
+	// server coordinated, sampling every instance each BakeInterval, 10
+	// seconds by default. An instance's signals come from BakeSignals,
+	// asked through its /signals, or otherwise from the Prometheus text
+	// served at BakeMetricsPath on its service port, where the gauges
+	// BakeErrorRateMetric and BakeLatencyMetric, in seconds, are read. The
+	// fleet is rolled back as soon as any instance's error rate goes over
+	// BakeMaxErrorRate or its latency over BakeMaxLatency. Baking needs
+	// HistoryFile and is off when BakeTime is 0.
+	BakeTime            time.Duration
+	BakeInterval        time.Duration
+	BakeSignals         func() (Signals, error)
+	BakeMetricsPath     string
+	BakeErrorRateMetric string
+	BakeLatencyMetric   string
+	BakeMaxErrorRate    float64
+	BakeMaxLatency      time.Duration
+
+	// /metrics needs a token with the read scope like any other route.
+	// MetricsBearerToken lets Prometheus scrape it with an Authorization:
+	// Bearer header instead, and PublicMetrics serves it without any auth.
+	MetricsBearerToken string
+	PublicMetrics      bool
+
+	// TLSCAFile, TLSCertFile and TLSKeyFile enable mutual TLS between
+	// peers. Requests to peers present the cert and check theirs against
+	// the CA, and prime_build and restart_server only accept callers with
+	// a cert from the CA. Peers are identified by an IP SAN for their
+	// address, or by a spiffe://TrustDomain/... URI SAN when TrustDomain
+	// is set.
+	TLSCAFile   string
+	TLSCertFile string
+	TLSKeyFile  string
+	TrustDomain string
 }
 
 type ServerVersion struct {
@@ -45,18 +215,55 @@ type ServerVersion struct {
 	Hostname      string `json:"hostname,omitemtpy"`
 }
 
+// ServerControl owns everything a single servercontrol handler needs, so
+// several can be mounted in one process without sharing state.
+type ServerControl struct {
+	config  ServerControlConfig
+	sv      ServerVersion
+	log     *fieldLogger
+	handler http.Handler
+	nonces  *nonceCache
+	secrets *secretStore
+	audit   *auditLog
+	metrics *metrics
+	events  *notifier
+	history *historyStore
+	lock    Locker
+	paused  Locker
+	smoke   []smokeTest
+	client  *http.Client
+
+	autoDeploy *autoDeployer
+	freezes    []freeze
+	approvals  *approvals
+	schedules  *scheduleStore
+
+	// gnupgHome holds SigningKeyring imported
+	gnupgHome string
+
+	caPool *x509.CertPool
+	cert   *tls.Certificate
+
+	metaClient   *metadataClient
+	metaMu       sync.Mutex
+	metaLoaded   bool
+	metaRetry    time.Time
+	metaFailures int
+	meta         Metadata
+	metaErr      error
+
+	connectMu sync.Mutex
+	sess      *session.Session
+	asg       *autoscaling.AutoScaling
+	ec2       *ec2.EC2
+}
+
 var (
-	GitHash       = "not-set"
-	startupuptime = "not-set"
-	sv            ServerVersion
-	gConfig       ServerControlConfig
-	shutdownFunc  context.CancelFunc
-	logger        Logger
-	DEBUG         bool
+	GitHash = "not-set"
+	DEBUG   bool
 )
 
 func init() {
-	getInstanceData()
 	if d := os.Getenv("DEBUG"); d == "" {
 		DEBUG = false
 	} else {
@@ -64,22 +271,27 @@ func init() {
 	}
 }
 
+// NewServerControl is kept for existing callers. When the config is
+// invalid the error is logged and every request is answered with it.
 func NewServerControl(config ServerControlConfig) http.Handler {
 
-	sess = session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(gRegion),
-	}))
-
-	ASG = autoscaling.New(sess)
-	EC2 = ec2.New(sess)
-
-	sv.StartTime = time.Now().Format(ISO_8601)
-	if h, err := os.Hostname(); err == nil {
-		sv.Hostname = h
+	sc, err := New(config)
+	if err != nil {
+		newFieldLogger(config).error("invalid servercontrol config", errField(err))
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			res.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(res, "%s", err.Error())
+		})
 	}
+	return sc
+}
+
+// New builds a ServerControl from config, filling in defaults for anything
+// left unset. The returned value is an http.Handler mounted under Prefix.
+func New(config ServerControlConfig) (*ServerControl, error) {
 
 	if config.RepoDir == "" {
-		fatalf("config dir not setup")
+		return nil, errors.New("config dir not setup")
 	}
 
 	if config.UpdateScript == "" {
@@ -90,6 +302,10 @@ func NewServerControl(config ServerControlConfig) http.Handler {
 		config.Version = GitHash
 	}
 
+	if config.Proto == "" && config.TLSCertFile != "" {
+		config.Proto = "https"
+	}
+
 	if config.Proto == "" {
 		config.Proto = "http"
 	}
@@ -106,33 +322,184 @@ func NewServerControl(config ServerControlConfig) http.Handler {
 		config.Timeout = 60
 	}
 
-	if config.Log != nil {
-		logger = config.Log
+	if config.Branch == "" {
+		config.Branch = defaultBranch
 	}
 
-	gConfig = config
-	sv.GitCommitHash = config.Version
+	if err := validateTokens(config.Tokens); err != nil {
+		return nil, err
+	}
 
-	router := mux.NewRouter().PathPrefix(config.Prefix).Subrouter().StrictSlash(true)
-	router.HandleFunc("/service_data", serviceData)
-	router.HandleFunc("/update_service", updateService)
-	router.HandleFunc("/server_version", serverVersion)
-	router.HandleFunc("/update_server", updateServer)
+	if config.SignatureSkew == 0 {
+		config.SignatureSkew = defaultSignatureSkew
+	}
+
+	if config.LockTTL == 0 {
+		config.LockTTL = defaultLockTTL
+	}
+
+	if config.LockKey == "" {
+		config.LockKey = config.AppName
+	}
+
+	if config.HealthChecks == 0 {
+		config.HealthChecks = defaultHealthChecks
+	}
+
+	if config.HealthInterval == 0 {
+		config.HealthInterval = defaultHealthInterval
+	}
+
+	if config.BakeInterval == 0 {
+		config.BakeInterval = defaultBakeInterval
+	}
+
+	if err := validateBake(config); err != nil {
+		return nil, err
+	}
+
+	if config.ApprovalTTL == 0 {
+		config.ApprovalTTL = defaultApprovalTTL
+	}
+
+	if config.AutoDeployMaxBackoff == 0 {
+		config.AutoDeployMaxBackoff = defaultAutoDeployMaxBackoff
+	}
+	if config.AutoDeployMaxBackoff < config.AutoDeployInterval {
+		config.AutoDeployMaxBackoff = config.AutoDeployInterval
+	}
+	if config.AutoDeployInterval > 0 && config.Lock == nil && config.LockTable == "" && config.LockFile == "" {
+		return nil, errors.New("AutoDeployInterval needs Lock, LockTable or LockFile")
+	}
+
+	if config.MetadataEndpoint == "" {
+		config.MetadataEndpoint = os.Getenv("SERVERCONTROL_METADATA_ENDPOINT")
+	}
+	if config.MetadataEndpoint == "" {
+		config.MetadataEndpoint = "http://169.254.169.254"
+	}
+
+	if config.AWSEndpoint == "" {
+		config.AWSEndpoint = os.Getenv("SERVERCONTROL_AWS_ENDPOINT")
+	}
+
+	sc := &ServerControl{
+		config:     config,
+		log:        newFieldLogger(config),
+		metaClient: newMetadataClient(config.MetadataEndpoint),
+		nonces:     newNonceCache(),
+		metrics:    newMetrics(),
+	}
+
+	var err error
+	if sc.secrets, err = newSecretStore(config, sc.log); err != nil {
+		return nil, err
+	}
+
+	if sc.events, err = newNotifier(config, sc.log); err != nil {
+		return nil, err
+	}
 
-	router.HandleFunc("/prime_build", primeBuild)
-	router.HandleFunc("/restart_server", restartServer)
+	sc.lock = sc.newLocker()
+	sc.paused = sc.sharedLocker(pausedSuffix)
+	sc.autoDeploy = newAutoDeployer(config)
+	if sc.approvals, err = openApprovals(config.ApprovalFile); err != nil {
+		return nil, err
+	}
+
+	if sc.freezes, err = newFreezes(config.Freezes); err != nil {
+		return nil, err
+	}
+
+	if config.ScheduleFile != "" {
+		if sc.schedules, err = openSchedules(config.ScheduleFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if sc.smoke, err = newSmokeTests(config.SmokeTests); err != nil {
+		return nil, err
+	}
+
+	if config.HistoryFile != "" {
+		if sc.history, err = openHistory(config.HistoryFile, sc.log); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.AuditLog != "" {
+		if sc.audit, err = openAuditLog(config.AuditLog, sc.log); err != nil {
+			return nil, err
+		}
+		if err := VerifyAuditLog(config.AuditLog); err != nil && !os.IsNotExist(err) {
+			sc.log.error("audit log failed verification", field("path", config.AuditLog), errField(err))
+		}
+	}
+
+	if err := sc.loadTLS(); err != nil {
+		return nil, err
+	}
+	sc.client = sc.newHTTPClient()
+
+	if err := sc.loadKeyring(); err != nil {
+		return nil, err
+	}
+
+	sc.sv.StartTime = time.Now().Format(ISO_8601)
+	if config.Hostname != "" {
+		sc.sv.Hostname = config.Hostname
+	} else if h, err := os.Hostname(); err == nil {
+		sc.sv.Hostname = h
+	}
+	sc.sv.GitCommitHash = config.Version
+
+	router := mux.NewRouter().PathPrefix(config.Prefix).Subrouter().StrictSlash(true)
+	router.HandleFunc("/service_data", sc.serviceData)
+	router.HandleFunc("/update_service", sc.audited("update_service", sc.updateService))
+	router.HandleFunc("/server_version", sc.serverVersion)
+	router.HandleFunc("/update_server", sc.audited("update_server", sc.updateServer))
+	router.HandleFunc("/audit", sc.auditQuery)
+	router.HandleFunc("/metrics", sc.serveMetrics)
+	router.HandleFunc("/history", sc.historyQuery)
+	router.HandleFunc("/rollback", sc.audited("rollback", sc.rollback))
+	router.HandleFunc("/lock", sc.lockStatus)
+	router.HandleFunc("/health", sc.health)
+	router.HandleFunc("/signals", sc.signals)
+	router.HandleFunc("/changelog", sc.changelogQuery)
+	router.HandleFunc("/git_webhook", sc.audited("git_webhook", sc.gitWebhook))
+	router.HandleFunc("/unlock", sc.audited("unlock", sc.forceUnlock))
+	router.HandleFunc("/auto_deploy", sc.autoDeployStatus)
+	router.HandleFunc("/pause_auto_deploy", sc.audited("pause_auto_deploy", sc.pauseAutoDeploy))
+	router.HandleFunc("/resume_auto_deploy", sc.audited("resume_auto_deploy", sc.resumeAutoDeploy))
+	router.HandleFunc("/freeze", sc.freezeStatus)
+	router.HandleFunc("/approve", sc.audited("approve", sc.approve))
+	router.HandleFunc("/deploy_requests", sc.deployRequests)
+	router.HandleFunc("/schedule_deploy", sc.audited("schedule_deploy", sc.scheduleDeploy))
+	router.HandleFunc("/scheduled_deploys", sc.scheduledDeploys)
+	router.HandleFunc("/cancel_scheduled_deploy", sc.audited("cancel_scheduled_deploy", sc.cancelScheduledDeploy))
+
+	router.HandleFunc("/prime_build", sc.audited("prime_build", sc.requirePeer(sc.primeBuild)))
+	router.HandleFunc("/restart_server", sc.audited("restart_server", sc.requirePeer(sc.restartServer)))
 
 	n := negroni.New()
-	n.Use(negroni.HandlerFunc(auth(config)))
+	n.Use(negroni.HandlerFunc(sc.auth))
 
 	n.UseHandler(router)
 
-	shutdownFunc = config.ShutdownFunc
+	sc.handler = n
+
+	go sc.resumeBake()
+	go sc.pollBranch()
+	sc.armSchedules()
+
+	return sc, nil
+}
 
-	return n
+func (sc *ServerControl) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	sc.handler.ServeHTTP(res, req)
 }
 
-func primeBuild(res http.ResponseWriter, req *http.Request) {
+func (sc *ServerControl) primeBuild(res http.ResponseWriter, req *http.Request) {
 	res.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate")
 	res.Header().Add("Content-Type", "application/json")
 
@@ -146,28 +513,41 @@ func primeBuild(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if _, err := os.Stat("/tmp/" + gConfig.AppName + "-" + props.Hash); err == nil {
-		fmt.Fprintf(res, "binary for hash %s already exists skipping compile")
-		printf("build succesfull")
+	log := sc.requestLog(props).with(field(FieldPhase, "build"))
+
+	if _, err := os.Stat("/tmp/" + sc.config.AppName + "-" + props.Hash); err == nil {
+		// a binary left from before signing was enforced, or built from a
+		// key since removed, is no more trusted than a fresh build
+		if _, err := sc.verifyCommit(props.Hash); err != nil {
+			log.error("refused cached binary", errField(err))
+			sc.metrics.builds.inc("refused")
+			res.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(res, "pull/compiled failed")
+			return
+		}
+		fmt.Fprintf(res, "binary for hash %s already exists skipping compile", props.Hash)
+		log.info("binary already built")
+		sc.metrics.builds.inc("cached")
 		return
 	}
 
-	err = internalUpdateServer(props.Hash, GitHash)
+	err = sc.internalUpdateServer(props.Hash, sc.config.Version)
 	if err != nil {
+		log.error("build failed", errField(err))
 		res.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(res, "pull/compiled failed")
 	} else {
 		fmt.Fprint(res, "build succesfull")
-		printf("build succesfull")
+		log.info("build succesfull")
 	}
 
 }
 
-func serverVersion(res http.ResponseWriter, req *http.Request) {
+func (sc *ServerControl) serverVersion(res http.ResponseWriter, req *http.Request) {
 	res.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate")
 	res.Header().Add("Content-Type", "application/json")
 
-	if j, err := ToJsonString(sv); err == nil {
+	if j, err := ToJsonString(sc.sv); err == nil {
 		fmt.Fprintf(res, j)
 	} else {
 		res.WriteHeader(http.StatusInternalServerError)
@@ -175,44 +555,70 @@ func serverVersion(res http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func internalUpdateServer(hash, revertHash string) error {
-	return runCommand(hash, gConfig.UpdateScript, gConfig.AppName, hash, revertHash)
+func (sc *ServerControl) internalUpdateServer(hash, revertHash string) error {
+
+	if _, err := sc.verifyCommit(hash); err != nil {
+		sc.metrics.builds.inc("refused")
+		return err
+	}
+
+	start := time.Now()
+	err := sc.runCommand(hash, sc.config.UpdateScript, sc.config.AppName, hash, revertHash)
+	sc.metrics.builds.inc(outcome(err))
+	sc.metrics.buildDuration.observe(time.Since(start).Seconds(), outcome(err))
+	return err
 }
 
-func updateServer(res http.ResponseWriter, req *http.Request) {
+// scheduleRestart shuts the server down shortly after the response to the
+// request that triggered it has gone out
+func (sc *ServerControl) scheduleRestart(reason string, delay time.Duration) {
+
+	sc.metrics.restarts.inc(reason)
+	time.AfterFunc(delay, func() {
+		sc.events.wait(5 * time.Second)
+		// os.Exit(0)
+		sc.removeKeyring()
+		sc.config.ShutdownFunc()
+	})
+}
+
+func (sc *ServerControl) updateServer(res http.ResponseWriter, req *http.Request) {
 	props, err := parseDefaultProps(req, res)
 	if err != nil {
 		return
 	}
 
-	if props.Hash == "" {
-		res.WriteHeader(http.StatusBadRequest)
+	if !sc.resolveProps(res, &props) {
 		return
 	}
 
-	err = internalUpdateServer(props.Hash, GitHash)
+	log := sc.requestLog(props)
+
+	if _, ok := sc.checkFreeze(res, req, props, log); !ok {
+		return
+	}
+
+	err = sc.internalUpdateServer(props.Hash, sc.config.Version)
 	if err != nil {
+		log.error("pull failed", errField(err))
 		res.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(res, "pull failed")
 	} else {
 		fmt.Fprint(res, "restarting server")
-		printf("pull succesfull restarting server")
-		time.AfterFunc(time.Millisecond*100, func() {
-			// os.Exit(0)
-			shutdownFunc()
-		})
+		log.info("pull succesfull restarting server")
+		sc.scheduleRestart("update_server", time.Millisecond*100)
 	}
 
 }
 
-func serviceData(res http.ResponseWriter, req *http.Request) {
+func (sc *ServerControl) serviceData(res http.ResponseWriter, req *http.Request) {
 
 	res.Header().Add("Content-Type", "application/json")
 
-	data, err := getServiceData()
+	data, err := sc.getServiceData()
 	if err != nil {
-		printf(err.Error())
-		res.WriteHeader(http.StatusInternalServerError)
+		sc.log.error("unable to get service data", errField(err))
+		res.WriteHeader(errorStatus(err))
 		fmt.Fprintf(res, "%s", err.Error())
 		return
 	}
@@ -226,7 +632,7 @@ func serviceData(res http.ResponseWriter, req *http.Request) {
 
 }
 
-func updateService(res http.ResponseWriter, req *http.Request) {
+func (sc *ServerControl) updateService(res http.ResponseWriter, req *http.Request) {
 
 	props, err := parseDefaultProps(req, res)
 	if err != nil {
@@ -234,14 +640,162 @@ func updateService(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if props.Hash == "" {
-		res.WriteHeader(http.StatusBadRequest)
+	if !sc.resolveProps(res, &props) {
+		return
+	}
+
+	if wantsPlan(req, props) {
+		sc.servePlan(res, props)
 		return
 	}
 
-	data, err := getServiceData()
+	if sc.needsApproval(req) {
+		sc.requestApproval(res, req, props)
+		return
+	}
+
+	sc.deploy(res, req, props, "deploy")
+}
+
+// rollback deploys the version the fleet ran before its latest successful
+// deployment, as recorded in the deployment history. Auto-deploy is paused
+// until resumed so it doesn't redeploy what was rolled back.
+func (sc *ServerControl) rollback(res http.ResponseWriter, req *http.Request) {
+
+	previous, err := sc.history.previous()
 	if err != nil {
+		res.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(res, "%s", err.Error())
+		return
+	}
+
+	// a body is optional, it can only ask to override a freeze
+	props := defaultProps{}
+	if body, err := readBody(req); err == nil && len(body) > 0 {
+		if err := json.Unmarshal(body, &props); err != nil {
+			res.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(res, "%s", err.Error())
+			return
+		}
+	}
+
+	sc.deploy(res, req, defaultProps{Hash: previous, OverrideFreeze: props.OverrideFreeze}, "rollback")
+}
+
+// deploy builds hash on every instance, restarts the others one at a time,
+// then installs it here, points the autoscale group at it and restarts
+func (sc *ServerControl) deploy(res http.ResponseWriter, req *http.Request, props defaultProps, kind string) {
+
+	props.DeploymentID = newDeploymentID()
+	log := sc.requestLog(props)
+
+	overridden, ok := sc.checkFreeze(res, req, props, log)
+	if !ok {
+		return
+	}
+
+	lock, holder, err := sc.lockDeploy(props, callerName(req))
+	if err == ErrLocked {
+		log.warn(kind+" refused, deploy lock held", field("holder", holder.describe()))
+		res.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(res, "%s holds the deploy lock", holder.describe())
+		return
+	}
+	if err != nil {
+		log.error("unable to take deploy lock", errField(err))
 		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "unable to take deploy lock\n%s", err.Error())
+		return
+	}
+	defer lock.release()
+
+	// approving uses up the request only now, a refused deployment leaves
+	// it pending
+	if props.Approves != "" {
+		if !sc.approvals.take(props.Approves, log) {
+			res.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(res, "deploy request %s was already approved", props.Approves)
+			return
+		}
+		log.info("deploy request approved", field("request", props.Approves), field("approved_by", props.ApprovedBy))
+	}
+
+	log.info(kind+" started", field("caller", callerName(req)))
+
+	if kind == "rollback" {
+		sc.pauseForRollback(callerName(req))
+	}
+
+	d := &Deployment{
+		ID:           props.DeploymentID,
+		Kind:         kind,
+		Hash:         props.Hash,
+		Ref:          props.Ref,
+		PreviousHash: sc.config.Version,
+		Caller:       callerName(req),
+		Started:      timestamp(),
+		Outcome:      DeployInProgress,
+
+		FreezeOverridden: overridden,
+		ApprovedBy:       props.ApprovedBy,
+	}
+	sc.record(d)
+
+	started := sc.event(EventDeployStarted, props)
+	if kind == "rollback" {
+		started.Type = EventRollback
+	}
+	started.Caller = d.Caller
+	if len(sc.config.Webhooks) > 0 {
+		if started.Changelog, err = sc.changelog([]string{sc.config.Version}, props.Hash); err != nil {
+			log.warn("unable to build changelog", errField(err))
+		}
+	}
+	sc.events.send(started)
+
+	// deployErr and phase say where the deploy stopped if it doesn't finish
+	deployErr := errors.New("deploy failed")
+	phase := "prepare"
+	defer func() {
+		sc.metrics.deploys.inc(outcome(deployErr))
+		d.Finished = timestamp()
+		d.Outcome = DeployOK
+		if deployErr != nil {
+			d.Outcome = DeployFailed
+			d.Phase = phase
+			d.Error = deployErr.Error()
+			failed := sc.event(EventDeployFailed, props)
+			failed.Phase = phase
+			failed.Error = deployErr.Error()
+			sc.events.send(failed)
+		}
+		sc.record(d)
+	}()
+
+	phase = "verify"
+	if d.Verification, err = sc.verifyCommit(props.Hash); err != nil {
+		deployErr = err
+		log.error("refusing to deploy", field(FieldPhase, "verify"), errField(err))
+		if errors.Is(err, errUnsigned) {
+			res.WriteHeader(http.StatusConflict)
+		} else {
+			res.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(res, "refusing to deploy\n%s", err.Error())
+		return
+	}
+	if d.Verification != nil {
+		log.info("commit verified", field(FieldPhase, "verify"), field("signed_by", d.Verification.SignedBy),
+			field("tag", d.Verification.Tag))
+		sc.record(d)
+	}
+
+	phase = "prepare"
+	data, err := sc.getServiceData()
+	if err != nil {
+		deployErr = err
+		log.error("unable to get service data", errField(err))
+		res.WriteHeader(errorStatus(err))
 		fmt.Fprintf(res, "%s", err.Error())
 		return
 	}
@@ -252,70 +806,140 @@ func updateService(res http.ResponseWriter, req *http.Request) {
 	}
 
 	// issue a build on all instances including this one
+	phase = "build"
+	start := time.Now()
 	done := make(chan primeBuildJob)
 	for _, instance := range data.InstanceList {
 		go func(i Instance) {
-			err = primeBuildInstance(props.Hash, i)
+			err := sc.primeBuildInstance(props, i, log)
 			done <- primeBuildJob{err, i}
 		}(instance)
 	}
 
-	finishedWithErrors := false
+	failedBuilds := []string{}
 	for i := 0; i < len(data.InstanceList); i++ {
 		job := <-done
+		result := d.instance(job.Instance.InstanceID)
 		if job.Err != nil {
-			finishedWithErrors = true
-			printf("instance %s failed to pull/compiles", job.Instance.InstanceID)
-			fmt.Fprintf(res, "instance %s failed to pull/compiles", job.Instance.InstanceID)
+			result.Error = job.Err.Error()
+			failedBuilds = append(failedBuilds, job.Instance.InstanceID)
+			log.error("instance failed to pull/compile", field(FieldPhase, "build"),
+				field(FieldInstance, job.Instance.InstanceID), errField(job.Err))
 		} else {
-			printf("instance %s completed build", job.Instance.InstanceID)
+			log.info("instance completed build", field(FieldPhase, "build"),
+				field(FieldInstance, job.Instance.InstanceID))
+			result.Built = true
+			built := sc.event(EventInstanceBuilt, props)
+			built.Instance = job.Instance.InstanceID
+			sc.events.send(built)
 		}
 	}
 
-	if finishedWithErrors {
+	if len(failedBuilds) > 0 {
+		deployErr = fmt.Errorf("build failed on %s", strings.Join(failedBuilds, ", "))
+		sc.metrics.phase("build", start, deployErr)
 		res.WriteHeader(http.StatusInternalServerError)
+		for _, id := range failedBuilds {
+			fmt.Fprintf(res, "instance %s failed to pull/compiles", id)
+		}
 		fmt.Fprintf(res, "finished with errors")
 		return
 	}
+	sc.metrics.phase("build", start, nil)
+	sc.record(d)
+
+	// lockLost answers the request when another coordinator took over the
+	// lock, nothing more is restarted or installed once it has
+	lockLost := func() bool {
+		if err := lock.held(); err != nil {
+			deployErr = err
+			log.error("aborting, deploy lock lost", field(FieldPhase, phase), errField(err))
+			res.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(res, "aborted %s\n%s", phase, err.Error())
+			return true
+		}
+		return false
+	}
 
 	// rolling restart all except this one
+	phase = "rolling_restart"
+	start = time.Now()
 	for _, instance := range data.InstanceList {
-		if instance.InstanceID != gInstanceId {
-			err := restartServerRequest(props.Hash, instance)
+		if instance.InstanceID != data.InstanceID {
+			if lockLost() {
+				sc.metrics.phase("rolling_restart", start, deployErr)
+				return
+			}
+			err := sc.restartServerRequest(props, instance, log)
+			sc.metrics.peerRestarts.inc(outcome(err))
 			if err != nil {
-				printf("%v", err)
+				d.instance(instance.InstanceID).Error = err.Error()
+				deployErr = fmt.Errorf("%s: %v", instance.InstanceID, err)
+				sc.metrics.phase("rolling_restart", start, err)
+				log.error("instance failed to restart", field(FieldPhase, "rolling_restart"),
+					field(FieldInstance, instance.InstanceID), errField(err))
+				res.WriteHeader(http.StatusInternalServerError)
 				fmt.Fprintf(res, "failed restarting server\n%s", err.Error())
 				return
 			}
+			d.instance(instance.InstanceID).Restarted = true
+			sc.record(d)
+			restarted := sc.event(EventInstanceRestarted, props)
+			restarted.Instance = instance.InstanceID
+			sc.events.send(restarted)
 		}
 	}
 
-	err = installVersion(props.Hash)
+	sc.metrics.phase("rolling_restart", start, nil)
+
+	phase = "install"
+	if lockLost() {
+		return
+	}
+	start = time.Now()
+	err = sc.installVersion(props.Hash)
+	sc.metrics.phase("install", start, err)
 	if err != nil {
+		deployErr = err
 		msg := "unable to install version on this server"
 		res.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(res, "%s\n%s", msg, err.Error())
-		printf(msg)
+		log.error(msg, field(FieldPhase, "install"), errField(err))
 		return
 	}
 
-	err = updateAutoscaleGroup(props.Hash, data.AutoScaleGroup.Name, data.AutoScaleGroup.LaunchConfiguration.Name)
+	phase = "update_asg"
+	start = time.Now()
+	err = sc.updateAutoscaleGroup(props.Hash, data.AutoScaleGroup.Name, data.AutoScaleGroup.LaunchConfiguration.Name)
+	sc.metrics.phase("update_asg", start, err)
 	if err != nil {
-		printf("%v", err)
+		deployErr = err
+		log.error("failed updating asg/lc", field(FieldPhase, "update_asg"), errField(err))
+		res.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(res, "failed updating asg/lc\n%s", err.Error())
 		return
 	}
 
+	sc.events.send(sc.event(EventASGUpdated, props))
+
+	deployErr = nil
+	d.instance(data.InstanceID).Restarted = true
+	if kind == "deploy" && sc.config.BakeTime > 0 {
+		d.Bake = BakeBaking
+	}
+	sc.events.send(sc.event(EventDeployFinished, props))
+	log.info(kind + " finished, restarting this server")
 	res.WriteHeader(http.StatusOK)
-	fmt.Fprint(res, "Successful updating all servers, restarting this server.")
-	time.AfterFunc(time.Millisecond*50, func() {
-		// os.Exit(0)
-		shutdownFunc()
-	})
+	fmt.Fprintf(res, "Successful updating all servers to %s, restarting this server.", props.Hash)
+	if kind == "rollback" {
+		sc.scheduleRestart("rollback", time.Millisecond*50)
+	} else {
+		sc.scheduleRestart("update_service", time.Millisecond*50)
+	}
 
 }
 
-func restartServer(res http.ResponseWriter, req *http.Request) {
+func (sc *ServerControl) restartServer(res http.ResponseWriter, req *http.Request) {
 	// install new version and restart server
 
 	props, err := parseDefaultProps(req, res)
@@ -329,61 +953,61 @@ func restartServer(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = installVersion(props.Hash)
+	instanceId := sc.instanceID()
+
+	log := sc.requestLog(props).with(field(FieldPhase, "install"))
+
+	err = sc.installVersion(props.Hash)
 	if err != nil {
-		printf(err.Error())
+		log.error("unable to install version", errField(err))
 		res.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(res, "restarted server %s with git_hash %s", gInstanceId, props.Hash)
+		fmt.Fprintf(res, "restarted server %s with git_hash %s", instanceId, props.Hash)
 		return
 	}
 
-	time.AfterFunc(time.Millisecond*100, func() {
-		// os.Exit(0)
-		shutdownFunc()
-	})
+	log.info("installed version, restarting")
+	sc.scheduleRestart("restart_server", time.Millisecond*100)
 
-	fmt.Fprintf(res, "restarted server %s with git_hash %s", gInstanceId, props.Hash)
+	fmt.Fprintf(res, "restarted server %s with git_hash %s", instanceId, props.Hash)
 
 }
 
-func installVersion(hash string) error {
+func (sc *ServerControl) installVersion(hash string) error {
 
-	appname := gConfig.AppName + "-" + hash
+	appname := sc.config.AppName + "-" + hash
 	bin := filepath.Join("/tmp/", appname)
-	dest := filepath.Join(os.Getenv("GOPATH"), "bin", gConfig.AppName)
-	return runCommand("", "install", "-m", "0777", bin, dest)
+	dest := filepath.Join(os.Getenv("GOPATH"), "bin", sc.config.AppName)
+	return sc.runCommand("", "install", "-m", "0777", bin, dest)
 }
 
-func restartServerRequest(hash string, instance Instance) error {
+func (sc *ServerControl) restartServerRequest(props defaultProps, instance Instance, log *fieldLogger) error {
 
-	props := struct {
-		Hash string `json:"hash"`
-	}{
-		Hash: hash,
-	}
+	log = log.with(field(FieldPhase, "rolling_restart"), field(FieldInstance, instance.InstanceID))
 
 	data, _ := ToJson(props)
-	url := getServiceForInstance(instance, "restart_server")
+	url := sc.getServiceForInstance(instance, "restart_server")
 
-	resp, err := apiRequest(url, "GET", bytes.NewReader(data))
+	resp, err := sc.apiRequest(url, "GET", bytes.NewReader(data))
 	if err != nil || resp.StatusCode != 200 {
 		return errors.New("failed sending restart instance request")
 	}
 
-	err = waitForInstance(hash, instance)
-	return err
+	if err := sc.waitForInstance(props.Hash, instance, log); err != nil {
+		return err
+	}
+	return sc.smokeTestInstance(instance, log)
 
 }
 
-func waitForInstance(hash string, instance Instance) error {
+func (sc *ServerControl) waitForInstance(hash string, instance Instance, log *fieldLogger) error {
 
-	url := getServiceForInstance(instance, "server_version")
-	for i := 0; i < gConfig.Timeout; i++ {
+	url := sc.getServiceForInstance(instance, "server_version")
+	for i := 0; i < sc.config.Timeout; i++ {
 
-		printf("waiting for %s (%s)", instance.InstanceID, instance.PrivateIP)
+		log.debug("waiting for instance", field("ip", instance.PrivateIP))
 		time.Sleep(1 * time.Second)
 
-		resp, err := apiRequest(url, "GET", nil)
+		resp, err := sc.apiRequest(url, "GET", nil)
 		if err != nil {
 			continue
 		}
@@ -391,14 +1015,18 @@ func waitForInstance(hash string, instance Instance) error {
 
 		body := ServerVersion{}
 		err = json.NewDecoder(resp.Body).Decode(&body)
-		if err != nil || resp.StatusCode != 200 {
-			printf("Sleeping 2 code: %v\n%v", resp.StatusCode, err)
+		if err != nil {
+			log.debug("instance not ready", field("status", resp.StatusCode), errField(err))
+			continue
+		}
+		if resp.StatusCode != 200 {
+			log.debug("instance not ready", field("status", resp.StatusCode))
 			continue
 		}
 
 		if body.GitCommitHash == hash {
-			printf("updated %s (%s) with %s", instance.InstanceID, instance.PrivateIP, hash)
-			return nil
+			log.info("instance updated", field("ip", instance.PrivateIP))
+			return sc.waitForHealthy(instance, log)
 		}
 	}
 
@@ -406,18 +1034,14 @@ func waitForInstance(hash string, instance Instance) error {
 
 }
 
-func primeBuildInstance(hash string, instance Instance) error {
+func (sc *ServerControl) primeBuildInstance(props defaultProps, instance Instance, log *fieldLogger) error {
 
-	printf("Updating instance: %s with %s", instance.InstanceID, hash)
+	log.info("building on instance", field(FieldPhase, "build"), field(FieldInstance, instance.InstanceID))
 
-	url := getServiceForInstance(instance, "prime_build")
-	props := defaultProps{
-		Hash:   hash,
-		Secret: gConfig.Secret,
-	}
+	url := sc.getServiceForInstance(instance, "prime_build")
 	json, _ := ToJson(props)
 
-	resp, err := apiRequest(url, "GET", bytes.NewReader(json))
+	resp, err := sc.apiRequest(url, "GET", bytes.NewReader(json))
 
 	if err != nil || resp.StatusCode != 200 {
 		return errors.New("failed to update instance")
@@ -426,19 +1050,3 @@ func primeBuildInstance(hash string, instance Instance) error {
 	return nil
 
 }
-
-func auth(config ServerControlConfig) func(http.ResponseWriter, *http.Request, http.HandlerFunc) {
-
-	return func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-
-		if r.Header.Get("x-sc-secret") == config.Secret {
-			next(rw, r)
-		} else if cookie, err := r.Cookie("secret"); err == nil && cookie.Value == config.Secret {
-			next(rw, r)
-		} else {
-			rw.WriteHeader(http.StatusForbidden)
-		}
-
-	}
-
-}
@@ -0,0 +1,134 @@
+package servercontrol
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	errUnsigned = errors.New("not signed by a trusted key")
+
+	sshGoodSignature = regexp.MustCompile(`Good "git" signature for (\S+) with \S+ key (\S+)`)
+)
+
+// Verification is whether a commit is signed by a trusted key, directly or
+// through a signed tag pointing at it.
+type Verification struct {
+	Verified bool   `json:"verified"`
+	SignedBy string `json:"signed_by,omitempty"`
+	Tag      string `json:"tag,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// signingEnabled is whether builds have to be signed
+func (sc *ServerControl) signingEnabled() bool {
+	return sc.config.SigningKeyring != "" || sc.config.AllowedSigners != ""
+}
+
+// loadKeyring imports SigningKeyring into a GnuPG home of its own, left
+// empty without one, so only its keys are trusted and the user's keys never
+// are
+func (sc *ServerControl) loadKeyring() error {
+
+	if !sc.signingEnabled() {
+		return nil
+	}
+
+	home, err := ioutil.TempDir("", "servercontrol-gnupg")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(home, "gpg.conf"), []byte("trust-model always\n"), 0600); err != nil {
+		os.RemoveAll(home)
+		return err
+	}
+
+	if sc.config.SigningKeyring != "" {
+		out, err := exec.Command("gpg", "--homedir", home, "--batch", "--quiet", "--import", sc.config.SigningKeyring).CombinedOutput()
+		if err != nil {
+			os.RemoveAll(home)
+			return fmt.Errorf("importing %s: %v\n%s", sc.config.SigningKeyring, err, out)
+		}
+	}
+
+	sc.gnupgHome = home
+	return nil
+}
+
+// removeKeyring deletes the GnuPG home made by loadKeyring
+func (sc *ServerControl) removeKeyring() {
+	if sc.gnupgHome != "" {
+		os.RemoveAll(sc.gnupgHome)
+	}
+}
+
+// verifyGit runs git verify-commit or verify-tag against the trusted keys,
+// returning who signed. Both kinds of key are always given, so neither falls
+// back to the user's own.
+func (sc *ServerControl) verifyGit(command, object string) (string, error) {
+
+	allowedSigners := sc.config.AllowedSigners
+	if allowedSigners == "" {
+		allowedSigners = os.DevNull
+	}
+
+	cmd := exec.Command("git", "-c", "gpg.ssh.allowedSignersFile="+allowedSigners, command, "--raw", object)
+	cmd.Dir = sc.config.RepoDir
+	cmd.Env = append(os.Environ(), "GNUPGHOME="+sc.gnupgHome)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", errUnsigned
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Fields(line); len(fields) > 2 && fields[0] == "[GNUPG:]" && fields[1] == "VALIDSIG" {
+			return fields[2], nil
+		}
+		if m := sshGoodSignature.FindStringSubmatch(line); m != nil {
+			return m[1] + " " + m[2], nil
+		}
+	}
+	return "", errUnsigned
+}
+
+// verifyCommit checks hash is signed by a trusted key, or pointed at by a
+// tag that is. It returns nil when signing isn't enforced.
+func (sc *ServerControl) verifyCommit(hash string) (*Verification, error) {
+
+	if !sc.signingEnabled() {
+		return nil, nil
+	}
+	if !fullHash.MatchString(hash) {
+		return nil, fmt.Errorf("%s is not a full commit hash", hash)
+	}
+
+	if err := sc.fetchCommits(hash); err != nil {
+		return nil, err
+	}
+
+	if signer, err := sc.verifyGit("verify-commit", hash); err == nil {
+		return &Verification{Verified: true, SignedBy: signer}, nil
+	}
+
+	// tags may not have come with the commit
+	if err := sc.fetchRefs(); err != nil {
+		return nil, err
+	}
+	out, err := sc.git("tag", "--points-at", hash)
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range strings.Fields(string(out)) {
+		if signer, err := sc.verifyGit("verify-tag", "refs/tags/"+tag); err == nil {
+			return &Verification{Verified: true, SignedBy: signer, Tag: tag}, nil
+		}
+	}
+
+	return &Verification{Error: fmt.Sprintf("%s is %v", hash, errUnsigned)}, fmt.Errorf("%s is %w", hash, errUnsigned)
+}
@@ -0,0 +1,111 @@
+package servercontrol
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const smokeBodyLimit = 1 << 20
+
+// SmokeTest is a request made to an instance's service port after it
+// restarts. Method defaults to GET and Status to 200. Body, when set, is a
+// regular expression the response body must match, and the response must
+// arrive within MaxLatency when that is set.
+type SmokeTest struct {
+	Name       string
+	Method     string
+	Path       string
+	Status     int
+	Body       string
+	MaxLatency time.Duration
+}
+
+type smokeTest struct {
+	SmokeTest
+	body *regexp.Regexp
+}
+
+func newSmokeTests(tests []SmokeTest) ([]smokeTest, error) {
+
+	compiled := make([]smokeTest, 0, len(tests))
+	for _, t := range tests {
+		if !strings.HasPrefix(t.Path, "/") {
+			return nil, fmt.Errorf("smoke test %q path %q must start with /", t.Name, t.Path)
+		}
+		if t.Name == "" {
+			t.Name = t.Path
+		}
+		if t.Method == "" {
+			t.Method = "GET"
+		}
+		if t.Status == 0 {
+			t.Status = http.StatusOK
+		}
+
+		st := smokeTest{SmokeTest: t}
+		if t.Body != "" {
+			var err error
+			if st.body, err = regexp.Compile(t.Body); err != nil {
+				return nil, fmt.Errorf("smoke test %q body: %v", t.Name, err)
+			}
+		}
+		compiled = append(compiled, st)
+	}
+	return compiled, nil
+}
+
+// smokeTestInstance runs every smoke test against instance, stopping at the
+// first that fails
+func (sc *ServerControl) smokeTestInstance(instance Instance, log *fieldLogger) error {
+
+	for _, t := range sc.smoke {
+		url := fmt.Sprintf("%s://%s:%d%s", sc.config.Proto, instance.PrivateIP, sc.config.ServicePort, t.Path)
+		if err := sc.runSmokeTest(t, url); err != nil {
+			log.error("smoke test failed", field("test", t.Name), errField(err))
+			return fmt.Errorf("smoke test %s failed: %v", t.Name, err)
+		}
+		log.debug("smoke test passed", field("test", t.Name))
+	}
+
+	if len(sc.smoke) > 0 {
+		log.info("smoke tests passed", field("tests", len(sc.smoke)))
+	}
+	return nil
+}
+
+func (sc *ServerControl) runSmokeTest(t smokeTest, url string) error {
+
+	req, err := http.NewRequest(t.Method, url, nil)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	resp, err := sc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, smokeBodyLimit))
+	latency := time.Since(start)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != t.Status {
+		return fmt.Errorf("%s %s returned %d, want %d", t.Method, t.Path, resp.StatusCode, t.Status)
+	}
+	if t.body != nil && !t.body.Match(body) {
+		return fmt.Errorf("%s %s body does not match %s", t.Method, t.Path, t.Body)
+	}
+	if t.MaxLatency > 0 && latency > t.MaxLatency {
+		return fmt.Errorf("%s %s took %v, over %v", t.Method, t.Path, latency.Round(time.Millisecond), t.MaxLatency)
+	}
+	return nil
+}
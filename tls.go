@@ -0,0 +1,207 @@
+package servercontrol
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+var errNoPeerCert = errors.New("no verified peer certificate")
+
+// loadTLS reads the CA and key pair when mutual TLS is configured
+func (sc *ServerControl) loadTLS() error {
+
+	c := sc.config
+	if c.TLSCAFile == "" && c.TLSCertFile == "" && c.TLSKeyFile == "" {
+		return nil
+	}
+
+	if c.TLSCAFile == "" || c.TLSCertFile == "" || c.TLSKeyFile == "" {
+		return errors.New("TLSCAFile, TLSCertFile and TLSKeyFile must all be set")
+	}
+
+	ca, err := ioutil.ReadFile(c.TLSCAFile)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("no certificates found in %s", c.TLSCAFile)
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return err
+	}
+
+	sc.caPool = pool
+	sc.cert = &cert
+	return nil
+}
+
+func (sc *ServerControl) mutualTLS() bool {
+	return sc.caPool != nil
+}
+
+// ServerTLSConfig returns the tls.Config the host app's server should use
+// so peers can present their certificates. Clients without one are still
+// let through to the endpoints that don't require a peer. It is nil when
+// mutual TLS isn't configured.
+func (sc *ServerControl) ServerTLSConfig() *tls.Config {
+
+	if !sc.mutualTLS() {
+		return nil
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{*sc.cert},
+		ClientCAs:    sc.caPool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// clientTLSConfig is used for requests to peers. Peers are dialed by
+// private IP so without a TrustDomain the standard verification checks the
+// certificate has an IP SAN for that address, with one the SPIFFE URI SAN
+// is checked instead.
+func (sc *ServerControl) clientTLSConfig() *tls.Config {
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{*sc.cert},
+		RootCAs:      sc.caPool,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if sc.config.TrustDomain != "" {
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			certs := make([]*x509.Certificate, 0, len(raw))
+			for _, r := range raw {
+				c, err := x509.ParseCertificate(r)
+				if err != nil {
+					return err
+				}
+				certs = append(certs, c)
+			}
+			leaf, err := sc.verifyChain(certs, x509.ExtKeyUsageServerAuth)
+			if err != nil {
+				return err
+			}
+			_, err = sc.peerIdentity(leaf, nil)
+			return err
+		}
+	}
+
+	return config
+}
+
+func (sc *ServerControl) newHTTPClient() *http.Client {
+
+	client := &http.Client{Timeout: time.Second * 30}
+	if sc.mutualTLS() {
+		client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: sc.clientTLSConfig(),
+		}
+	}
+	return client
+}
+
+// verifyChain checks certs, leaf first, against the fleet CA
+func (sc *ServerControl) verifyChain(certs []*x509.Certificate, usage x509.ExtKeyUsage) (*x509.Certificate, error) {
+
+	if len(certs) == 0 {
+		return nil, errNoPeerCert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         sc.caPool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return certs[0], nil
+}
+
+// peerIdentity returns who a verified certificate belongs to. With a
+// TrustDomain that is its spiffe://TrustDomain/... URI SAN, otherwise the
+// certificate must carry an IP SAN for the address the peer connected from.
+func (sc *ServerControl) peerIdentity(cert *x509.Certificate, remote net.IP) (string, error) {
+
+	if sc.config.TrustDomain != "" {
+		for _, uri := range cert.URIs {
+			if uri.Scheme == "spiffe" && uri.Host == sc.config.TrustDomain {
+				return uri.String(), nil
+			}
+		}
+		return "", fmt.Errorf("certificate has no spiffe id in trust domain %s", sc.config.TrustDomain)
+	}
+
+	if remote == nil {
+		return "", errors.New("no address to match against certificate")
+	}
+
+	for _, ip := range cert.IPAddresses {
+		if ip.Equal(remote) {
+			return "ip:" + ip.String(), nil
+		}
+	}
+	return "", fmt.Errorf("certificate not issued for %s", remote)
+}
+
+// requirePeer only lets through requests made by another member of the
+// fleet, identified by its client certificate. Without mutual TLS
+// configured it is a no-op.
+func (sc *ServerControl) requirePeer(next http.HandlerFunc) http.HandlerFunc {
+
+	return func(res http.ResponseWriter, req *http.Request) {
+
+		if !sc.mutualTLS() {
+			next(res, req)
+			return
+		}
+
+		id, err := sc.verifyPeer(req)
+		if err != nil {
+			sc.log.warn("rejected peer", field("path", req.URL.Path), field("remote", req.RemoteAddr), errField(err))
+			res.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		sc.log.debug("called by peer", field("path", req.URL.Path), field("peer", id))
+		next(res, req)
+	}
+}
+
+func (sc *ServerControl) verifyPeer(req *http.Request) (string, error) {
+
+	if req.TLS == nil {
+		return "", errNoPeerCert
+	}
+
+	leaf, err := sc.verifyChain(req.TLS.PeerCertificates, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return "", err
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	return sc.peerIdentity(leaf, net.ParseIP(host))
+}
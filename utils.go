@@ -3,24 +3,23 @@ package servercontrol
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
@@ -28,15 +27,6 @@ import (
 const ISO_8601 = "2006-01-02T15:04:05.999Z"
 
 var (
-	sess    *session.Session
-	ASG     *autoscaling.AutoScaling
-	EC2     *ec2.EC2
-	ec2Meta *ec2metadata.EC2Metadata
-
-	gRegion     string
-	gInstanceId string
-	gUserData   string
-
 	lcRegex = regexp.MustCompile(`(.*)-(\d+)`)
 )
 
@@ -70,15 +60,27 @@ type LaunchConfig struct {
 }
 
 type ServiceData struct {
-	MasterGitHash  string     `json:"master_git_hash"`
+	Branch         string     `json:"branch"`
+	BranchGitHash  string     `json:"branch_git_hash"`
+	MasterGitHash  string     `json:"master_git_hash"` // Deprecated: the same as BranchGitHash
 	InstanceID     string     `json:"instance_id"`
 	InstanceList   []Instance `json:"instance_list"`
 	AutoScaleGroup Group      `json:"auto_scale_group"`
 }
 
 type defaultProps struct {
-	Hash   string `json:"hash"`
-	Secret string `json:"secret"`
+	Hash         string `json:"hash"`
+	Ref          string `json:"ref,omitempty"`
+	DeploymentID string `json:"deployment_id,omitempty"`
+	Plan         bool   `json:"plan,omitempty"`
+
+	// OverrideFreeze deploys during a freeze, with the override-freeze scope
+	OverrideFreeze bool `json:"override_freeze,omitempty"`
+
+	// Approves is the deploy request being approved, by ApprovedBy. Neither
+	// is ever read from a body.
+	Approves   string `json:"-"`
+	ApprovedBy string `json:"-"`
 }
 
 func parseDefaultProps(req *http.Request, res http.ResponseWriter) (defaultProps, error) {
@@ -105,39 +107,72 @@ func parseBody(body io.ReadCloser, i interface{}) error {
 	return json.NewDecoder(body).Decode(&i)
 }
 
-func apiRequest(url, method string, body io.Reader) (*http.Response, error) {
+// apiRequest signs with the newest secret, falling back to older ones when
+// a peer that hasn't picked up a rotation yet refuses it
+func (sc *ServerControl) apiRequest(url, method string, body io.Reader) (*http.Response, error) {
 
-	client := &http.Client{Timeout: time.Second * 30}
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = ioutil.ReadAll(body); err != nil {
+			return nil, err
+		}
+	}
 
-	req, err := http.NewRequest(method, url, body)
-	if err != nil {
-		return nil, err
+	secrets := sc.secrets.active()
+	if len(secrets) == 0 {
+		secrets = []string{""}
 	}
-	req.Header.Add("X-Sc-Secret", gConfig.Secret)
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	start := time.Now()
+	service := path.Base(url)
+
+	var resp *http.Response
+	for i, secret := range secrets {
+
+		if i > 0 {
+			resp.Body.Close()
+			sc.log.warn("peer refused the newest secret, retrying with an older one", field("url", url))
+		}
+
+		req, err := http.NewRequest(method, url, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if err := sc.signRequest(req, secret); err != nil {
+			return nil, err
+		}
+
+		resp, err = sc.client.Do(req)
+		if err != nil {
+			sc.metrics.peerRequest(service, start, nil, err)
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusForbidden {
+			break
+		}
 	}
 
+	sc.metrics.peerRequest(service, start, resp, nil)
 	return resp, nil
 }
 
-func getServiceForInstance(instance Instance, service string) string {
+func (sc *ServerControl) getServiceForInstance(instance Instance, service string) string {
 
-	url := fmt.Sprintf("%s://%s:%d%s/%s", gConfig.Proto,
-		instance.PrivateIP, gConfig.ServicePort, gConfig.Prefix, service)
+	url := fmt.Sprintf("%s://%s:%d%s/%s", sc.config.Proto,
+		instance.PrivateIP, sc.config.ServicePort, sc.config.Prefix, service)
 	return url
 }
 
-func getInstances(instanceIds []*string) ([]Instance, error) {
+func (sc *ServerControl) getInstances(instanceIds []*string) ([]Instance, error) {
 
 	ec2params := &ec2.DescribeInstancesInput{
 		InstanceIds: instanceIds,
 	}
-	ec2resp, err := EC2.DescribeInstances(ec2params)
+	ec2resp, err := sc.ec2.DescribeInstances(ec2params)
 	if err != nil {
-		fmt.Println(err.Error())
+		sc.log.error("unable to describe instances", errField(err))
 		return nil, err
 	}
 
@@ -157,8 +192,8 @@ func getInstances(instanceIds []*string) ([]Instance, error) {
 				}
 
 				s := ServerVersion{}
-				url := getServiceForInstance(i, "server_version")
-				resp, err := apiRequest(url, "GET", nil)
+				url := sc.getServiceForInstance(i, "server_version")
+				resp, err := sc.apiRequest(url, "GET", nil)
 				if err == nil && resp.StatusCode == 200 {
 					parseBody(resp.Body, &s)
 					i.GitCommitHash = s.GitCommitHash
@@ -174,7 +209,7 @@ func getInstances(instanceIds []*string) ([]Instance, error) {
 	return instances, nil
 }
 
-func getAutoScaleGroup(instanceId string) (*Group, error) {
+func (sc *ServerControl) getAutoScaleGroup(instanceId string) (*Group, error) {
 
 	params := &autoscaling.DescribeAutoScalingInstancesInput{
 		InstanceIds: []*string{
@@ -182,7 +217,7 @@ func getAutoScaleGroup(instanceId string) (*Group, error) {
 		},
 	}
 
-	resp, err := ASG.DescribeAutoScalingInstances(params)
+	resp, err := sc.asg.DescribeAutoScalingInstances(params)
 	if err != nil {
 		return nil, err
 	}
@@ -196,7 +231,7 @@ func getAutoScaleGroup(instanceId string) (*Group, error) {
 		AutoScalingGroupNames: []*string{name},
 	}
 
-	respASG, err := ASG.DescribeAutoScalingGroups(paramsAsg)
+	respASG, err := sc.asg.DescribeAutoScalingGroups(paramsAsg)
 	if err != nil {
 		return nil, err
 	}
@@ -215,27 +250,31 @@ func getAutoScaleGroup(instanceId string) (*Group, error) {
 	}, nil
 }
 
-func getServiceData() (*ServiceData, error) {
+func (sc *ServerControl) getServiceData() (*ServiceData, error) {
 
-	masterGitHash, err := getMasterGitHash(gConfig.RepoUrl)
+	head, err := branchHead(sc.config.RepoUrl, sc.config.Branch)
 	if err != nil {
 		return nil, err
 	}
 
-	instanceId := gInstanceId
-	autoScaleGroup, err := getAutoScaleGroup(instanceId)
+	if err := sc.connect(); err != nil {
+		return nil, err
+	}
+
+	instanceId := sc.instanceID()
+	autoScaleGroup, err := sc.getAutoScaleGroup(instanceId)
 	if err != nil {
 		return nil, err
 	}
 
-	launchConfig, err := getLaunchConfiguration(&autoScaleGroup.LaunchConfiguration.Name)
+	launchConfig, err := sc.getLaunchConfiguration(&autoScaleGroup.LaunchConfiguration.Name)
 	if err != nil {
 		return nil, err
 	}
 
 	userDataDecoded, err := base64.StdEncoding.DecodeString(*launchConfig.UserData)
 	if err != nil {
-		printf("unable to decode user data")
+		sc.log.error("unable to decode user data", errField(err))
 		return nil, err
 	}
 
@@ -255,13 +294,15 @@ func getServiceData() (*ServiceData, error) {
 		instanceIds = append(instanceIds, instance.InstanceId)
 	}
 
-	instances, err := getInstances(instanceIds)
+	instances, err := sc.getInstances(instanceIds)
 	if err != nil {
 		return nil, err
 	}
 
 	return &ServiceData{
-		MasterGitHash:  masterGitHash,
+		Branch:         sc.config.Branch,
+		BranchGitHash:  head,
+		MasterGitHash:  head,
 		InstanceID:     instanceId,
 		AutoScaleGroup: group,
 		InstanceList:   instances,
@@ -269,60 +310,14 @@ func getServiceData() (*ServiceData, error) {
 
 }
 
-func getInstanceData() {
-
-	// we can cache all this since its never going to change
-	s := session.Must(session.NewSession())
-	ec2Meta = ec2metadata.New(s)
-
-	gRegion = getRegion()
-	gInstanceId, _ = getInstanceId()
-	gUserData = getUserData()
-
-}
-
-func getRegion() string {
-
-	region, err := ec2Meta.Region()
-	if err != nil {
-		printf("failed to get region")
-	}
-
-	return region
-}
-
-func getUserData() string {
-
-	userData, err := ec2Meta.GetUserData()
-	if err != nil {
-		printf("failed to get user data from instance")
-		return ""
-	}
-	return userData
-}
-
-func getInstanceId() (string, error) {
-	// TODO Update to use metadata
-	const instanceIdUrl = "http://169.254.169.254/latest/meta-data/instance-id"
-	resp, err := http.Get(instanceIdUrl)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	data, err := ioutil.ReadAll(resp.Body)
-
-	return string(data), err
-}
-
-func getLaunchConfiguration(name *string) (*autoscaling.LaunchConfiguration, error) {
+func (sc *ServerControl) getLaunchConfiguration(name *string) (*autoscaling.LaunchConfiguration, error) {
 
 	params := &autoscaling.DescribeLaunchConfigurationsInput{
 		LaunchConfigurationNames: []*string{
 			name,
 		},
 	}
-	resp, err := ASG.DescribeLaunchConfigurations(params)
+	resp, err := sc.asg.DescribeLaunchConfigurations(params)
 	if err != nil {
 		return nil, err
 	}
@@ -334,56 +329,25 @@ func getLaunchConfiguration(name *string) (*autoscaling.LaunchConfiguration, err
 	return resp.LaunchConfigurations[0], nil
 }
 
-func updateAutoscaleGroup(newHash, asgName, launchConfigName string) error {
+func (sc *ServerControl) updateAutoscaleGroup(newHash, asgName, launchConfigName string) error {
 
-	launchConfig, err := getLaunchConfiguration(&launchConfigName)
-	if err != nil {
+	if err := sc.connect(); err != nil {
 		return err
 	}
 
-	decoded, err := base64.StdEncoding.DecodeString(*launchConfig.UserData)
+	launchConfig, err := sc.getLaunchConfiguration(&launchConfigName)
 	if err != nil {
-		printf("unable to decode")
 		return err
 	}
 
-	newUserData := bytes.Buffer{}
-	udr := bufio.NewReader(bytes.NewReader(decoded))
-	for {
-		line, _, err := udr.ReadLine()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			print("error reading userData")
-			break
-		}
-
-		if strings.Contains(string(line), "GO_GIT_HASH") {
-			newHashLine := fmt.Sprintf("GO_GIT_HASH=%s\n", newHash)
-			newUserData.WriteString(newHashLine)
-		} else {
-			newUserData.Write(line)
-			newUserData.Write([]byte("\n"))
-		}
-
+	decoded, err := base64.StdEncoding.DecodeString(*launchConfig.UserData)
+	if err != nil {
+		sc.log.error("unable to decode user data", errField(err))
+		return err
 	}
 
-	newUserDataEncoded := base64.StdEncoding.EncodeToString(newUserData.Bytes())
-	lcNewName := ""
-
-	groups := lcRegex.FindAllStringSubmatch(launchConfigName, -1)
-	if len(groups) > 0 && len(groups[0]) > 2 {
-		prefix := groups[0][1]
-		iter, err := strconv.Atoi(groups[0][2])
-		if err != nil {
-			lcNewName = launchConfigName + "-1"
-		} else {
-			lcNewName = fmt.Sprintf("%s-%d", prefix, iter+1)
-		}
-
-	} else {
-		lcNewName = launchConfigName + "-1"
-	}
+	newUserDataEncoded := base64.StdEncoding.EncodeToString(sc.setUserDataHash(decoded, newHash))
+	lcNewName := nextLaunchConfigName(launchConfigName)
 
 	var keyName *string = nil
 	newConfig := &autoscaling.CreateLaunchConfigurationInput{
@@ -402,7 +366,7 @@ func updateAutoscaleGroup(newHash, asgName, launchConfigName string) error {
 		UserData:                     aws.String(newUserDataEncoded),
 	}
 
-	_, err = ASG.CreateLaunchConfiguration(newConfig)
+	_, err = sc.asg.CreateLaunchConfiguration(newConfig)
 	if err != nil {
 		return err
 	}
@@ -412,15 +376,90 @@ func updateAutoscaleGroup(newHash, asgName, launchConfigName string) error {
 		LaunchConfigurationName: aws.String(lcNewName),
 	}
 
-	_, err = ASG.UpdateAutoScalingGroup(asgParams)
+	_, err = sc.asg.UpdateAutoScalingGroup(asgParams)
 	if err != nil {
-		fmt.Println(err.Error())
+		sc.log.error("unable to update autoscale group", errField(err))
 		return err
 	}
 
 	return nil
 }
 
+// setUserDataHash replaces the GO_GIT_HASH line of a launch configuration's
+// user data with newHash
+func (sc *ServerControl) setUserDataHash(userData []byte, newHash string) []byte {
+
+	newUserData := bytes.Buffer{}
+	udr := bufio.NewReader(bytes.NewReader(userData))
+	for {
+		line, _, err := udr.ReadLine()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			sc.log.error("unable to read user data", errField(err))
+			break
+		}
+
+		if strings.Contains(string(line), "GO_GIT_HASH") {
+			newHashLine := fmt.Sprintf("GO_GIT_HASH=%s\n", newHash)
+			newUserData.WriteString(newHashLine)
+		} else {
+			newUserData.Write(line)
+			newUserData.Write([]byte("\n"))
+		}
+
+	}
+
+	return newUserData.Bytes()
+}
+
+// nextLaunchConfigName bumps the trailing -N of a launch configuration name
+func nextLaunchConfigName(launchConfigName string) string {
+
+	groups := lcRegex.FindAllStringSubmatch(launchConfigName, -1)
+	if len(groups) > 0 && len(groups[0]) > 2 {
+		prefix := groups[0][1]
+		iter, err := strconv.Atoi(groups[0][2])
+		if err != nil {
+			return launchConfigName + "-1"
+		}
+		return fmt.Sprintf("%s-%d", prefix, iter+1)
+	}
+
+	return launchConfigName + "-1"
+}
+
+// readJSONLines calls fn with every line of r that isn't blank, numbered
+// from 1. A crash in the middle of an append leaves a last line without
+// its newline; that one is skipped and the offset it starts at returned,
+// -1 when there is none, for the caller to truncate the file to.
+func readJSONLines(r io.Reader, fn func(n int, line []byte) error) (int64, error) {
+
+	br := bufio.NewReader(r)
+	offset := int64(0)
+	n := 0
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				return offset, nil
+			}
+			return -1, nil
+		}
+		if err != nil {
+			return -1, err
+		}
+
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			n++
+			if err := fn(n, trimmed); err != nil {
+				return -1, err
+			}
+		}
+		offset += int64(len(line))
+	}
+}
+
 func ToJson(s interface{}) ([]byte, error) {
 	var buf bytes.Buffer
 	err := json.NewEncoder(&buf).Encode(s)
@@ -432,7 +471,7 @@ func ToJsonString(s interface{}) (string, error) {
 	return string(b), err
 }
 
-func printPipes(logPostFix string, stdout, stderr io.Reader) {
+func (sc *ServerControl) printPipes(logPostFix string, stdout, stderr io.Reader) {
 
 	stdoutpath := "/tmp/servercontrol.out.log"
 	stderrpath := "/tmp/servercontrol.err.log"
@@ -444,13 +483,13 @@ func printPipes(logPostFix string, stdout, stderr io.Reader) {
 
 	stdoutFile, err := os.Create(stdoutpath)
 	if err != nil {
-		printf("unable to open tmp file for output")
+		sc.log.warn("unable to open tmp file for output", errField(err))
 		return
 	}
 
 	stderrFile, err := os.Create(stderrpath)
 	if err != nil {
-		printf("unable to open tmp file for output")
+		sc.log.warn("unable to open tmp file for output", errField(err))
 		return
 	}
 
@@ -466,53 +505,87 @@ func printPipes(logPostFix string, stdout, stderr io.Reader) {
 
 }
 
-func getMasterGitHash(remote string) (string, error) {
-	cmd := "git ls-remote " + remote + " refs/heads/master | cut -f 1 | tr -d '\n'"
-	out, err := exec.Command("bash", "-c", cmd).CombinedOutput()
-	return string(out), err
-}
-
-func runCommand(logPostFix string, app string, args ...string) error {
+func (sc *ServerControl) runCommand(logPostFix string, app string, args ...string) error {
 
 	cmd := exec.Command(app, args...)
-	cmd.Dir = gConfig.RepoDir
+	cmd.Dir = sc.config.RepoDir
+	cmd.Env = append(os.Environ(), "SERVERCONTROL_METADATA_ENDPOINT="+sc.config.MetadataEndpoint,
+		"SERVERCONTROL_REPO_URL="+sc.config.RepoUrl)
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
 
-	printPipes(logPostFix, stdout, stderr)
+	sc.printPipes(logPostFix, stdout, stderr)
+
+	log := sc.log.with(field("cmd", app))
+	if logPostFix != "" {
+		log = log.with(field(FieldHash, logPostFix))
+	}
 
 	err := cmd.Start()
 	if err != nil {
-		fatalf(err.Error())
+		log.error("unable to start command", errField(err))
+		return err
 	}
 
 	if err = cmd.Wait(); err != nil {
 		if exiterr, ok := err.(*exec.ExitError); ok {
-			printf("exit status != 0: %s", exiterr)
+			log.error("command exited with non-zero status", errField(exiterr))
 			return errors.New("cmd terminated with non-zero")
 		}
 	}
 
 	if !cmd.ProcessState.Success() {
-		printf("exit status != 0")
+		log.error("command exited with non-zero status")
 		return errors.New("cmd terminated with non-zero")
 	}
 
 	return nil
 }
 
-func printf(format string, args ...interface{}) {
-	if logger != nil {
-		logger.Printf(format, args...)
-	} else if DEBUG {
-		log.Printf(format, args...)
+// internalRequest calls one of the handler's endpoints from within, as
+// caller, for work that isn't started by a request of its own
+func (sc *ServerControl) internalRequest(route string, h http.HandlerFunc, caller Caller, props interface{}) (*internalResponse, error) {
+
+	var body io.Reader
+	if props != nil {
+		data, err := ToJson(props)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest("POST", sc.config.Prefix+route, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(context.WithValue(req.Context(), callerKey{}, caller))
+
+	res := &internalResponse{header: http.Header{}}
+	h(res, req)
+	return res, nil
+}
+
+// internalResponse collects the response to an internalRequest
+type internalResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *internalResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *internalResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
 	}
 }
 
-func fatalf(format string, args ...interface{}) {
-	if logger != nil {
-		logger.Fatalf(format, args...)
-	} else if DEBUG {
-		log.Fatalf(format, args...)
+func (r *internalResponse) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
 	}
+	return r.body.Write(b)
 }